@@ -0,0 +1,159 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogLayout is the suffix of rotated access log files.
+const accessLogLayout = "20060102T150405"
+
+var accessLogLines = newCounter("freegeoip_dns_access_log_lines_total", "Access log lines, by result: written, dropped or error.", "result")
+
+// accessLog writes a JSON line for every answer to a file, rotated when
+// it reaches rotateSize bytes or is a day old. Rotated files older than
+// maxAge, or beyond maxSize bytes in total, are deleted, oldest first.
+// Zero limits are not enforced.
+type accessLog struct {
+	file       string
+	rotateSize int64
+	maxAge     time.Duration
+	maxSize    int64
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	created time.Time
+	purged  time.Time // last purge, on the monotonic clock
+}
+
+// open opens the access log file for appending.
+func (l *accessLog) open() error {
+	f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.w, l.size, l.created = f, bufio.NewWriter(f), st.Size(), timeNow()
+	if l.size > 0 {
+		// Rebase the age of the file on the monotonic clock, so that
+		// wall clock changes don't rotate it early or late.
+		age := wallNow().Sub(st.ModTime())
+		if age > 24*time.Hour {
+			age = 24 * time.Hour
+		}
+		if age > 0 {
+			l.created = l.created.Add(-age)
+		}
+	}
+	return nil
+}
+
+// rotateDue reports whether the current file is to be rotated at now,
+// for its size or age.
+func (l *accessLog) rotateDue(now time.Time) bool {
+	return (l.rotateSize > 0 && l.size >= l.rotateSize) || now.Sub(l.created) >= 24*time.Hour
+}
+
+// rotate renames the current file with its rotation time and opens a new
+// one, then purges the expired files.
+func (l *accessLog) rotate(now time.Time) error {
+	l.w.Flush()
+	l.f.Close()
+	if err := os.Rename(l.file, l.file+"."+now.UTC().Format(accessLogLayout)); err != nil {
+		return err
+	}
+	l.purge(now)
+	return l.open()
+}
+
+// rotated returns the rotated files, oldest first.
+func (l *accessLog) rotated() []string {
+	files, _ := filepath.Glob(l.file + ".*")
+	var ret []string
+	for _, f := range files {
+		if _, err := time.Parse(accessLogLayout, strings.TrimPrefix(f, l.file+".")); err == nil {
+			ret = append(ret, f)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// purge deletes the rotated files older than maxAge or beyond maxSize.
+func (l *accessLog) purge(now time.Time) {
+	files := l.rotated()
+	var total int64
+	for i := len(files) - 1; i >= 0; i-- {
+		st, err := os.Stat(files[i])
+		if err != nil {
+			continue
+		}
+		t, _ := time.Parse(accessLogLayout, strings.TrimPrefix(files[i], l.file+"."))
+		total += st.Size()
+		if (l.maxAge > 0 && now.Sub(t) > l.maxAge) || (l.maxSize > 0 && total > l.maxSize) {
+			if err := os.Remove(files[i]); err != nil {
+				log.Println("access log:", err)
+			}
+		}
+	}
+}
+
+// run writes the answers to the log.
+func (l *accessLog) run() {
+	queue := answerQueue(sinkQueueLen, accessLogLines)
+	for a := range queue {
+		b, _ := json.Marshal(newQueryEvent(a))
+		l.mu.Lock()
+		n, err := l.w.Write(append(b, '\n'))
+		l.size += int64(n)
+		l.mu.Unlock()
+		if err != nil {
+			accessLogLines.inc("error")
+			continue
+		}
+		accessLogLines.inc("written")
+	}
+}
+
+// maintain flushes the log, and rotates it if due or else purges the
+// expired files, at most every minute. It is run every second by the
+// access-log-rotate task.
+func (l *accessLog) maintain() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.w.Flush()
+	switch now := timeNow(); {
+	case l.rotateDue(now):
+		l.purged = now
+		if rerr := l.rotate(wallNow()); err == nil {
+			err = rerr
+		}
+	case now.Sub(l.purged) >= time.Minute:
+		// Expire old files even without rotations.
+		l.purged = now
+		l.purge(wallNow())
+	}
+	if err != nil {
+		return fmt.Errorf("access log: %v", err)
+	}
+	return nil
+}
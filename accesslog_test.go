@@ -0,0 +1,91 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessLogClockJumps(t *testing.T) {
+	clk := setTestClock(t)
+	for _, tc := range []struct {
+		jump time.Duration // of the system clock between the last write and the reopening
+		due  time.Duration // rotation time after the reopening
+	}{
+		// The file seems written in the future, its age is not negative.
+		{-time.Hour, 24 * time.Hour},
+		{time.Hour, 23 * time.Hour},
+		// The file is rotated at once, but not older than a day.
+		{48 * time.Hour, 0},
+	} {
+		file := filepath.Join(t.TempDir(), "access.log")
+		if err := ioutil.WriteFile(file, []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := clk.wall()
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		clk.jump(tc.jump)
+		l := &accessLog{file: file}
+		if err := l.open(); err != nil {
+			t.Fatal(err)
+		}
+		l.f.Close()
+		opened := clk.now()
+		if tc.due > 0 && l.rotateDue(opened.Add(tc.due-time.Second)) {
+			t.Errorf("clock stepped by %v: got the file rotated before %v", tc.jump, tc.due)
+		}
+		if !l.rotateDue(opened.Add(tc.due)) {
+			t.Errorf("clock stepped by %v: got the file not rotated after %v", tc.jump, tc.due)
+		}
+	}
+}
+
+func TestAccessLogPurge(t *testing.T) {
+	clk := setTestClock(t)
+	file := filepath.Join(t.TempDir(), "access.log")
+	l := &accessLog{file: file, maxAge: time.Hour}
+	if err := l.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.f.Close()
+	expired := func() string {
+		name := file + "." + clk.wall().Add(-2*time.Hour).UTC().Format(accessLogLayout)
+		if err := ioutil.WriteFile(name, []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	purged := func(name string) bool {
+		_, err := os.Stat(name)
+		return os.IsNotExist(err)
+	}
+
+	name := expired()
+	if err := l.maintain(); err != nil {
+		t.Fatal(err)
+	}
+	if !purged(name) {
+		t.Error("expired file kept by the first run")
+	}
+	// Purges run at most every minute, whatever the wall clock.
+	clk.advance(time.Second)
+	name = expired()
+	l.maintain()
+	if purged(name) {
+		t.Error("expired file purged again within a minute")
+	}
+	clk.advance(time.Minute)
+	l.maintain()
+	if !purged(name) {
+		t.Error("expired file kept after a minute")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tuning of adaptive timeouts: the timeout is adaptiveFactor times the
+// adaptiveQuantile of the last adaptiveWindow latencies, recomputed every
+// adaptiveEvery of them once there are at least that many.
+const (
+	adaptiveWindow   = 512
+	adaptiveEvery    = 32
+	adaptiveQuantile = 0.99
+	adaptiveFactor   = 2
+)
+
+// resolveTimeouts tunes the hostname resolution timeout, set with
+// -resolve-timeout-adaptive. A nil adaptiveTimeout keeps the timeout
+// given.
+var resolveTimeouts *adaptiveTimeout
+
+// tuneResolveTimeout makes the hostname resolution timeout adaptive,
+// between floor and ceiling, and exports it.
+func tuneResolveTimeout(floor, ceiling time.Duration) {
+	resolveTimeouts = newAdaptiveTimeout(floor, ceiling)
+	newGaugeFunc("freegeoip_dns_resolve_timeout_seconds", "Hostname resolution timeout tuned by -resolve-timeout-adaptive.", func() float64 {
+		return resolveTimeouts.timeout(0).Seconds()
+	})
+}
+
+// adaptiveTimeout is a timeout tuned to the observed latency, between a
+// floor and a ceiling, so that answers don't wait out a timeout sized
+// for the worst upstream conditions when they're good, nor give up too
+// soon when they degrade. Calls that time out are observed as taking the
+// timeout, raising it while they are more than 1% of the calls.
+type adaptiveTimeout struct {
+	floor   time.Duration
+	ceiling time.Duration
+	current int64 // time.Duration, atomic
+
+	mu      sync.Mutex
+	samples []time.Duration // ring of the last latencies
+	next    int
+	seen    int // samples since the last tuning
+}
+
+// newAdaptiveTimeout returns a timeout between floor and ceiling, at the
+// ceiling until enough latencies are observed.
+func newAdaptiveTimeout(floor, ceiling time.Duration) *adaptiveTimeout {
+	if floor > ceiling {
+		floor = ceiling
+	}
+	return &adaptiveTimeout{floor: floor, ceiling: ceiling, current: int64(ceiling)}
+}
+
+// timeout returns the current timeout, or def if a is nil.
+func (a *adaptiveTimeout) timeout(def time.Duration) time.Duration {
+	if a == nil {
+		return def
+	}
+	return time.Duration(atomic.LoadInt64(&a.current))
+}
+
+// observe records the latency d of a call.
+func (a *adaptiveTimeout) observe(d time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.samples) < adaptiveWindow {
+		a.samples = append(a.samples, d)
+	} else {
+		a.samples[a.next] = d
+		a.next = (a.next + 1) % adaptiveWindow
+	}
+	if a.seen++; a.seen < adaptiveEvery {
+		return
+	}
+	a.seen = 0
+	sorted := append([]time.Duration(nil), a.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	t := adaptiveFactor * sorted[int(float64(len(sorted)-1)*adaptiveQuantile)]
+	if t < a.floor {
+		t = a.floor
+	}
+	if t > a.ceiling {
+		t = a.ceiling
+	}
+	atomic.StoreInt64(&a.current, int64(t))
+}
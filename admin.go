@@ -0,0 +1,113 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serveAdmin serves the HTTP admin endpoints on addr.
+func serveAdmin(network, addr string, h *handle) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, h.adminMux())
+}
+
+// adminMux returns the handler of the admin endpoints of h.
+func (h *handle) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/dbmeta", h.info)
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/ready", h.readyHandler)
+	mux.HandleFunc("/schema", h.schemaHandler)
+	mux.HandleFunc("/features", h.featuresHandler)
+	if h.dbKey != "" {
+		mux.HandleFunc("/db/file", serveDBFile(h.info, &fileChecksum{}, h.dbKeyAuthorized))
+	}
+	if h.adminKey != "" {
+		mux.HandleFunc("/db/rollback", h.adminOnly(h.rollbackHandler))
+		// The traffic stats tell who queries the server and from where,
+		// and are as privileged as their DNS counterpart signed with TSIG.
+		if h.geoStats != nil {
+			mux.HandleFunc("/stats/continents", h.adminOnly(h.statsHandler))
+		}
+		if h.prefixStats != nil {
+			mux.HandleFunc("/stats/prefixes", h.adminOnly(h.prefixStatsHandler))
+		}
+	}
+	if h.cluster != nil {
+		mux.HandleFunc("/cluster/stats", h.cluster.serveStats)
+		mux.HandleFunc("/cluster", h.cluster.serveAggregate)
+		mux.HandleFunc("/cluster/db", h.cluster.serveDB(h.info, &fileChecksum{}))
+		mux.HandleFunc("/cluster/cache", h.cluster.serveCache(h.cache))
+	}
+	return mux
+}
+
+// rollbackHandler restores a previous database version on POST. The
+// version query parameter selects it, defaulting to the newest one.
+func (h *handle) rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	v, err := h.db.rollback(r.FormValue("version"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "rolled back to", v)
+}
+
+// readyHandler reports whether the server is ready to answer queries,
+// for use as a readiness probe.
+func (h *handle) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.db.ready() {
+		http.Error(w, "database not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	if h.cache != nil && h.cache.warmingUp() {
+		http.Error(w, "warming up cache", http.StatusServiceUnavailable)
+		return
+	}
+	if err := h.plugins.failed(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// dbKeyAuthorized reports whether r carries the -db-key as a bearer
+// token.
+func (h *handle) dbKeyAuthorized(r *http.Request) bool {
+	return bearerAuthorized(r, h.dbKey)
+}
+
+// adminOnly returns f served to the requests with the -admin-key as a
+// bearer token, and refused to the others.
+func (h *handle) adminOnly(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !bearerAuthorized(r, h.adminKey) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// bearerAuthorized reports whether r carries key, which must not be
+// empty, as a bearer token. The comparison is constant-time so that the
+// key can't be guessed from response times.
+func bearerAuthorized(r *http.Request, key string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return key != "" && subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// adminRequest sends a request to the admin endpoints of h, with key as
+// bearer token if not empty, and returns the status.
+func adminRequest(h *handle, method, path, key string) int {
+	r := httptest.NewRequest(method, path, nil)
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	h.adminMux().ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAdminRollbackAuth(t *testing.T) {
+	h := newTestHandle(t, fixtureDB)
+	if got := adminRequest(h, "POST", "/db/rollback", ""); got != http.StatusNotFound {
+		t.Errorf("without -admin-key: got status %d, want %d", got, http.StatusNotFound)
+	}
+	h.adminKey = "secret"
+	for _, tc := range []struct {
+		key  string
+		want int
+	}{
+		{"", http.StatusForbidden},
+		{"wrong", http.StatusForbidden},
+		// The fixture is a local file, which can't be rolled back.
+		{"secret", http.StatusBadRequest},
+	} {
+		if got := adminRequest(h, "POST", "/db/rollback", tc.key); got != tc.want {
+			t.Errorf("with key %q: got status %d, want %d", tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestAdminStatsAuth(t *testing.T) {
+	h := newTestHandle(t, fixtureDB)
+	h.geoStats = newContinentStats(5)
+	h.prefixStats = newPrefixStats(5, 100)
+	paths := []string{"/stats/continents", "/stats/prefixes"}
+	for _, path := range paths {
+		if got := adminRequest(h, "GET", path, ""); got != http.StatusNotFound {
+			t.Errorf("%s without -admin-key: got status %d, want %d", path, got, http.StatusNotFound)
+		}
+	}
+	h.adminKey = "secret"
+	for _, path := range paths {
+		for _, tc := range []struct {
+			key  string
+			want int
+		}{
+			{"", http.StatusForbidden},
+			{"wrong", http.StatusForbidden},
+			{"secret", http.StatusOK},
+		} {
+			if got := adminRequest(h, "GET", path, tc.key); got != tc.want {
+				t.Errorf("%s with key %q: got status %d, want %d", path, tc.key, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestAdminFeaturesAuth(t *testing.T) {
+	defer switches.set(switchResolve, true)
+	h := newTestHandle(t, fixtureDB)
+	const path = "/features?name=resolve&enabled=false"
+	if got := adminRequest(h, "GET", "/features", ""); got != http.StatusOK {
+		t.Errorf("GET: got status %d, want %d", got, http.StatusOK)
+	}
+	if got := adminRequest(h, "POST", path, ""); got != http.StatusForbidden {
+		t.Errorf("POST without -admin-key: got status %d, want %d", got, http.StatusForbidden)
+	}
+	h.adminKey = "secret"
+	for _, key := range []string{"", "wrong"} {
+		if got := adminRequest(h, "POST", path, key); got != http.StatusForbidden {
+			t.Errorf("POST with key %q: got status %d, want %d", key, got, http.StatusForbidden)
+		}
+	}
+	if !switches.on(switchResolve) {
+		t.Fatal("got resolve switched off by unauthorized requests")
+	}
+	if got := adminRequest(h, "POST", path, "secret"); got != http.StatusOK {
+		t.Errorf("POST with the key: got status %d, want %d", got, http.StatusOK)
+	}
+	if switches.on(switchResolve) {
+		t.Error("got resolve still on after an authorized request")
+	}
+}
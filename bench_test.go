@@ -0,0 +1,71 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var benchDB = flag.String("bench-db", fixtureDB, "IP database looked up by the benchmarks")
+
+// benchWriter is a dns.ResponseWriter discarding the replies, keeping
+// the rcode of the last one.
+type benchWriter struct {
+	rcode int
+}
+
+var benchAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+
+func (w *benchWriter) LocalAddr() net.Addr  { return benchAddr }
+func (w *benchWriter) RemoteAddr() net.Addr { return benchAddr }
+func (w *benchWriter) Close() error         { return nil }
+func (w *benchWriter) TsigStatus() error    { return nil }
+func (w *benchWriter) TsigTimersOnly(bool)  {}
+func (w *benchWriter) Hijack()              {}
+
+func (w *benchWriter) WriteMsg(m *dns.Msg) error {
+	w.rcode = m.Rcode
+	return nil
+}
+
+func (w *benchWriter) Write(b []byte) (int, error) {
+	w.rcode = int(b[3] & 0xF)
+	return len(b), nil
+}
+
+// benchmarkQuery measures the time the handler takes to answer a TXT
+// query for a literal IP, through the fast lane if fast, with an EDNS
+// record if edns.
+func benchmarkQuery(b *testing.B, fast, edns bool) {
+	h := newTestHandle(b, *benchDB)
+	if fast {
+		if h.fast = h.newFastLane(); h.fast == nil {
+			b.Fatal("the fast lane is off")
+		}
+	}
+	r := txtQuery("8.8.8.8")
+	if edns {
+		r.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	w := &benchWriter{}
+	h.ServeDNS(w, r)
+	if w.rcode != dns.RcodeSuccess {
+		b.Fatalf("got rcode %s, want NOERROR", dns.RcodeToString[w.rcode])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeDNS(w, r)
+	}
+}
+
+func BenchmarkFastLane(b *testing.B)       { benchmarkQuery(b, true, true) }
+func BenchmarkFastLaneNoEDNS(b *testing.B) { benchmarkQuery(b, true, false) }
+func BenchmarkGeneralPath(b *testing.B)    { benchmarkQuery(b, false, true) }
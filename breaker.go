@@ -0,0 +1,112 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// resolveBreaker is the circuit breaker of hostname resolution, set with
+// -resolve-breaker. A nil breaker is always closed.
+var resolveBreaker *breaker
+
+var resolveShortCircuits = newCounter("freegeoip_dns_resolve_short_circuits_total", "Hostname queries answered SERVFAIL without resolving, while the resolve breaker was open.")
+
+func init() {
+	newGaugeFunc("freegeoip_dns_resolve_breaker_open", "Whether hostname resolution is suspended by the resolve breaker.", func() float64 {
+		if resolveBreaker != nil && resolveBreaker.isOpen() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// breaker is a circuit breaker. It opens after threshold consecutive
+// failures, failing calls at once for a cooldown, then lets a single call
+// through: it closes if that call succeeds, and opens again for twice the
+// cooldown, up to maxCooldown, if it fails.
+type breaker struct {
+	mu          sync.Mutex
+	threshold   int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+	failures    int
+	backoff     time.Duration // cooldown of the breaker, 0 if closed
+	until       time.Time     // end of the cooldown
+	probing     bool          // a call is let through after the cooldown
+}
+
+// newBreaker returns a closed breaker.
+func newBreaker(threshold int, cooldown, maxCooldown time.Duration) *breaker {
+	if maxCooldown < cooldown {
+		maxCooldown = cooldown
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown, maxCooldown: maxCooldown}
+}
+
+// allow reports whether a call may be made now. Calls allowed must be
+// followed by record.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.backoff == 0:
+		return true
+	case b.probing || time.Now().Before(b.until):
+		resolveShortCircuits.inc()
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the result of a call allowed.
+func (b *breaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.backoff != 0 {
+			log.Println("hostname resolution recovered, closing the resolve breaker")
+		}
+		b.failures, b.backoff, b.probing = 0, 0, false
+		return
+	}
+	b.failures++
+	switch {
+	case b.probing:
+		b.probing = false
+		if b.backoff *= 2; b.backoff > b.maxCooldown {
+			b.backoff = b.maxCooldown
+		}
+	case b.backoff == 0 && b.failures >= b.threshold:
+		b.backoff = b.cooldown
+	default:
+		return
+	}
+	b.until = time.Now().Add(b.backoff)
+	log.Printf("WARNING %d hostname resolutions failed in a row, suspending resolution for %s", b.failures, b.backoff)
+}
+
+// isOpen reports whether calls are failed at once.
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backoff != 0
+}
+
+// resolveFailed reports whether err of a hostname resolution is a failure
+// of the resolvers, rather than an answer.
+func resolveFailed(err error) bool {
+	return err == errResolveTimeout || err == errResolveFailed
+}
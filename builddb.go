@@ -0,0 +1,230 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// buildDBColumns are the CSV columns build-db reads, besides network.
+var buildDBColumns = []string{
+	"continent_code", "country_code", "country_name", "region_code", "region_name",
+	"city", "postal_code", "latitude", "longitude", "time_zone", "metro_code",
+}
+
+// The test database, covering edge cases of the lookups and responses.
+//go:generate env SOURCE_DATE_EPOCH=1767225600 go run . build-db -in testdata/fixture.csv -out testdata/fixture.mmdb
+
+// buildDBCmd compiles a CSV of networks and their location into a mmdb
+// file the server can load.
+func buildDBCmd(args []string) error {
+	fs := flag.NewFlagSet("build-db", flag.ExitOnError)
+	in := fs.String("in", "", "CSV file with a header row, - for stdin")
+	out := fs.String("out", "", "mmdb file to write, gzipped if it ends in .gz")
+	lang := fs.String("lang", "en", "Language of the names in the CSV")
+	dbType := fs.String("type", "freegeoip-dns-Custom", "Database type written in the metadata")
+	desc := fs.String("description", "Custom geolocation data", "Description written in the metadata")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: freegeoip-dns build-db -in networks.csv -out custom.mmdb.gz")
+		fmt.Fprintf(fs.Output(), "The CSV has a network column, in CIDR notation, and any of: %s.\n", strings.Join(buildDBColumns, ", "))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *in == "" || *out == "" {
+		fs.Usage()
+		return errors.New("build-db: -in and -out are required")
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return fmt.Errorf("build-db: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	rows, err := readNetworks(r, *lang)
+	if err != nil {
+		return fmt.Errorf("build-db: %s: %v", *in, err)
+	}
+	mw := newMMDBWriter(*dbType, *desc, []string{*lang})
+	for _, row := range rows {
+		mw.insert(row.network, row.record)
+	}
+	var b bytes.Buffer
+	if _, err := mw.WriteTo(&b); err != nil {
+		return fmt.Errorf("build-db: %v", err)
+	}
+	db, err := maxminddb.FromBytes(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("build-db: invalid database written: %v", err)
+	}
+	if err := db.Verify(); err != nil {
+		return fmt.Errorf("build-db: invalid database written: %v", err)
+	}
+	if err := writeDB(*out, b.Bytes()); err != nil {
+		return fmt.Errorf("build-db: %v", err)
+	}
+	fmt.Printf("%s: %d networks, %d nodes, %d bytes\n", *out, len(rows), db.Metadata.NodeCount, b.Len())
+	return nil
+}
+
+// networkRow is a network and the record of its addresses.
+type networkRow struct {
+	network *net.IPNet
+	record  map[string]interface{}
+}
+
+// readNetworks reads the CSV rows of networks, sorted from the least to
+// the most specific so that nested networks override their parents.
+func readNetworks(r io.Reader, lang string) ([]networkRow, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	if _, ok := cols["network"]; !ok {
+		return nil, errors.New("missing network column")
+	}
+	var rows []networkRow
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		_, network, err := net.ParseCIDR(get("network"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		record, err := networkRecord(get, lang)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rows = append(rows, networkRow{network: network, record: record})
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return prefixLen(rows[i].network) < prefixLen(rows[j].network)
+	})
+	return rows, nil
+}
+
+// prefixLen returns the prefix length of network in the IPv6 tree.
+func prefixLen(network *net.IPNet) int {
+	ones, size := network.Mask.Size()
+	if size == 32 {
+		ones += 96
+	}
+	return ones
+}
+
+// networkRecord returns the record of a CSV row, in the layout of the
+// GeoIP2 City databases, with the values of the columns given by get.
+func networkRecord(get func(name string) string, lang string) (map[string]interface{}, error) {
+	rec := make(map[string]interface{})
+	set := func(key, field string, v interface{}) {
+		m, ok := rec[key].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			rec[key] = m
+		}
+		m[field] = v
+	}
+	names := func(s string) map[string]interface{} {
+		return map[string]interface{}{lang: s}
+	}
+	if v := get("continent_code"); v != "" {
+		set("continent", "code", v)
+	}
+	if v := get("country_code"); v != "" {
+		set("country", "iso_code", strings.ToUpper(v))
+	}
+	if v := get("country_name"); v != "" {
+		set("country", "names", names(v))
+	}
+	if code, name := get("region_code"), get("region_name"); code != "" || name != "" {
+		sub := make(map[string]interface{})
+		if code != "" {
+			sub["iso_code"] = code
+		}
+		if name != "" {
+			sub["names"] = names(name)
+		}
+		rec["subdivisions"] = []interface{}{sub}
+	}
+	if v := get("city"); v != "" {
+		set("city", "names", names(v))
+	}
+	if v := get("postal_code"); v != "" {
+		set("postal", "code", v)
+	}
+	for _, c := range []string{"latitude", "longitude"} {
+		if v := get(c); v != "" {
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", c, v)
+			}
+			set("location", c, x)
+		}
+	}
+	if v := get("time_zone"); v != "" {
+		set("location", "time_zone", v)
+	}
+	if v := get("metro_code"); v != "" {
+		x, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metro_code %q", v)
+		}
+		set("location", "metro_code", uint16(x))
+	}
+	return rec, nil
+}
+
+// writeDB writes the database b to file, gzipped if its name ends in
+// .gz, through a temporary file renamed when complete.
+func writeDB(file string, b []byte) error {
+	if strings.HasSuffix(file, ".gz") {
+		var zb bytes.Buffer
+		zw := gzip.NewWriter(&zb)
+		zw.Write(b)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		b = zb.Bytes()
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,35 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestFixture checks that the fixture database is the one built from
+// its CSV, as by the go:generate line of builddb.go, so that it can't
+// drift from the CSV or depend on the build.
+func TestFixture(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1767225600")
+	out := filepath.Join(t.TempDir(), "fixture.mmdb")
+	if err := buildDBCmd([]string{"-in", "testdata/fixture.csv", "-out", out}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(fixtureDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes built from testdata/fixture.csv, different from the %d of %s: run go generate", len(got), len(want), fixtureDB)
+	}
+}
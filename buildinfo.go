@@ -0,0 +1,128 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"sort"
+)
+
+// commit and buildDate are set at build time with
+//
+//	go build -ldflags "-X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// and otherwise taken from the VCS info embedded by the go command.
+var (
+	commit    string
+	buildDate string
+)
+
+// featureFlags maps the flags enabling optional features to the names of
+// the features.
+var featureFlags = map[string]string{
+	"access-log":   "access-log",
+	"admin-addr":   "admin",
+	"asn-db":       "hosting",
+	"cloud-ranges": "cloud",
+	"db-key":       "db-distribution",
+	"fallback":     "fallback",
+	"geo-routes":   "geo-routing",
+	"grpc-addr":    "grpc",
+	"hmac-key":     "signing",
+	"https-addr":   "doh",
+	"log-sink":     "log-sink",
+	"max-qps":      "throttle",
+	"mirror":       "mirror",
+	"otlp-logs":    "otlp-logs",
+	"peer":         "cluster",
+	"plugin":       "plugins",
+	"privacy-mode": "privacy",
+	"publish":      "publish",
+	"ratelimit":    "ratelimit",
+	"record":       "record",
+	"script":       "scripting",
+	"threat-feed":  "threat-feeds",
+	"tls-addr":     "dot",
+	"tor-exits":    "tor",
+	"tsig-key":     "tsig",
+	"unix-socket":  "unix",
+	"uri-template": "uri",
+}
+
+// buildInfo describes the running binary.
+type buildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildDate string   `json:"build_date"`
+	GoVersion string   `json:"go_version"`
+	Features  []string `json:"features"`
+}
+
+// getBuildInfo returns the build info, with the features enabled by the
+// command line flags.
+func getBuildInfo() *buildInfo {
+	bi := &buildInfo{
+		Version:   VERSION,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Features:  []string{},
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && bi.Commit == "":
+				bi.Commit = s.Value
+			case s.Key == "vcs.time" && bi.BuildDate == "":
+				bi.BuildDate = s.Value
+			}
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if name, ok := featureFlags[f.Name]; ok && f.Value.String() != f.DefValue {
+			bi.Features = append(bi.Features, name)
+		}
+	})
+	if f := flag.Lookup("db-load"); f != nil && f.Value.String() == "mmap" {
+		bi.Features = append(bi.Features, "mmap")
+	}
+	sort.Strings(bi.Features)
+	return bi
+}
+
+// String returns the version, commit and Go version in a single line.
+func (bi *buildInfo) String() string {
+	s := "freegeoip-dns " + VERSION
+	if bi.Commit != "" {
+		c := bi.Commit
+		if len(c) > 12 {
+			c = c[:12]
+		}
+		s += " " + c
+	}
+	return s + " " + bi.GoVersion
+}
+
+// writeJSON writes the build info as JSON.
+func (bi *buildInfo) writeJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(bi, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// exportBuildInfo exports the build info as the labels of the constant
+// freegeoip_dns_build_info metric.
+func exportBuildInfo(bi *buildInfo) {
+	g := newGauge("freegeoip_dns_build_info", "Build info of the running binary, always 1.", "version", "commit", "build_date", "go_version")
+	g.set(1, bi.Version, bi.Commit, bi.BuildDate, bi.GoVersion)
+}
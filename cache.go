@@ -0,0 +1,280 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var cacheLookups = newCounter("freegeoip_dns_cache_lookups_total", "Lookup cache lookups, by result: hit or miss.", "result")
+
+// lookupCache is an LRU cache of the database records of the IPs looked
+// up, flushed when a database is loaded.
+type lookupCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[[16]byte]*list.Element
+	// gen is incremented by flush, so that records looked up in the
+	// previous database are not added after it.
+	gen uint64
+	// warming is set while the cache is warmed up.
+	warming int32
+}
+
+type cacheEntry struct {
+	key   [16]byte
+	query *Query
+}
+
+func newLookupCache(size int) *lookupCache {
+	c := &lookupCache{size: size, ll: list.New(), items: make(map[[16]byte]*list.Element, size)}
+	newGaugeFunc("freegeoip_dns_cache_entries", "Records in the lookup cache.", func() float64 {
+		return float64(c.len())
+	})
+	return c
+}
+
+func cacheKey(ip net.IP) (k [16]byte) {
+	copy(k[:], ip.To16())
+	return k
+}
+
+// get returns the cached record of ip and the current generation.
+func (c *lookupCache) get(ip net.IP) (*Query, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[cacheKey(ip)]
+	if !ok {
+		return nil, c.gen, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*cacheEntry).query, c.gen, true
+}
+
+// add caches the record of ip looked up in generation gen, evicting the
+// least recently used record if full.
+func (c *lookupCache) add(ip net.IP, query *Query, gen uint64) {
+	k := cacheKey(ip)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if e, ok := c.items[k]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*cacheEntry).query = query
+		return
+	}
+	c.items[k] = c.ll.PushFront(&cacheEntry{key: k, query: query})
+	if c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+}
+
+// flush empties the cache.
+func (c *lookupCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[[16]byte]*list.Element, c.size)
+	c.gen++
+}
+
+func (c *lookupCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// ips returns the cached IPs, most recently used first.
+func (c *lookupCache) ips() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make([]string, 0, c.ll.Len())
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		k := e.Value.(*cacheEntry).key
+		ret = append(ret, net.IP(k[:]).String())
+	}
+	return ret
+}
+
+// warmingUp reports whether the cache is being warmed up.
+func (c *lookupCache) warmingUp() bool {
+	return atomic.LoadInt32(&c.warming) != 0
+}
+
+// lookup returns the database record of the queried ip, from the cache
+// if enabled and switched on. Unless h.tunnelEndpoints is set, addresses
+// embedding an IPv4 address are looked up by it. Client addresses are
+// looked up with lookupClient, so that they are not kept nor shared with
+// peers.
+func (h *handle) lookup(ip net.IP) (*Query, error) {
+	if !h.tunnelEndpoints {
+		ip = embeddedIPv4(ip)
+	}
+	var gen uint64
+	cache := h.cache
+	if !switches.on(switchCache) {
+		cache = nil
+	}
+	if cache != nil {
+		query, g, ok := cache.get(ip)
+		if ok {
+			cacheLookups.inc("hit")
+			return query, nil
+		}
+		cacheLookups.inc("miss")
+		gen = g
+	}
+	query := new(Query)
+	if err := h.db.Lookup(ip, query); err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		cache.add(ip, query, gen)
+	}
+	return query, nil
+}
+
+// lookupClient returns the database record of the client address ip, as
+// lookup does but never through the cache.
+func (h *handle) lookupClient(ip net.IP) (*Query, error) {
+	if !h.tunnelEndpoints {
+		ip = embeddedIPv4(ip)
+	}
+	query := new(Query)
+	if err := h.db.Lookup(ip, query); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// warmCache looks up the IPs in the seed file, if any, and in the caches
+// of the cluster peers with fromPeers, once the database is loaded. The
+// caller sets the cache warming, so that the server is not ready until
+// it is done.
+func (h *handle) warmCache(file string, fromPeers bool) {
+	defer atomic.StoreInt32(&h.cache.warming, 0)
+	var seeds []net.IP
+	if file != "" {
+		ips, err := readSeeds(file)
+		if err != nil {
+			log.Println("cache warm-up:", err)
+		}
+		seeds = append(seeds, ips...)
+	}
+	if fromPeers && h.cluster != nil {
+		seeds = append(seeds, h.cluster.cacheSeeds()...)
+	}
+	for !h.db.ready() {
+		time.Sleep(time.Second)
+	}
+	start := time.Now()
+	for _, ip := range seeds {
+		if h.cache.len() >= h.cache.size {
+			break
+		}
+		h.lookup(ip)
+	}
+	log.Printf("cache warm-up: %d records from %d seeds in %s", h.cache.len(), len(seeds), time.Since(start).Round(time.Millisecond))
+}
+
+// readSeeds returns the IPs of the seed file, one per line. Blank lines
+// and lines starting with # are skipped.
+func readSeeds(file string) ([]net.IP, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ips []net.IP
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ip := parseIP(line)
+		if ip == nil {
+			return ips, fmt.Errorf("%s:%d: invalid IP %q", file, n, line)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, s.Err()
+}
+
+// serveCache serves the IPs in the lookup cache, most recently used
+// first, for peers warming up theirs.
+func (c *cluster) serveCache(cache *lookupCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !c.authorized(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		ips := []string{}
+		if cache != nil {
+			ips = cache.ips()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ips)
+	}
+}
+
+// cacheSeeds returns the IPs in the lookup caches of the peers.
+func (c *cluster) cacheSeeds() []net.IP {
+	var ret []net.IP
+	for _, peer := range c.peers {
+		ips, err := c.fetchCache(peer)
+		if err != nil {
+			log.Println("cache warm-up:", err)
+			continue
+		}
+		ret = append(ret, ips...)
+	}
+	return ret
+}
+
+// fetchCache returns the IPs in the lookup cache of peer.
+func (c *cluster) fetchCache(peer string) ([]net.IP, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(peer, "/")+"/cluster/cache", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(clusterKeyHeader, c.key)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", peer, resp.Status)
+	}
+	var ips []string
+	if err = json.NewDecoder(resp.Body).Decode(&ips); err != nil {
+		return nil, fmt.Errorf("%s: %v", peer, err)
+	}
+	var ret []net.IP
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip != nil {
+			ret = append(ret, ip)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"strconv"
+)
+
+// candidate is an alternate location of an IP, in databases that list
+// them under "candidates", each with the confidence, 0 to 100, that the
+// IP is located there.
+type candidate struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code" json:"iso_code,omitempty"`
+	} `maxminddb:"country" json:"country,omitempty"`
+	City struct {
+		Names map[string]string `maxminddb:"names" json:"names,omitempty"`
+	} `maxminddb:"city" json:"city,omitempty"`
+	Confidence uint16 `maxminddb:"confidence" json:"confidence,omitempty"`
+}
+
+// candidateFields returns the fields of the n candidates of query with
+// the highest confidence, numbered from 1. It returns nothing for
+// databases without candidates.
+func candidateFields(query *Query, n int, lang string) []field {
+	cs := append([]candidate(nil), query.Candidates...)
+	sort.SliceStable(cs, func(i, j int) bool { return cs[i].Confidence > cs[j].Confidence })
+	if len(cs) > n {
+		cs = cs[:n]
+	}
+	var ret []field
+	for i, c := range cs {
+		prefix := "candidate" + strconv.Itoa(i+1) + "_"
+		ret = append(ret,
+			extraField(prefix+"country_code", c.Country.ISOCode),
+			extraField(prefix+"city", c.City.Names[lang]),
+			extraField(prefix+"confidence", strconv.Itoa(int(c.Confidence))))
+	}
+	return ret
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// ipEncodings are the names of the IP label encodings, besides dotted
+// IPv4 addresses, decoded by decodeIPLabel.
+var ipEncodings = []string{"hex", "base32", "decimal"}
+
+// optionLabels are the leading labels of query options other than
+// profiles, versions and formats.
+var optionLabels = []string{"debug", "dual", "omitempty"}
+
+// capabilities returns the answer to TXT queries at the apex of the
+// domain, describing what the server answers as key=value fields, so
+// that clients can discover features before querying.
+func (h *handle) capabilities() string {
+	var profileNames []string
+	for name := range profiles {
+		profileNames = append(profileNames, name)
+	}
+	sort.Slice(profileNames, func(i, j int) bool { return profiles[profileNames[i]] < profiles[profileNames[j]] })
+	var versionNames []string
+	for name := range versions {
+		versionNames = append(versionNames, name)
+	}
+	sort.Strings(versionNames)
+	var fields []string
+	for _, f := range queryFields(new(Query), net.IPv4zero, "") {
+		fields = append(fields, f.name)
+	}
+	return strings.Join([]string{
+		"service=freegeoip-dns/" + VERSION,
+		"types=TXT,LOC",
+		"formats=" + strings.Join(formatNames(), ","),
+		"versions=" + strings.Join(versionNames, ","),
+		"profiles=" + strings.Join(profileNames, ","),
+		"options=" + strings.Join(optionLabels, ","),
+		"fields=" + strings.Join(fields, ","),
+		"encodings=dotted," + strings.Join(ipEncodings, ","),
+	}, "    ")
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// defaultCloudRanges are the published range feeds of each provider.
+// Azure publishes its service tags under a URL that changes weekly, so
+// it must always be given explicitly.
+var defaultCloudRanges = map[string][]string{
+	"aws":        {"https://ip-ranges.amazonaws.com/ip-ranges.json"},
+	"gcp":        {"https://www.gstatic.com/ipranges/cloud.json"},
+	"cloudflare": {"https://www.cloudflare.com/ips-v4", "https://www.cloudflare.com/ips-v6"},
+	"azure":      nil,
+}
+
+// cloudParsers read a provider feed into a prefix table, with values in
+// the form provider/region.
+var cloudParsers = map[string]func(io.Reader, *prefixTable) error{
+	"aws":        parseAWSRanges,
+	"gcp":        parseGCPRanges,
+	"azure":      parseAzureRanges,
+	"cloudflare": parseCloudflareRanges,
+}
+
+func cloudValue(provider, region string) string {
+	if region == "" || strings.EqualFold(region, "global") {
+		return provider
+	}
+	return provider + "/" + region
+}
+
+func insertCIDR(t *prefixTable, cidr, v string) error {
+	n, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	t.insert(n, v)
+	return nil
+}
+
+func parseAWSRanges(r io.Reader, t *prefixTable) error {
+	var feed struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Region   string `json:"region"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Region     string `json:"region"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return err
+	}
+	for _, p := range feed.Prefixes {
+		if err := insertCIDR(t, p.IPPrefix, cloudValue("aws", p.Region)); err != nil {
+			return err
+		}
+	}
+	for _, p := range feed.IPv6Prefixes {
+		if err := insertCIDR(t, p.IPv6Prefix, cloudValue("aws", p.Region)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseGCPRanges(r io.Reader, t *prefixTable) error {
+	var feed struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return err
+	}
+	for _, p := range feed.Prefixes {
+		cidr := p.IPv4Prefix
+		if cidr == "" {
+			cidr = p.IPv6Prefix
+		}
+		if err := insertCIDR(t, cidr, cloudValue("gcp", p.Scope)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseAzureRanges(r io.Reader, t *prefixTable) error {
+	var feed struct {
+		Values []struct {
+			Properties struct {
+				Region          string   `json:"region"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return err
+	}
+	// Service tags overlap; insert the regional ones last so they win
+	// over the global tags covering the same prefixes.
+	for _, regional := range []bool{false, true} {
+		for _, v := range feed.Values {
+			if (v.Properties.Region != "") != regional {
+				continue
+			}
+			for _, cidr := range v.Properties.AddressPrefixes {
+				if err := insertCIDR(t, cidr, cloudValue("azure", v.Properties.Region)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func parseCloudflareRanges(r io.Reader, t *prefixTable) error {
+	return readPrefixes(r, t, "cloudflare")
+}
+
+// cloudSource is a provider range feed.
+type cloudSource struct {
+	provider string
+	srcs     []string
+}
+
+// cloudRanges identifies addresses in published cloud provider ranges.
+type cloudRanges struct {
+	sources []cloudSource
+	mu      sync.RWMutex
+	table   *prefixTable
+}
+
+// newCloudRanges parses specs in the form provider[=file-or-url] and
+// loads the feeds. Providers without a source use their published feed.
+func newCloudRanges(specs []string) (*cloudRanges, error) {
+	cr := &cloudRanges{}
+	for _, spec := range specs {
+		p := strings.SplitN(spec, "=", 2)
+		provider := strings.ToLower(p[0])
+		if _, ok := cloudParsers[provider]; !ok {
+			return nil, fmt.Errorf("unknown cloud provider %q", p[0])
+		}
+		src := cloudSource{provider: provider, srcs: defaultCloudRanges[provider]}
+		if len(p) == 2 {
+			src.srcs = strings.Split(p[1], ",")
+		}
+		if len(src.srcs) == 0 {
+			return nil, fmt.Errorf("cloud provider %q requires a source, e.g. %s=path", provider, provider)
+		}
+		cr.sources = append(cr.sources, src)
+	}
+	return cr, cr.load()
+}
+
+// load (re)reads all feeds into a new table, keeping the previous table
+// if any feed fails.
+func (cr *cloudRanges) load() error {
+	t := newPrefixTable()
+	for _, cs := range cr.sources {
+		for _, src := range cs.srcs {
+			rc, err := openSource(src)
+			if err != nil {
+				return fmt.Errorf("cloud ranges: %v", err)
+			}
+			err = cloudParsers[cs.provider](rc, t)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("cloud ranges: %s: %v", src, err)
+			}
+		}
+	}
+	cr.mu.Lock()
+	cr.table = t
+	cr.mu.Unlock()
+	return nil
+}
+
+// lookup returns provider/region for ip, or an empty string.
+func (cr *cloudRanges) lookup(ip net.IP) string {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	v, _ := cr.table.lookup(ip)
+	return v
+}
@@ -0,0 +1,255 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterKeyHeader carries the shared cluster key in peer requests.
+const clusterKeyHeader = "X-Cluster-Key"
+
+// topClients is the number of top clients shared with peers.
+const topClients = 20
+
+// banTable is a set of client addresses with expiry times.
+type banTable struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newBanTable() *banTable {
+	return &banTable{until: make(map[string]time.Time)}
+}
+
+// add bans client until the given time, unless already banned longer.
+func (b *banTable) add(client string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until.After(b.until[client]) {
+		b.until[client] = until
+	}
+}
+
+// banned reports whether client is currently banned.
+func (b *banTable) banned(client string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.until[client]
+	if ok && timeNow().After(until) {
+		delete(b.until, client)
+		return false
+	}
+	return ok
+}
+
+// list returns the current bans and drops the expired ones.
+func (b *banTable) list() map[string]time.Time {
+	now := timeNow()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := make(map[string]time.Time, len(b.until))
+	for c, until := range b.until {
+		if now.After(until) {
+			delete(b.until, c)
+			continue
+		}
+		ret[c] = until
+	}
+	return ret
+}
+
+// nodeStats are the statistics a node shares with its peers.
+type nodeStats struct {
+	Instance   string               `json:"instance"`
+	Time       time.Time            `json:"time"`
+	Queries    map[string]float64   `json:"queries"`
+	TopClients []keyCount           `json:"top_clients"`
+	Banned     map[string]time.Time `json:"banned"`
+	Error      string               `json:"error,omitempty"`
+}
+
+// cluster shares statistics and bans with a static list of peers.
+type cluster struct {
+	instance string
+	peers    []string
+	key      string
+	banTTL   time.Duration
+	client   *http.Client
+
+	top       *topN
+	offenders *banTable // clients refused locally, shared with peers
+	peerBans  *banTable // clients refused by peers
+	mu        sync.Mutex
+	peerStats map[string]*nodeStats
+}
+
+// newCluster returns a cluster of the peer admin endpoints, given as
+// base URLs, e.g. http://10.0.0.2:8080.
+func newCluster(instance string, peers []string, key string, banTTL time.Duration) *cluster {
+	return &cluster{
+		instance:  instance,
+		peers:     peers,
+		key:       key,
+		banTTL:    banTTL,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		top:       newTopN(1000),
+		offenders: newBanTable(),
+		peerBans:  newBanTable(),
+		peerStats: make(map[string]*nodeStats),
+	}
+}
+
+// refused records a client refused locally, so that peers refuse it too.
+func (c *cluster) refused(client string) {
+	c.offenders.add(client, timeNow().Add(c.banTTL))
+}
+
+// stats returns the local statistics. The bans are shared on the system
+// clock, at the time of the statistics.
+func (c *cluster) stats() *nodeStats {
+	now, wall := timeNow(), wallNow()
+	banned := c.offenders.list()
+	for client, until := range banned {
+		banned[client] = wall.Add(until.Sub(now)).UTC()
+	}
+	return &nodeStats{
+		Instance:   c.instance,
+		Time:       wall.UTC(),
+		Queries:    queriesTotal.snapshot(),
+		TopClients: c.top.top(topClients),
+		Banned:     banned,
+	}
+}
+
+// fetch returns the statistics of peer.
+func (c *cluster) fetch(peer string) (*nodeStats, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(peer, "/")+"/cluster/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(clusterKeyHeader, c.key)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", peer, resp.Status)
+	}
+	var ns nodeStats
+	if err = json.NewDecoder(resp.Body).Decode(&ns); err != nil {
+		return nil, fmt.Errorf("%s: %v", peer, err)
+	}
+	return &ns, nil
+}
+
+// poll fetches the statistics of all peers and imports their bans.
+// Unreachable peers are logged and kept with their error.
+//
+// The ban times of a peer are on its wall clock, so they are imported as
+// deadlines on the local monotonic clock, relative to the time of its
+// statistics: bans then last as long as on the peer, however skewed or
+// changed the clocks.
+func (c *cluster) poll() error {
+	for _, peer := range c.peers {
+		ns, err := c.fetch(peer)
+		if err != nil {
+			log.Println("cluster:", err)
+			ns = &nodeStats{Error: err.Error()}
+		}
+		now := timeNow()
+		for client, until := range ns.Banned {
+			if !ns.Time.IsZero() {
+				until = now.Add(until.Sub(ns.Time))
+			}
+			c.peerBans.add(client, until)
+		}
+		c.mu.Lock()
+		c.peerStats[peer] = ns
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// aggregate merges the local statistics with the last ones of each peer.
+func (c *cluster) aggregate() map[string]interface{} {
+	nodes := []*nodeStats{c.stats()}
+	c.mu.Lock()
+	for _, peer := range c.peers {
+		if ns, ok := c.peerStats[peer]; ok {
+			nodes = append(nodes, ns)
+		}
+	}
+	c.mu.Unlock()
+
+	queries := make(map[string]float64)
+	clients := make(map[string]uint64)
+	banned := make(map[string]time.Time)
+	for _, ns := range nodes {
+		for rcode, n := range ns.Queries {
+			queries[rcode] += n
+		}
+		for _, kc := range ns.TopClients {
+			clients[kc.Key] += kc.Count
+		}
+		for client, until := range ns.Banned {
+			if until.After(banned[client]) {
+				banned[client] = until
+			}
+		}
+	}
+	top := make([]keyCount, 0, len(clients))
+	for k, n := range clients {
+		top = append(top, keyCount{k, n})
+	}
+	sortCounts(top)
+	if len(top) > topClients {
+		top = top[:topClients]
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Instance < nodes[j].Instance })
+	return map[string]interface{}{
+		"queries":     queries,
+		"top_clients": top,
+		"banned":      banned,
+		"nodes":       nodes,
+	}
+}
+
+// authorized reports whether r carries the cluster key. The comparison is
+// constant-time so that the key can't be guessed from response times.
+func (c *cluster) authorized(r *http.Request) bool {
+	return c.key != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterKeyHeader)), []byte(c.key)) == 1
+}
+
+// serveStats serves the local statistics to peers.
+func (c *cluster) serveStats(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.stats())
+}
+
+// serveAggregate serves the aggregated cluster statistics to the holders
+// of the cluster key, since they have the clients of every node.
+func (c *cluster) serveAggregate(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.aggregate())
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestClusterAuth(t *testing.T) {
+	c := newCluster("a", nil, "secret", time.Minute)
+	c.refused("192.0.2.1")
+	for _, tc := range []struct {
+		key  string
+		want int
+	}{
+		{"", http.StatusForbidden},
+		{"secre", http.StatusForbidden},
+		{"secret!", http.StatusForbidden},
+		{"secret", http.StatusOK},
+	} {
+		for path, serve := range map[string]http.HandlerFunc{"/cluster/stats": c.serveStats, "/cluster": c.serveAggregate} {
+			r := httptest.NewRequest("GET", path, nil)
+			if tc.key != "" {
+				r.Header.Set(clusterKeyHeader, tc.key)
+			}
+			w := httptest.NewRecorder()
+			serve(w, r)
+			if w.Code != tc.want {
+				t.Errorf("%s with key %q: got status %d, want %d", path, tc.key, w.Code, tc.want)
+			}
+		}
+	}
+
+	c.key = ""
+	r := httptest.NewRequest("GET", "/cluster", nil)
+	if c.authorized(r) {
+		t.Error("without a cluster key: got a request authorized, want none")
+	}
+}
+
+func TestClusterPrivacy(t *testing.T) {
+	for _, privacy := range []bool{false, true} {
+		h := newTestHandle(t, fixtureDB)
+		h.privacy = privacy
+		h.limiter = newRateLimiter(0.001, 1)
+		h.cluster = newCluster("a", nil, "secret", time.Minute)
+		addr := startServer(t, h, nil)
+		exchange(t, addr, "udp", txtQuery("8.8.8.8"))
+		if r := exchange(t, addr, "udp", txtQuery("8.8.8.8")); r.Rcode != dns.RcodeRefused {
+			t.Fatalf("privacy %v: got rcode %s past the rate limit, want REFUSED", privacy, dns.RcodeToString[r.Rcode])
+		}
+		banned := h.cluster.stats().Banned
+		if _, ok := banned["127.0.0.1"]; ok == privacy {
+			t.Errorf("privacy %v: got the bans %v shared with the peers", privacy, banned)
+		}
+	}
+}
+
+// testClock is a clock of timeNow and wallNow. Advancing it lets time
+// pass, on both; jumping it steps the system clock only.
+type testClock struct {
+	mu   sync.Mutex
+	mono time.Time
+	skew time.Duration
+}
+
+// setTestClock makes timeNow and wallNow a test clock, starting at the
+// current time, until the end of the test.
+func setTestClock(t *testing.T) *testClock {
+	c := &testClock{mono: time.Now()}
+	timeNow, wallNow = c.now, c.wall
+	t.Cleanup(func() { timeNow, wallNow = time.Now, time.Now })
+	return c
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mono
+}
+
+func (c *testClock) wall() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mono.Add(c.skew).Round(0)
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.mono = c.mono.Add(d)
+	c.mu.Unlock()
+}
+
+func (c *testClock) jump(d time.Duration) {
+	c.mu.Lock()
+	c.skew += d
+	c.mu.Unlock()
+}
+
+func TestClusterClockJumps(t *testing.T) {
+	clk := setTestClock(t)
+	const client = "192.0.2.1"
+	jumps := []time.Duration{-2 * time.Hour, 0, 2 * time.Hour}
+
+	// The clock of the peer is skewed, or in sync. Its ban of a minute
+	// must last a minute here too, whatever the steps of the local clock.
+	for _, skew := range jumps {
+		peerNow := clk.wall().Add(skew)
+		ns := &nodeStats{Instance: "b", Time: peerNow.UTC(), Banned: map[string]time.Time{client: peerNow.Add(time.Minute).UTC()}}
+		peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(ns)
+		}))
+		c := newCluster("a", []string{peer.URL}, "secret", time.Minute)
+		c.poll()
+		peer.Close()
+		for _, jump := range jumps {
+			clk.jump(jump)
+			if !c.peerBans.banned(client) {
+				t.Errorf("peer clock skewed by %v, local clock stepped by %v: got the ban of the peer expired", skew, jump)
+			}
+		}
+		clk.advance(59 * time.Second)
+		if !c.peerBans.banned(client) {
+			t.Errorf("peer clock skewed by %v: got the ban of the peer expired within a minute", skew)
+		}
+		clk.advance(2 * time.Second)
+		if c.peerBans.banned(client) {
+			t.Errorf("peer clock skewed by %v: got the ban of the peer active after a minute", skew)
+		}
+	}
+
+	// The local bans are shared with the time left from the time of the
+	// statistics, whatever the steps of the local clock.
+	c := newCluster("a", nil, "secret", time.Minute)
+	c.refused(client)
+	for _, jump := range jumps {
+		clk.jump(jump)
+		ns := c.stats()
+		if left := ns.Banned[client].Sub(ns.Time); left != time.Minute {
+			t.Errorf("local clock stepped by %v: got the ban shared for %v past the time of the statistics, want 1m0s", jump, left)
+		}
+	}
+	clk.advance(61 * time.Second)
+	if banned := c.stats().Banned; len(banned) != 0 {
+		t.Errorf("after a minute: got the bans %v shared, want none", banned)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// secretFlags are the flags whose values are redacted from the printed
+// configuration.
+var secretFlags = map[string]bool{
+	"tsig-key":    true,
+	"cluster-key": true,
+	"hmac-key":    true,
+	"db-key":      true,
+	"admin-key":   true,
+}
+
+const redacted = "REDACTED"
+
+// redact returns the value of the flag name without secrets: redacted
+// entirely for secretFlags, and without the password of URLs. Values
+// with secret references are returned as given, before resolution.
+func redact(name, v string) string {
+	if v == "" {
+		return v
+	}
+	if ref, ok := secretRefs[v]; ok {
+		v = ref
+	}
+	if secretFlags[name] {
+		return redacted
+	}
+	if u, err := url.Parse(v); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			return u.String()
+		}
+	}
+	return v
+}
+
+// flagValue returns the redacted value of f: a list for repeatable
+// flags, a string otherwise.
+func flagValue(f *flag.Flag) interface{} {
+	if l, ok := f.Value.(*listFlag); ok {
+		vs := []string{}
+		for _, v := range *l {
+			vs = append(vs, redact(f.Name, v))
+		}
+		return vs
+	}
+	return redact(f.Name, f.Value.String())
+}
+
+// printConfig writes the effective configuration, all flags with their
+// redacted values, as JSON.
+func printConfig(w io.Writer) error {
+	cfg := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "print-config" && !strings.HasPrefix(f.Name, faultFlagPrefix) {
+			cfg[f.Name] = flagValue(f)
+		}
+	})
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// configSummary returns the flags set on the command line, with their
+// redacted values, in a single line.
+func configSummary() string {
+	var ret []string
+	flag.Visit(func(f *flag.Flag) {
+		ret = append(ret, f.Name+"="+redact(f.Name, f.Value.String()))
+	})
+	sort.Strings(ret)
+	return strings.Join(ret, " ")
+}
@@ -0,0 +1,267 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// conformance sends queries exercising protocol edge cases to a server.
+type conformance struct {
+	target  string
+	timeout time.Duration
+}
+
+// conformanceTests are the checks of the conformance command, run in
+// order. The last one checks the server still answers after the others.
+var conformanceTests = []struct {
+	name string
+	run  func(c *conformance) error
+}{
+	{"id and question echoed", (*conformance).echo},
+	{"empty question section", (*conformance).emptyQuestion},
+	{"too many questions", (*conformance).tooManyQuestions},
+	{"responses ignored", (*conformance).responseIgnored},
+	{"unknown opcode", (*conformance).unknownOpcode},
+	{"unknown EDNS option", (*conformance).unknownOption},
+	{"unsupported EDNS version", (*conformance).badVersion},
+	{"oversized name", (*conformance).oversizedName},
+	{"oversized label", (*conformance).oversizedLabel},
+	{"compression loop", (*conformance).compressionLoop},
+	{"truncated message", (*conformance).truncatedMessage},
+	{"still answering", (*conformance).echo},
+}
+
+// conformanceCmd runs the conformance tests against a running server,
+// checking it answers malformed and unusual queries per spec.
+func conformanceCmd(args []string) error {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	target := fs.String("target", "127.0.0.1:5300", "Address in form of host:port of the server to check")
+	timeout := fs.Duration("timeout", 2*time.Second, "Query timeout")
+	fs.Parse(args)
+
+	c := &conformance{target: *target, timeout: *timeout}
+	failed := 0
+	for _, t := range conformanceTests {
+		if err := t.run(c); err != nil {
+			fmt.Printf("FAIL %s: %v\n", t.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", t.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("conformance: %d of %d tests failed", failed, len(conformanceTests))
+	}
+	return nil
+}
+
+// probe returns a query answered by every server, for version.bind.
+func probe() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	return m
+}
+
+// exchange sends the raw message b over UDP and returns the reply.
+func (c *conformance) exchange(b []byte) (*dns.Msg, error) {
+	conn, err := net.DialTimeout("udp", c.target, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err = conn.Write(b); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err = r.Unpack(buf[:n]); err != nil {
+		return nil, fmt.Errorf("invalid reply: %v", err)
+	}
+	if !r.Response {
+		return nil, errors.New("reply without the QR bit")
+	}
+	if r.Id != binary.BigEndian.Uint16(b) {
+		return nil, fmt.Errorf("got reply id %d, want %d", r.Id, binary.BigEndian.Uint16(b))
+	}
+	return r, nil
+}
+
+// query packs m and sends it.
+func (c *conformance) query(m *dns.Msg) (*dns.Msg, error) {
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(b)
+}
+
+// expect sends m, or the raw message b if not nil, and checks the rcode
+// of the reply.
+func (c *conformance) expect(m *dns.Msg, b []byte, rcode int) (*dns.Msg, error) {
+	var r *dns.Msg
+	var err error
+	if b != nil {
+		r, err = c.exchange(b)
+	} else {
+		r, err = c.query(m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != rcode {
+		return nil, fmt.Errorf("got rcode %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[rcode])
+	}
+	return r, nil
+}
+
+func (c *conformance) echo() error {
+	m := probe()
+	r, err := c.expect(m, nil, dns.RcodeSuccess)
+	if err != nil {
+		return err
+	}
+	if len(r.Question) != 1 || r.Question[0] != m.Question[0] {
+		return fmt.Errorf("got question %v, want %v", r.Question, m.Question)
+	}
+	return nil
+}
+
+func (c *conformance) emptyQuestion() error {
+	m := probe()
+	m.Question = nil
+	_, err := c.expect(m, nil, dns.RcodeFormatError)
+	return err
+}
+
+func (c *conformance) tooManyQuestions() error {
+	m := probe()
+	for len(m.Question) <= maxQuestions {
+		m.Question = append(m.Question, m.Question[0])
+	}
+	_, err := c.expect(m, nil, dns.RcodeFormatError)
+	return err
+}
+
+// responseIgnored checks responses are not answered, since the source of
+// a spoofed response would get the reply.
+func (c *conformance) responseIgnored() error {
+	m := probe()
+	m.Response = true
+	_, err := c.query(m)
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return errors.New("got a reply to a response")
+}
+
+func (c *conformance) unknownOpcode() error {
+	m := probe()
+	m.Opcode = 3 // unassigned
+	_, err := c.expect(m, nil, dns.RcodeNotImplemented)
+	return err
+}
+
+// unknownOption checks unknown EDNS options are ignored (RFC 6891 6.1.2)
+// and not echoed.
+func (c *conformance) unknownOption() error {
+	m := probe()
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte("conformance")})
+	r, err := c.expect(m, nil, dns.RcodeSuccess)
+	if err != nil {
+		return err
+	}
+	ropt := r.IsEdns0()
+	if ropt == nil {
+		return errors.New("reply without OPT record")
+	}
+	for _, o := range ropt.Option {
+		if o.Option() == 65001 {
+			return errors.New("unknown option echoed")
+		}
+	}
+	return nil
+}
+
+// badVersion checks queries with an unsupported EDNS version get BADVERS
+// with the version supported (RFC 6891 6.1.3).
+func (c *conformance) badVersion() error {
+	m := probe()
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	m.IsEdns0().SetVersion(1)
+	r, err := c.expect(m, nil, dns.RcodeBadVers)
+	if err != nil {
+		return err
+	}
+	if opt := r.IsEdns0(); opt == nil || opt.Version() != 0 {
+		return errors.New("BADVERS without an OPT record of version 0")
+	}
+	return nil
+}
+
+// rawQuery returns a TXT query for the raw name.
+func rawQuery(id uint16, name []byte) []byte {
+	b := make([]byte, 12, 12+len(name)+4)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], 1<<8) // RD
+	binary.BigEndian.PutUint16(b[4:], 1)    // QDCOUNT
+	b = append(b, name...)
+	return append(b, 0, byte(dns.TypeTXT), 0, byte(dns.ClassINET))
+}
+
+// oversizedName checks names longer than 255 octets are rejected with
+// FORMERR.
+func (c *conformance) oversizedName() error {
+	label := append([]byte{63}, strings.Repeat("a", 63)...)
+	var name []byte
+	for i := 0; i < 4; i++ {
+		name = append(name, label...)
+	}
+	_, err := c.expect(nil, rawQuery(dns.Id(), append(name, 0)), dns.RcodeFormatError)
+	return err
+}
+
+// oversizedLabel checks labels longer than 63 octets, whose length
+// would be a reserved label type, are rejected with FORMERR.
+func (c *conformance) oversizedLabel() error {
+	name := append([]byte{64}, strings.Repeat("a", 64)...)
+	_, err := c.expect(nil, rawQuery(dns.Id(), append(name, 0)), dns.RcodeFormatError)
+	return err
+}
+
+// compressionLoop checks a name pointing to itself is rejected with
+// FORMERR.
+func (c *conformance) compressionLoop() error {
+	_, err := c.expect(nil, rawQuery(dns.Id(), []byte{0xc0, 12}), dns.RcodeFormatError)
+	return err
+}
+
+// truncatedMessage checks a message cut in the middle of its question is
+// rejected with FORMERR.
+func (c *conformance) truncatedMessage() error {
+	b := rawQuery(dns.Id(), []byte{7, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0})
+	_, err := c.expect(nil, b[:len(b)-3], dns.RcodeFormatError)
+	return err
+}
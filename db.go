@@ -0,0 +1,231 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/freegeoip"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoDB is an IP database that can be reloaded at runtime.
+type geoDB struct {
+	// lookups and lookupErrs count the lookups and lookup errors since
+	// the last error rate check. They come first to be 64-bit aligned.
+	lookups, lookupErrs int64
+
+	dsn    string
+	opts   dbOptions
+	silent bool
+	onOpen func(file string)
+
+	reloading int32
+	mu        sync.RWMutex
+	db        *freegeoip.DB
+	mm        *maxminddb.Reader // set instead of db in mmap mode
+	done      chan struct{}     // closed when mm is replaced
+}
+
+// Startup policies, applied when the database can't be opened at startup.
+const (
+	startupWait     = "wait"           // retry until it is opened
+	startupFail     = "fail"           // return the error
+	startupDegraded = "serve-degraded" // retry in background, failing lookups meanwhile
+)
+
+// newGeoDB opens the database at dsn, a file or URL, and watches its
+// events. onOpen is called with the name of each database file loaded.
+// policy sets what to do when the database can't be opened.
+func newGeoDB(dsn string, opts dbOptions, silent bool, onOpen func(file string), policy string) (*geoDB, error) {
+	g := &geoDB{
+		dsn:    dsn,
+		opts:   opts,
+		silent: silent,
+		onOpen: onOpen,
+	}
+	err := g.reopen()
+	switch {
+	case err == nil:
+	case policy == startupFail:
+		return nil, err
+	case policy == startupWait:
+		g.retryOpen(err)
+	case policy == startupDegraded:
+		go g.retryOpen(err)
+	default:
+		return nil, fmt.Errorf("unknown startup policy %q, want wait, fail or serve-degraded", policy)
+	}
+	return g, nil
+}
+
+// retryOpen retries opening the database after err with exponential
+// backoff, up to the max retry interval, until it succeeds.
+func (g *geoDB) retryOpen(err error) {
+	backoff := time.Second
+	for err != nil {
+		log.Printf("database unavailable, retrying in %s: %v\n", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > g.opts.maxRetryIntvl {
+			backoff = g.opts.maxRetryIntvl
+		}
+		err = g.reopen()
+	}
+}
+
+// ready reports whether a database is loaded.
+func (g *geoDB) ready() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.db != nil || g.mm != nil
+}
+
+// Lookup looks up ip in the current database, counting the errors.
+func (g *geoDB) Lookup(ip net.IP, result interface{}) error {
+	err := g.lookup(ip, result)
+	atomic.AddInt64(&g.lookups, 1)
+	if err != nil && err != freegeoip.ErrUnavailable {
+		atomic.AddInt64(&g.lookupErrs, 1)
+		dbLookupErrors.inc()
+	}
+	return err
+}
+
+// lookup looks up ip in the current database. The lock is held during
+// the lookup so that a mmap database is never unmapped under it.
+func (g *geoDB) lookup(ip net.IP, result interface{}) error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	switch {
+	case g.mm != nil:
+		return g.mm.Lookup(ip, result)
+	case g.db != nil:
+		return g.db.Lookup(ip, result)
+	}
+	return freegeoip.ErrUnavailable
+}
+
+// source returns the current file or URL of the database.
+func (g *geoDB) source() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.dsn
+}
+
+// setSource switches the database to dsn, reloading it if it changed.
+func (g *geoDB) setSource(dsn string) error {
+	g.mu.Lock()
+	same := g.dsn == dsn
+	g.dsn = dsn
+	g.mu.Unlock()
+	if same {
+		return nil
+	}
+	return g.reload()
+}
+
+// reopen reopens the database from its local file and replaces the
+// current one.
+func (g *geoDB) reopen() error {
+	if g.opts.mmap {
+		return g.reopenMmap()
+	}
+	db, err := openDB(g.source(), g.opts)
+	if err != nil {
+		return err
+	}
+	go watchEvents(db, "ip", g.silent, g.onOpen)
+	g.swap(db, nil)
+	return nil
+}
+
+// reopenMmap reopens the database with mmap, and watches it for updates
+// until it is replaced.
+func (g *geoDB) reopenMmap() error {
+	src := g.source()
+	mm, file, err := openMmap(src, g.opts)
+	if err != nil {
+		return err
+	}
+	done := g.swap(nil, mm)
+	countDBEvent("ip", dbOpen)
+	if !g.silent {
+		log.Println("database loaded:", file)
+	}
+	if g.onOpen != nil {
+		g.onOpen(file)
+	}
+	reopen := func() {
+		if err := g.reopen(); err != nil {
+			countDBEvent("ip", dbError)
+			log.Println("database error:", err)
+			emitDBReload("", err)
+		}
+	}
+	if isURL(src) {
+		newDownloader(src, g.opts).autoUpdate(done, reopen)
+	} else {
+		watchFile(src, g.opts.updateIntvl, done, reopen)
+	}
+	return nil
+}
+
+// swap replaces the current database with db or mm, closing the old one,
+// and returns the channel closed when mm is replaced.
+func (g *geoDB) swap(db *freegeoip.DB, mm *maxminddb.Reader) chan struct{} {
+	done := make(chan struct{})
+	g.mu.Lock()
+	oldDB, oldMM, oldDone := g.db, g.mm, g.done
+	g.db, g.mm, g.done = db, mm, done
+	g.mu.Unlock()
+	if oldDB != nil {
+		oldDB.Close()
+	}
+	if oldMM != nil {
+		close(oldDone)
+		oldMM.Close()
+		countDBEvent("ip", dbClose)
+		emitDBClose()
+	}
+	return done
+}
+
+// rollback restores the given version of a downloaded database, or the
+// newest previous one if empty, and returns the version restored.
+func (g *geoDB) rollback(version string) (string, error) {
+	src := g.source()
+	if !isURL(src) {
+		return "", errors.New("rollback: the database was not downloaded")
+	}
+	v, err := rollback(newDownloader(src, g.opts).file, version)
+	if err != nil {
+		return "", err
+	}
+	return v, g.reopen()
+}
+
+// reload downloads the database again if it is remote, reopens it and
+// replaces the current one. Calls made while a reload is in progress
+// return immediately.
+func (g *geoDB) reload() error {
+	if !atomic.CompareAndSwapInt32(&g.reloading, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&g.reloading, 0)
+	src := g.source()
+	if isURL(src) {
+		if _, err := newDownloader(src, g.opts).download(); err != nil {
+			return err
+		}
+	}
+	return g.reopen()
+}
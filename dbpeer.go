@@ -0,0 +1,249 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checksumHeader carries the hex encoded SHA-256 of the served database.
+const checksumHeader = "X-Checksum-Sha256"
+
+// fileChecksum caches the SHA-256 of a file by name and modification time.
+type fileChecksum struct {
+	mu   sync.Mutex
+	name string
+	mod  time.Time
+	sum  string
+}
+
+// get returns the checksum of the named file.
+func (fc *fileChecksum) get(name string) (string, error) {
+	st, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.name == name && fc.mod.Equal(st.ModTime()) {
+		return fc.sum, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	fc.name, fc.mod, fc.sum = name, st.ModTime(), hex.EncodeToString(h.Sum(nil))
+	return fc.sum, nil
+}
+
+// leader returns the instance ID and admin URL of the cluster leader,
+// the node with the lowest instance ID among this node and the peers
+// that answered the last poll. The URL is empty if this node leads.
+func (c *cluster) leader() (instance, url string) {
+	instance = c.instance
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for peer, ns := range c.peerStats {
+		if ns.Error == "" && ns.Instance != "" && ns.Instance < instance {
+			instance, url = ns.Instance, peer
+		}
+	}
+	return instance, url
+}
+
+// serveDB serves the database file currently loaded by this node.
+func (c *cluster) serveDB(info *dbInfo, sums *fileChecksum) http.HandlerFunc {
+	return serveDBFile(info, sums, c.authorized)
+}
+
+// serveDBFile serves the database file currently loaded to the requests
+// authorized, with its checksum, type and build epoch in headers.
+func serveDBFile(info *dbInfo, sums *fileChecksum, authorized func(*http.Request) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		meta := info.get()
+		if meta == nil {
+			http.Error(w, "database not loaded", http.StatusServiceUnavailable)
+			return
+		}
+		sum, err := sums.get(meta.File)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f, err := os.Open(meta.File)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(checksumHeader, sum)
+		w.Header().Set("X-Database-Type", meta.DatabaseType)
+		w.Header().Set("X-Database-Build-Epoch", strconv.FormatUint(uint64(meta.BuildEpoch), 10))
+		w.Header().Set("Etag", `"`+sum+`"`)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, filepath.Base(meta.File), st.ModTime(), f)
+	}
+}
+
+// dbTransport is the transport of database downloads. It bounds the
+// connection to the server and the wait for its response headers, so
+// that a stalled server fails the download rather than blocking it.
+var dbTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	IdleConnTimeout:       90 * time.Second,
+}
+
+// dbClient downloads the database of the leader.
+var dbClient = &http.Client{Transport: dbTransport}
+
+// dbFetchTimeout bounds a download of the leader's database, body
+// included: enough for a full city database over a slow link.
+var dbFetchTimeout = 10 * time.Minute
+
+// errNotModified is returned by fetchDB when the leader's database is
+// the one already downloaded.
+var errNotModified = errors.New("not modified")
+
+// fetchDB downloads the database of the leader at url into file,
+// verifying its checksum. sum is the checksum of the current file.
+func (c *cluster) fetchDB(url, file, sum string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(url, "/")+"/cluster/db", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(clusterKeyHeader, c.key)
+	if sum != "" {
+		req.Header.Set("If-None-Match", `"`+sum+`"`)
+	}
+	resp, err := dbClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return sum, errNotModified
+	default:
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	want := resp.Header.Get(checksumHeader)
+	if want == "" {
+		return "", fmt.Errorf("%s: missing %s header", url, checksumHeader)
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return "", fmt.Errorf("%s: checksum mismatch: got %s, want %s", url, got, want)
+	}
+	return want, os.Rename(tmp.Name(), file)
+}
+
+// startupDB returns the database a node opens at startup, and its
+// checksum if it is the leader's: the peers are polled first so that a
+// node that doesn't lead downloads the leader's database into file
+// rather than the upstream one. It falls back to a previous copy of the
+// leader's database, then to upstream, if the leader can't serve it.
+func (c *cluster) startupDB(upstream, file string) (dsn, sum string) {
+	c.poll()
+	leader, url := c.leader()
+	if url == "" {
+		return upstream, ""
+	}
+	sum, err := c.fetchDB(url, file, "")
+	if err == nil {
+		log.Printf("cluster database: downloaded from leader %s, sha256 %s\n", leader, sum)
+		return file, sum
+	}
+	if _, serr := os.Stat(file); serr == nil {
+		log.Printf("cluster database: %v, opening the previous copy\n", err)
+		return file, ""
+	}
+	log.Printf("cluster database: %v, downloading from upstream\n", err)
+	return upstream, ""
+}
+
+// dbSync returns the task keeping the database in sync with the cluster:
+// the leader downloads it from upstream, and the other nodes from the
+// leader's admin endpoint into file. sum is the checksum of the leader's
+// database opened at startup, if any.
+func (c *cluster) dbSync(db *geoDB, upstream, file, sum string) func() error {
+	return func() error {
+		leader, url := c.leader()
+		if url == "" {
+			if err := db.setSource(upstream); err != nil {
+				return fmt.Errorf("cluster database: %v", err)
+			}
+			return nil
+		}
+		newSum, err := c.fetchDB(url, file, sum)
+		if err == errNotModified {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cluster database: %v", err)
+		}
+		log.Printf("cluster database: downloaded from leader %s, sha256 %s\n", leader, newSum)
+		sum = newSum
+		if db.source() == file {
+			err = db.reload()
+		} else {
+			err = db.setSource(file)
+		}
+		if err != nil {
+			return fmt.Errorf("cluster database: %v", err)
+		}
+		return nil
+	}
+}
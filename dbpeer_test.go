@@ -0,0 +1,104 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startLeader serves the cluster stats and the fixture database as the
+// node of instance ID id.
+func startLeader(t *testing.T, id string) string {
+	t.Helper()
+	c := newCluster(id, nil, "secret", time.Minute)
+	info := &dbInfo{}
+	info.load(fixtureDB)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster/stats", c.serveStats)
+	mux.HandleFunc("/cluster/db", c.serveDB(info, &fileChecksum{}))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestStartupDB(t *testing.T) {
+	const upstream = "http://upstream.invalid/GeoLite2-City.mmdb.gz"
+	want, err := ioutil.ReadFile(fixtureDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader := startLeader(t, "b")
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, tc := range []struct {
+		instance string
+		peer     string
+		leads    bool
+	}{
+		{"c", leader, false},
+		{"a", leader, true},
+		{"c", down.URL, true},
+	} {
+		file := filepath.Join(t.TempDir(), "cluster-db.mmdb.gz")
+		c := newCluster(tc.instance, []string{tc.peer}, "secret", time.Minute)
+		dsn, sum := c.startupDB(upstream, file)
+		if tc.leads {
+			if dsn != upstream || sum != "" {
+				t.Errorf("%s leading: got %q, %q, want %q", tc.instance, dsn, sum, upstream)
+			}
+			continue
+		}
+		if dsn != file || sum == "" {
+			t.Errorf("%s following %s: got %q, %q, want %q and its checksum", tc.instance, tc.peer, dsn, sum, file)
+			continue
+		}
+		got, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s following %s: got a database of %d bytes, want the leader's %d", tc.instance, tc.peer, len(got), len(want))
+		}
+	}
+}
+
+func TestFetchDBStalled(t *testing.T) {
+	defer func(d time.Duration) { dbFetchTimeout = d }(dbFetchTimeout)
+	dbFetchTimeout = 200 * time.Millisecond
+	// The leader sends the headers and the start of the database, and
+	// then nothing.
+	stall := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(checksumHeader, "0")
+		w.Write(make([]byte, 1024))
+		w.(http.Flusher).Flush()
+		<-stall
+	}))
+	defer srv.Close()
+	defer close(stall)
+
+	c := newCluster("c", []string{srv.URL}, "secret", time.Minute)
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.fetchDB(srv.URL, filepath.Join(t.TempDir(), "cluster-db.mmdb.gz"), "")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("stalled download succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled download not interrupted")
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// dbDiff counts the changes of the records of the sampled IPs between
+// two databases.
+type dbDiff struct {
+	sampled  int
+	missing  int // in neither database
+	added    int // only in the new database
+	removed  int // only in the old database
+	country  int
+	city     int
+	moves    map[string]int // country changes, as old -> new
+	changed  []string
+	maxLines int
+}
+
+// diffDBCmd reports how many sampled IPs change country or city between
+// two databases, to assess the impact of an update before deploying it.
+func diffDBCmd(args []string) error {
+	fs := flag.NewFlagSet("diff-db", flag.ExitOnError)
+	sample := fs.String("sample", "", "File of the IPs to compare, one per line, random IPv4 addresses if empty")
+	random := fs.Int("random", 10000, "Number of random IPv4 addresses compared without -sample")
+	lang := fs.String("lang", "en", "Language of the city names compared")
+	top := fs.Int("top", 10, "Number of most frequent country changes printed")
+	list := fs.Int("list", 0, "Number of changed IPs printed with their old and new locations")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: freegeoip-dns diff-db [flags] <old.mmdb> <new.mmdb>")
+		fs.PrintDefaults()
+	}
+	// Flags may follow the database files.
+	var files []string
+	for fs.Parse(args); fs.NArg() > 0; fs.Parse(args) {
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(files) != 2 {
+		fs.Usage()
+		return errors.New("diff-db: want the old and new database files")
+	}
+
+	var dbs [2]*geoDB
+	for i, file := range files {
+		var err error
+		if dbs[i], err = newGeoDB(file, dbOptions{mmap: true}, true, nil, startupFail); err != nil {
+			return fmt.Errorf("diff-db: %v", err)
+		}
+	}
+	ips, err := diffSample(*sample, *random)
+	if err != nil {
+		return fmt.Errorf("diff-db: %v", err)
+	}
+	d := &dbDiff{moves: make(map[string]int), maxLines: *list}
+	for _, ip := range ips {
+		var old, cur Query
+		if err := dbs[0].lookup(ip, &old); err != nil {
+			return fmt.Errorf("diff-db: %s: %v", files[0], err)
+		}
+		if err := dbs[1].lookup(ip, &cur); err != nil {
+			return fmt.Errorf("diff-db: %s: %v", files[1], err)
+		}
+		d.add(ip, &old, &cur, *lang)
+	}
+	d.print(*top)
+	return nil
+}
+
+// diffSample returns the IPs in file, or n random IPv4 addresses if file
+// is empty.
+func diffSample(file string, n int) ([]net.IP, error) {
+	var ips []net.IP
+	if file == "" {
+		for i := 0; i < n; i++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, rand.Uint32())
+			ips = append(ips, ip)
+		}
+		return ips, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ip := parseIP(line)
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: invalid IP %q", file, n, line)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, s.Err()
+}
+
+// add compares the records old and cur of ip.
+func (d *dbDiff) add(ip net.IP, old, cur *Query, lang string) {
+	d.sampled++
+	oldCountry, curCountry := old.Country.ISOCode, cur.Country.ISOCode
+	switch {
+	case oldCountry == "" && curCountry == "":
+		d.missing++
+		return
+	case oldCountry == "":
+		d.added++
+	case curCountry == "":
+		d.removed++
+	}
+	oldCity, curCity := old.City.Names[lang], cur.City.Names[lang]
+	if oldCountry == curCountry && oldCity == curCity {
+		return
+	}
+	if oldCountry != curCountry {
+		d.country++
+		d.moves[orDash(oldCountry)+" -> "+orDash(curCountry)]++
+	} else {
+		d.city++
+	}
+	if len(d.changed) < d.maxLines {
+		d.changed = append(d.changed, fmt.Sprintf("%s\t%s/%s\t%s/%s", ip, orDash(oldCountry), orDash(oldCity), orDash(curCountry), orDash(curCity)))
+	}
+}
+
+// print prints the counts and the top most frequent country changes.
+func (d *dbDiff) print(top int) {
+	found := d.sampled - d.missing
+	fmt.Printf("%d IPs sampled, %d in neither database, %d only in the old one, %d only in the new one\n", d.sampled, d.missing, d.removed, d.added)
+	fmt.Printf("country changed: %d (%s)\n", d.country, percent(d.country, found))
+	fmt.Printf("city changed:    %d (%s), in the same country\n", d.city, percent(d.city, found))
+	moves := make([]keyCount, 0, len(d.moves))
+	for k, n := range d.moves {
+		moves = append(moves, keyCount{Key: k, Count: uint64(n)})
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		if moves[i].Count != moves[j].Count {
+			return moves[i].Count > moves[j].Count
+		}
+		return moves[i].Key < moves[j].Key
+	})
+	if len(moves) > top {
+		moves = moves[:top]
+	}
+	for _, m := range moves {
+		fmt.Printf("  %-12s %d\n", m.Key, m.Count)
+	}
+	for _, line := range d.changed {
+		fmt.Println(line)
+	}
+}
+
+// percent returns n as a percentage of total.
+func percent(n, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.2f%%", 100*float64(n)/float64(total))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// adminCommands are the commands run by TXT queries for
+// <command>.admin.<domain>. Each returns the text of the answer.
+var adminCommands = map[string]func(h *handle) (string, error){
+	"reload": func(h *handle) (string, error) {
+		go func() {
+			if err := h.db.reload(); err != nil {
+				log.Println("database reload:", err)
+			}
+		}()
+		return "reload started", nil
+	},
+	"rollback": func(h *handle) (string, error) {
+		v, err := h.db.rollback("")
+		if err != nil {
+			return "", err
+		}
+		return "rolled back to " + v, nil
+	},
+	"flushcache": func(h *handle) (string, error) {
+		if h.cache == nil {
+			return "", errors.New("cache disabled")
+		}
+		h.cache.flush()
+		return "cache flushed", nil
+	},
+}
+
+// adminCommand returns the command of an admin query name, or false if
+// name is not under admin.<domain>.
+func (h *handle) adminCommand(name string) (string, bool) {
+	suffix := "." + dns.Fqdn(join("admin", h.domain))
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, strings.ToLower(suffix)) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, strings.ToLower(suffix)), true
+}
+
+// admin runs an admin command. Only queries with a valid TSIG signature
+// are accepted.
+func (h *handle) admin(cmd string, start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		h.refuse(refuseUnsignedAdmin, start, w, r)
+		return
+	}
+	run, ok := adminCommands[cmd]
+	if !ok {
+		h.nxdomain(nxUnknownName, start, w, r)
+		return
+	}
+	if !h.silent {
+		log.Printf("admin command %s from %s", cmd, clientIP(w))
+	}
+	text, err := run(h)
+	if err != nil {
+		h.failInternal(internal(dns.ExtendedErrorCodeOther, "admin command failed", fmt.Errorf("%s: %v", cmd, err)), start, w, r)
+		return
+	}
+	h.txt([]string{text}, start, w, r)
+}
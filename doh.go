@@ -0,0 +1,252 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// dohContentType is the media type of DNS messages over HTTPS.
+const dohContentType = "application/dns-message"
+
+func init() {
+	registerTransport("https", func(fs *flag.FlagSet) func(env *transportEnv) (Transport, error) {
+		addr := fs.String("https-addr", "", "Address in form of ip:port for the DNS over HTTPS listener, e.g. :443, disabled if empty")
+		httpsNet := fs.String("https-net", "", "Network of the DNS over HTTPS listener: tcp (dual-stack), tcp4 or tcp6, inferred from -https-addr if empty")
+		path := fs.String("https-path", "/dns-query", "URL path of the DNS over HTTPS queries")
+		cert := fs.String("https-cert", "", "PEM certificate file of -https-addr, served over plain HTTP if empty, e.g. behind a TLS proxy")
+		key := fs.String("https-key", "", "PEM private key file of -https-addr")
+		return func(env *transportEnv) (Transport, error) {
+			if *addr == "" {
+				return nil, nil
+			}
+			network, err := listenNet("tcp", *httpsNet, *addr)
+			if err != nil {
+				return nil, err
+			}
+			t := &dohTransport{network: network, addr: *addr, path: *path, limits: env.limits}
+			if *cert != "" || *key != "" {
+				if t.tls, err = loadTLSConfig(*cert, *key); err != nil {
+					return nil, err
+				}
+			}
+			return t, nil
+		}
+	})
+}
+
+// dohTransport answers DNS over HTTPS (RFC 8484), with the queries in
+// the dns parameter of GET requests or the body of POST ones.
+type dohTransport struct {
+	network string
+	addr    string
+	path    string
+	tls     *tls.Config // nil for plain HTTP
+	limits  streamLimits
+	ln      net.Listener
+	srv     *http.Server
+}
+
+func (t *dohTransport) Name() string { return "https" }
+
+func (t *dohTransport) String() string {
+	if t.tls == nil {
+		return t.network + "-http " + t.addr + t.path
+	}
+	return t.network + "-https " + t.addr + t.path
+}
+
+func (t *dohTransport) Listen() error {
+	// Over TLS, the handshake is made by the HTTP server, for HTTP/2.
+	ln, err := t.limits.listen(t.network, t.addr, "https", nil)
+	if err != nil {
+		return err
+	}
+	t.ln = ln
+	return nil
+}
+
+func (t *dohTransport) Serve(h dns.Handler) error {
+	mux := http.NewServeMux()
+	mux.Handle(t.path, dohHandler{h: h, maxQueries: t.limits.maxQueries})
+	t.srv = &http.Server{
+		Handler:           mux,
+		TLSConfig:         t.tls,
+		ReadTimeout:       t.limits.readTimeout,
+		ReadHeaderTimeout: t.limits.readTimeout,
+		IdleTimeout:       t.limits.idleTimeout,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, dohQueriesKey{}, new(int64))
+		},
+	}
+	var err error
+	if t.tls != nil {
+		err = t.srv.ServeTLS(t.ln, "", "")
+	} else {
+		err = t.srv.Serve(t.ln)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (t *dohTransport) Shutdown(ctx context.Context) error {
+	if t.srv == nil {
+		return t.ln.Close()
+	}
+	return t.srv.Shutdown(ctx)
+}
+
+// dohQueriesKey is the context key of the count of the requests of a
+// connection.
+type dohQueriesKey struct{}
+
+// dohHandler answers the DNS queries of HTTP requests with a dns.Handler.
+// Connections are closed after maxQueries requests, if not 0: HTTP/1.1
+// ones after the response, and HTTP/2 ones once their streams are done.
+type dohHandler struct {
+	h          dns.Handler
+	maxQueries int
+}
+
+func (d dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if n, ok := r.Context().Value(dohQueriesKey{}).(*int64); ok && d.maxQueries > 0 && atomic.AddInt64(n, 1) >= int64(d.maxQueries) {
+		w.Header().Set("Connection", "close")
+	}
+	var (
+		buf []byte
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "want "+dohContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err == nil && len(buf) > dns.MaxMsgSize {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err == nil && len(buf) == 0 {
+		err = errors.New("no query")
+	}
+	if err == nil {
+		err = req.Unpack(buf)
+	}
+	if err == nil && req.Response {
+		err = errors.New("not a query")
+	}
+	if err != nil {
+		http.Error(w, "invalid DNS message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohWriter{r: r}
+	if req.IsTsig() != nil {
+		// TSIG isn't verified over HTTPS: signed queries are refused
+		// the commands requiring it.
+		dw.tsigErr = dns.ErrSig
+	}
+	d.h.ServeDNS(dw, req)
+	if dw.reply == nil {
+		http.Error(w, "no answer", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := minTTL(dw.reply); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	w.Write(dw.buf)
+}
+
+// minTTL returns the lowest TTL of the records of m but the OPT one,
+// which an HTTP cache must not keep the reply longer than (RFC 8484 5.1),
+// or false without records.
+func minTTL(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl, found = rr.Header().Ttl, true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// dohWriter is the dns.ResponseWriter of a query over HTTPS, keeping the
+// reply for the HTTP response.
+type dohWriter struct {
+	r       *http.Request
+	buf     []byte
+	reply   *dns.Msg
+	tsigErr error
+}
+
+func (w *dohWriter) LocalAddr() net.Addr {
+	addr, _ := w.r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
+
+func (w *dohWriter) RemoteAddr() net.Addr {
+	host, port, err := net.SplitHostPort(w.r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	w.buf, w.reply = buf, m
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.buf, w.reply = append([]byte(nil), b...), m
+	return len(b), nil
+}
+
+// ConnectionState returns the TLS state of the request, for padding.
+func (w *dohWriter) ConnectionState() *tls.ConnectionState { return w.r.TLS }
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return w.tsigErr }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
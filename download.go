@@ -0,0 +1,326 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiorix/freegeoip"
+)
+
+// dbOptions configure how databases are opened and updated.
+type dbOptions struct {
+	updateIntvl   time.Duration
+	maxRetryIntvl time.Duration
+	rate          int64  // download rate limit in bytes per second, 0 for none
+	dir           string // directory of the downloaded databases
+	keep          int    // number of previous versions kept for rollback
+	mmap          bool   // read the database with mmap instead of loading it in memory
+}
+
+// staleDownloadAge is the age after which interrupted downloads are
+// deleted by cleanDir instead of being resumed.
+const staleDownloadAge = 7 * 24 * time.Hour
+
+// cleanDir removes leftovers of previous downloads from dir: temporary
+// files, validators of deleted databases and partial downloads older
+// than staleDownloadAge. Other files are never touched, so dir may be
+// shared.
+func cleanDir(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		full := filepath.Join(dir, name)
+		switch {
+		case fi.IsDir():
+		case strings.HasPrefix(name, ".download-"):
+			os.Remove(full)
+		case strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".part.validators"):
+			if time.Since(fi.ModTime()) > staleDownloadAge {
+				os.Remove(full)
+			}
+		case strings.HasSuffix(name, ".validators"):
+			if _, err := os.Stat(strings.TrimSuffix(full, ".validators")); os.IsNotExist(err) {
+				os.Remove(full)
+			}
+		}
+	}
+}
+
+// openDB opens and returns the IP database. Remote databases are
+// downloaded to a local file, which is kept up to date in background.
+func openDB(dsn string, opts dbOptions) (*freegeoip.DB, error) {
+	if !isURL(dsn) {
+		return freegeoip.Open(dsn)
+	}
+	d, err := localCopy(dsn, opts)
+	if err != nil {
+		return nil, err
+	}
+	db, err := freegeoip.Open(d.file)
+	if err != nil {
+		return nil, err
+	}
+	d.autoUpdate(db.NotifyClose(), nil)
+	return db, nil
+}
+
+// localCopy returns the downloader of the remote database at dsn,
+// downloading it first if there is no local copy yet.
+func localCopy(dsn string, opts dbOptions) (*downloader, error) {
+	d := newDownloader(dsn, opts)
+	if _, err := os.Stat(d.file); os.IsNotExist(err) {
+		if _, err = d.download(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// isURL reports whether dsn is a URL rather than a file name.
+func isURL(dsn string) bool {
+	u, err := url.Parse(dsn)
+	return err == nil && len(u.Scheme) > 0
+}
+
+// downloader keeps a local copy of a remote database. Interrupted
+// downloads are resumed with HTTP range requests.
+type downloader struct {
+	url    string
+	file   string
+	opts   dbOptions
+	client *http.Client
+}
+
+func newDownloader(dsn string, opts dbOptions) *downloader {
+	u, _ := url.Parse(dsn)
+	return &downloader{
+		url:    dsn,
+		file:   filepath.Join(opts.dir, path.Base(u.Path)),
+		opts:   opts,
+		client: &http.Client{Transport: dbTransport},
+	}
+}
+
+// autoUpdate starts the task downloading the database every update
+// interval, retrying failed downloads with exponential backoff up to the
+// max retry interval, and calling onChange, if not nil, after each new
+// download. It stops when done is closed.
+func (d *downloader) autoUpdate(done <-chan struct{}, onChange func()) {
+	tasks.start(&task{name: "db-update", intvl: d.opts.updateIntvl, retry: d.opts.maxRetryIntvl, done: done, run: func() error {
+		changed, err := d.download()
+		if err != nil {
+			return fmt.Errorf("database update: %v", err)
+		}
+		if changed && onChange != nil {
+			onChange()
+		}
+		return nil
+	}})
+}
+
+// validators identify a version of a remote file.
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+func readValidators(name string) (v validators) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	p := strings.SplitN(string(b), "\n", 2)
+	v.etag = p[0]
+	if len(p) == 2 {
+		v.lastModified = p[1]
+	}
+	return
+}
+
+// matches reports whether v and o identify the same version.
+func (v validators) matches(o validators) bool {
+	return (v.etag != "" && v.etag == o.etag) || (v.lastModified != "" && v.lastModified == o.lastModified)
+}
+
+func (v validators) write(name string) error {
+	return ioutil.WriteFile(name, []byte(v.etag+"\n"+v.lastModified), 0644)
+}
+
+// download fetches the database into a partial file, resuming a previous
+// download if the remote file did not change, and then replaces the local
+// copy, which freegeoip reloads. Requests are conditional on the version
+// of the local copy, so that unchanged databases are not downloaded
+// again. It returns whether the local copy changed.
+func (d *downloader) download() (changed bool, err error) {
+	defer func() {
+		switch {
+		case err != nil:
+			dbUpdateChecks.inc("error")
+		case changed:
+			dbUpdateChecks.inc("downloaded")
+		default:
+			dbUpdateChecks.inc("not_modified")
+		}
+		dbLastUpdateCheck.set(float64(time.Now().Unix()))
+	}()
+	if err = os.MkdirAll(filepath.Dir(d.file), 0755); err != nil {
+		return false, err
+	}
+	part := d.file + ".part"
+	partValidators := part + ".validators"
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		return false, err
+	}
+	var size int64
+	if st, err := os.Stat(part); err == nil {
+		size = st.Size()
+	}
+	if v := readValidators(partValidators); size > 0 && (v.etag != "" || v.lastModified != "") {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", size))
+		if v.etag != "" {
+			req.Header.Set("If-Range", v.etag)
+		} else {
+			req.Header.Set("If-Range", v.lastModified)
+		}
+	} else if _, err := os.Stat(d.file); err == nil {
+		v := readValidators(d.file + ".validators")
+		if v.etag != "" {
+			req.Header.Set("If-None-Match", v.etag)
+		}
+		if v.lastModified != "" {
+			req.Header.Set("If-Modified-Since", v.lastModified)
+		}
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	// The partial file is only created once a body comes, so that checks
+	// of unchanged databases leave nothing behind.
+	var f *os.File
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if size == 0 {
+			os.Remove(part) // left empty by an earlier check, if any
+		}
+		return false, nil
+	case http.StatusPartialContent:
+		if start, ok := rangeStart(resp.Header.Get("Content-Range")); !ok || start != size {
+			os.Remove(part)
+			os.Remove(partValidators)
+			return false, fmt.Errorf("%s: got the range %q for %d downloaded bytes, restarting download", d.url, resp.Header.Get("Content-Range"), size)
+		}
+		f, err = os.OpenFile(part, os.O_WRONLY|os.O_APPEND, 0644)
+	case http.StatusOK:
+		v := validators{etag: resp.Header.Get("Etag"), lastModified: resp.Header.Get("Last-Modified")}
+		if v.matches(readValidators(d.file + ".rejected")) {
+			return false, nil
+		}
+		if err = v.write(partValidators); err != nil {
+			return false, err
+		}
+		f, err = os.Create(part)
+	case http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(part)
+		os.Remove(partValidators)
+		return false, fmt.Errorf("%s: %s, restarting download", d.url, resp.Status)
+	default:
+		return false, fmt.Errorf("%s: %s", d.url, resp.Status)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var body io.Reader = resp.Body
+	if d.opts.rate > 0 {
+		body = newThrottledReader(body, d.opts.rate)
+	}
+	if _, err = io.Copy(f, body); err != nil {
+		// What was downloaded is kept to be resumed, unless nothing was.
+		if st, serr := f.Stat(); serr == nil && st.Size() == 0 {
+			f.Close()
+			os.Remove(part)
+			os.Remove(partValidators)
+		}
+		return false, fmt.Errorf("%s: %v", d.url, err)
+	}
+	if err = f.Close(); err != nil {
+		return false, err
+	}
+	if d.opts.keep > 0 {
+		if err = archiveVersion(d.file, d.opts.keep); err != nil {
+			return false, err
+		}
+	}
+	if err = os.Rename(partValidators, d.file+".validators"); err != nil {
+		return false, err
+	}
+	if err = os.Rename(part, d.file); err != nil {
+		return false, err
+	}
+	cleanDir(d.opts.dir)
+	return true, nil
+}
+
+// rangeStart returns the first byte position of the Content-Range header
+// value cr, e.g. 100 for "bytes 100-999/1000".
+func rangeStart(cr string) (int64, bool) {
+	if !strings.HasPrefix(cr, "bytes ") {
+		return 0, false
+	}
+	i := strings.IndexByte(cr, '-')
+	if i < 0 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(cr[len("bytes "):i], 10, 64)
+	return start, err == nil
+}
+
+var (
+	dbUpdateChecks    = newCounter("freegeoip_dns_db_update_checks_total", "Database update checks, by result: downloaded, not_modified or error.", "result")
+	dbLastUpdateCheck = newGauge("freegeoip_dns_db_last_update_check_timestamp_seconds", "Unix time of the last database update check.")
+)
+
+// throttledReader limits the rate of reads from r.
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newThrottledReader(r io.Reader, rate int64) *throttledReader {
+	return &throttledReader{r: r, rate: rate, start: time.Now()}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second)))
+	if d := due.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+	return n, err
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRemoteDB is the content of the database served by the test
+// servers, with the Etag of its version.
+var (
+	testRemoteDB = bytes.Repeat([]byte("freegeoip-dns"), 1000)
+	testEtag     = `"v1"`
+)
+
+// serveTestDB serves testRemoteDB with its Etag and ranges. With
+// interrupt, full downloads are cut after half of the body.
+func serveTestDB(interrupt *bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", testEtag)
+		if r.Header.Get("Range") == "" && *interrupt {
+			w.Header().Set("Content-Length", "13000")
+			w.Write(testRemoteDB[:len(testRemoteDB)/2])
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "GeoLite2-City.mmdb", time.Time{}, bytes.NewReader(testRemoteDB))
+	}
+}
+
+// assertNoPart fails t if a partial download of d is left.
+func assertNoPart(t *testing.T, d *downloader, when string) {
+	t.Helper()
+	for _, name := range []string{d.file + ".part", d.file + ".part.validators"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s: got %s left, want none", when, name)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	var interrupt bool
+	srv := httptest.NewServer(serveTestDB(&interrupt))
+	defer srv.Close()
+	d := newDownloader(srv.URL+"/GeoLite2-City.mmdb", dbOptions{dir: t.TempDir()})
+
+	if changed, err := d.download(); err != nil || !changed {
+		t.Fatalf("first download: got %v, %v, want a new copy", changed, err)
+	}
+	if b, _ := ioutil.ReadFile(d.file); !bytes.Equal(b, testRemoteDB) {
+		t.Fatalf("first download: got %d bytes, want %d", len(b), len(testRemoteDB))
+	}
+	assertNoPart(t, d, "after a download")
+
+	if changed, err := d.download(); err != nil || changed {
+		t.Fatalf("unchanged database: got %v, %v, want not modified", changed, err)
+	}
+	assertNoPart(t, d, "after a 304")
+
+	testEtag = `"v2"`
+	defer func() { testEtag = `"v1"` }()
+	interrupt = true
+	if _, err := d.download(); err == nil {
+		t.Fatal("interrupted download: got no error")
+	}
+	if st, err := os.Stat(d.file + ".part"); err != nil || st.Size() == 0 {
+		t.Fatalf("interrupted download: got %v, want the partial file kept to be resumed", err)
+	}
+	if changed, err := d.download(); err != nil || !changed {
+		t.Fatalf("resumed download: got %v, %v, want a new copy", changed, err)
+	}
+	if b, _ := ioutil.ReadFile(d.file); !bytes.Equal(b, testRemoteDB) {
+		t.Errorf("resumed download: got %d bytes, want %d", len(b), len(testRemoteDB))
+	}
+	assertNoPart(t, d, "after a resumed download")
+}
+
+func TestDownloadError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	d := newDownloader(srv.URL+"/GeoLite2-City.mmdb", dbOptions{dir: t.TempDir()})
+	if _, err := d.download(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got error %v, want the 503", err)
+	}
+	assertNoPart(t, d, "after an error")
+}
+
+func TestDownloadRangeMismatch(t *testing.T) {
+	// The server sends ranges from the start of the file, whatever the
+	// ones asked for.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", testEtag)
+		if r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(testRemoteDB)-1, len(testRemoteDB)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(testRemoteDB)
+	}))
+	defer srv.Close()
+	d := newDownloader(srv.URL+"/GeoLite2-City.mmdb", dbOptions{dir: t.TempDir()})
+	if err := ioutil.WriteFile(d.file+".part", testRemoteDB[:100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (validators{etag: testEtag}).write(d.file + ".part.validators"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.download(); err == nil {
+		t.Fatal("mismatched range: got no error")
+	}
+	assertNoPart(t, d, "after a mismatched range")
+	if changed, err := d.download(); err != nil || !changed {
+		t.Fatalf("restarted download: got %v, %v, want a new copy", changed, err)
+	}
+	if b, _ := ioutil.ReadFile(d.file); !bytes.Equal(b, testRemoteDB) {
+		t.Errorf("restarted download: got %d bytes, want %d", len(b), len(testRemoteDB))
+	}
+}
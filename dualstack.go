@@ -0,0 +1,101 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryDualIP is queryIP for dual-stack answers: it returns an IPv4 and
+// an IPv6 address of hostnames with both, picked at random among their
+// A and AAAA records, or the single address of the others.
+func queryDualIP(name, domain string, timeout time.Duration) ([]net.IP, string, error) {
+	h, ok := stripDomain(name, domain)
+	if !ok || !validHost(h) {
+		return nil, "", errInvalidName
+	}
+	if ip := parseIP(h); ip != nil {
+		return []net.IP{ip}, "", nil
+	}
+	if !switches.on(switchResolve) {
+		return nil, "", errResolveDisabled
+	}
+	if !resolveBreaker.allow() {
+		return nil, "", errResolverDown
+	}
+	begin := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeouts.timeout(timeout))
+	defer cancel()
+	var v4, v6 []net.IP
+	var cname string
+	if res := getResolver(); res != nil {
+		var err error
+		v4, v6, cname, err = res.lookupDual(ctx, h)
+		resolveBreaker.record(resolveFailed(err))
+		resolveTimeouts.observe(time.Since(begin))
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, h)
+		resolveBreaker.record(ctx.Err() == context.DeadlineExceeded)
+		resolveTimeouts.observe(time.Since(begin))
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, "", errResolveTimeout
+		}
+		if err != nil {
+			return nil, "", errHostNotFound
+		}
+		for _, a := range addrs {
+			if a.IP.To4() != nil {
+				v4 = append(v4, a.IP)
+			} else {
+				v6 = append(v6, a.IP)
+			}
+		}
+	}
+	var ips []net.IP
+	for _, family := range [][]net.IP{v4, v6} {
+		if len(family) > 0 {
+			ips = append(ips, family[rand.Intn(len(family))])
+		}
+	}
+	if len(ips) == 0 {
+		return nil, "", errHostNotFound
+	}
+	return ips, cname, nil
+}
+
+// lookupDual returns the IPv4 and IPv6 addresses of host, and its
+// canonical name.
+func (res *resolver) lookupDual(ctx context.Context, host string) ([]net.IP, []net.IP, string, error) {
+	v4, cname, err := res.query(ctx, dns.Fqdn(host), dns.TypeA)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	v6, cname6, err := res.query(ctx, dns.Fqdn(host), dns.TypeAAAA)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if len(v4) == 0 {
+		cname = cname6
+	}
+	return v4, v6, strings.TrimSuffix(cname, "."), nil
+}
+
+// familyLabel returns the label of dual-stack answers for ip.
+func familyLabel(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4="
+	}
+	return "ipv6="
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// selfLabel is the host of the queries for the location of the client
+// itself, self.<domain>, e.g. to show users where they are seen from.
+const selfLabel = "self"
+
+// selfQuery reports whether a question of r is a self query, with any
+// option labels. Their answers hold the client address.
+func (h *handle) selfQuery(r *dns.Msg) bool {
+	for _, q := range r.Question {
+		_, name := h.options(q.Name)
+		domain, _ := h.queryDomain(name)
+		if host, ok := stripDomain(name, domain); ok && strings.EqualFold(host, selfLabel) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientSubnet returns the EDNS Client Subnet option (RFC 7871) of opt,
+// or nil.
+func clientSubnet(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// selfIP returns the address located for self queries: the client subnet
+// of r, as sent by recursive resolvers on behalf of their clients, or
+// the address r came from. The ECS option of the reply is returned with
+// the subnet, scoped to its prefix since the answer depends on it.
+// Subnets of length 0, sent by clients asking for their address not to
+// be used, fall back to the source address.
+func selfIP(w dns.ResponseWriter, r *dns.Msg) (net.IP, *dns.EDNS0_SUBNET) {
+	ecs := clientSubnet(r.IsEdns0())
+	if ecs == nil || ecs.SourceNetmask == 0 {
+		return clientIP(w), nil
+	}
+	return ecs.Address, ecsReply(ecs, ecs.SourceNetmask)
+}
+
+// ecsReply returns the ECS option of the replies to queries with ecs: the
+// family, prefix and address of ecs, with the prefix the answer is valid
+// for as scope, 0 for the answers that don't depend on the client.
+func ecsReply(ecs *dns.EDNS0_SUBNET, scope uint8) *dns.EDNS0_SUBNET {
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ecs.Family,
+		SourceNetmask: ecs.SourceNetmask,
+		SourceScope:   scope,
+		Address:       ecs.Address,
+	}
+}
+
+// hasSubnet reports whether opts has an ECS option.
+func hasSubnet(opts []dns.EDNS0) bool {
+	for _, o := range opts {
+		if o.Option() == dns.EDNS0SUBNET {
+			return true
+		}
+	}
+	return false
+}
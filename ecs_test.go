@@ -0,0 +1,86 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mvrilo/freegeoip-dns/events"
+)
+
+// selfAnswers receives the answer events of self queries.
+var selfAnswers = make(chan events.Answer, 100)
+
+func init() {
+	events.OnAnswer(func(a events.Answer) {
+		if strings.HasPrefix(a.Name, selfLabel+".") {
+			select {
+			case selfAnswers <- a:
+			default:
+			}
+		}
+	})
+}
+
+func TestSelf(t *testing.T) {
+	h := newTestHandle(t, fixtureDB)
+	h.cache = newLookupCache(100)
+	// A relayed answer would be in the kv format of the fallback.
+	fb := newTestHandle(t, fixtureDB)
+	if err := fb.policy.set("format", "kv"); err != nil {
+		t.Fatal(err)
+	}
+	h.fallback = newFallback(startServer(t, fb, nil), testDomain, time.Second)
+	addr := startServer(t, h, nil)
+
+	for _, tc := range []struct {
+		subnet string
+		want   []string
+		scope  int // of the ECS option of the reply, -1 for none
+	}{
+		// 127.0.0.1 can't be located, and is not relayed.
+		{"", []string{"127.0.0.1"}, -1},
+		{"8.8.8.0/24", []string{"8.8.8.0", "US", "Mountain View"}, 24},
+		{"2001:db8:2::/48", []string{"2001:db8:2::", "DE", "Berlin"}, 48},
+		// A /0 subnet asks for the client address not to be used.
+		{"0.0.0.0/0", []string{"127.0.0.1"}, 0},
+	} {
+		r := exchange(t, addr, "udp", subnetQuery(t, selfLabel, dns.TypeTXT, tc.subnet))
+		got := answerText(t, r)
+		if strings.Contains(got, "=") {
+			t.Errorf("ECS %q: got the fallback answer %q", tc.subnet, got)
+		}
+		for _, s := range tc.want {
+			if !strings.Contains(got, s) {
+				t.Errorf("ECS %q: got %q, want it to contain %q", tc.subnet, got, s)
+			}
+		}
+		ecs := clientSubnet(r.IsEdns0())
+		switch {
+		case tc.scope < 0 && ecs != nil:
+			t.Errorf("without ECS: got the ECS option %s", ecs)
+		case tc.scope >= 0 && ecs != nil && int(ecs.SourceScope) != tc.scope:
+			t.Errorf("ECS %q: got the ECS option %s, want it scoped to /%d", tc.subnet, ecs, tc.scope)
+		case tc.scope > 0 && ecs == nil:
+			t.Errorf("ECS %q: got no ECS option, want it scoped to /%d", tc.subnet, tc.scope)
+		}
+
+		select {
+		case a := <-selfAnswers:
+			if a.IP != nil {
+				t.Errorf("ECS %q: got the client address %s exported as the answer IP", tc.subnet, a.IP)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("ECS %q: got no answer event", tc.subnet)
+		}
+	}
+	if ips := h.cache.ips(); len(ips) != 0 {
+		t.Errorf("got the client addresses %v cached", ips)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ede returns an Extended DNS Error option (RFC 8914).
+func ede(code uint16, text string) dns.EDNS0 {
+	return &dns.EDNS0_EDE{InfoCode: code, ExtraText: text}
+}
+
+// staleEDE returns a Stale Answer option if the loaded database was built
+// longer than the max database age ago, or nil.
+func (h *handle) staleEDE() []dns.EDNS0 {
+	if h.maxDBAge <= 0 {
+		return nil
+	}
+	meta := h.info.get()
+	if meta == nil || time.Since(meta.BuildTime) <= h.maxDBAge {
+		return nil
+	}
+	return []dns.EDNS0{ede(dns.ExtendedErrorCodeStaleAnswer, "database built "+meta.BuildTime.Format(time.RFC3339))}
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ipBase32 is the encoding of base32 IP labels: RFC 4648 without padding,
+// case insensitive.
+var ipBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Prefixes of the hex and base32 IP labels, so that single label
+// hostnames that happen to be valid hex or base32, like deadbeef, are not
+// taken for IPs.
+const (
+	hexPrefix    = "hex-"
+	base32Prefix = "b32-"
+)
+
+// decodeIPLabel decodes an IP encoded as a single label, for resolvers
+// that mangle or filter dotted labels. The encoding is given by the
+// prefix of the label, case insensitive, and the address family by its
+// length:
+//
+//	hex-0a000001                          hex IPv4
+//	hex-20010db8000000000000000000000001  hex IPv6
+//	b32-biaaaai                           base32 IPv4
+//	b32-eaaq3oaaaaaaaaaaaaaaaaaaae        base32 IPv6
+//
+// Base32 labels must be canonical, with the unused trailing bits zero.
+// Labels made of digits only, without leading zeros, are decimal IPv4
+// addresses instead, as written by some legacy logging systems:
+// 167772161 is 10.0.0.1. It returns nil if label is not an encoded IP.
+func decodeIPLabel(label string) net.IP {
+	if ip := decimalIP(label); ip != nil {
+		return ip
+	}
+	if len(label) < len(hexPrefix) {
+		return nil
+	}
+	prefix, enc := strings.ToLower(label[:len(hexPrefix)]), label[len(hexPrefix):]
+	var b []byte
+	var err error
+	switch {
+	case prefix == hexPrefix && (len(enc) == 2*net.IPv4len || len(enc) == 2*net.IPv6len):
+		b, err = hex.DecodeString(enc)
+	case prefix == base32Prefix && (len(enc) == ipBase32.EncodedLen(net.IPv4len) || len(enc) == ipBase32.EncodedLen(net.IPv6len)):
+		enc = strings.ToUpper(enc)
+		b, err = ipBase32.DecodeString(enc)
+		if err == nil && ipBase32.EncodeToString(b) != enc {
+			return nil
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return net.IP(b)
+}
+
+// decimalIP returns the IPv4 address of the decimal integer s, or nil if
+// s is not one.
+func decimalIP(s string) net.IP {
+	if s == "" || (s[0] == '0' && s != "0") || strings.Trim(s, "0123456789") != "" {
+		return nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return nil
+	}
+	return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
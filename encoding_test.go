@@ -0,0 +1,96 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDecodeIPLabelHostnames(t *testing.T) {
+	// Single label hostnames of the length of hex or base32 IPs.
+	for _, label := range []string{
+		"deadbeef", "cafebabe", "facefeed",
+		"0a000001", "20010db8000000000000000000000001",
+		"biaaaai", "eaaq3oaaaaaaaaaaaaaaaaaaae",
+		"hex-deadbee", "b32-biaaaa", "x-0a000001",
+	} {
+		if ip := decodeIPLabel(label); ip != nil {
+			t.Errorf("decodeIPLabel(%q) = %s, want no IP", label, ip)
+		}
+	}
+}
+
+func TestDecimalIP(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want string // empty for no IP
+	}{
+		{"0", "0.0.0.0"},
+		{"1", "0.0.0.1"},
+		{"167772161", "10.0.0.1"},
+		{"134744072", "8.8.8.8"},
+		{"4294967295", "255.255.255.255"},
+		{"4294967296", ""},
+		{"18446744073709551616", ""},
+		{"00", ""},
+		{"0167772161", ""},
+		{"", ""},
+		{"-1", ""},
+		{"+1", ""},
+		{"1e9", ""},
+		{"16777216.1", ""},
+	} {
+		got := decimalIP(tc.s)
+		if tc.want == "" {
+			if got != nil {
+				t.Errorf("decimalIP(%q) = %s, want no IP", tc.s, got)
+			}
+			continue
+		}
+		if !got.Equal(net.ParseIP(tc.want)) {
+			t.Errorf("decimalIP(%q) = %s, want %s", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeIPLabel(t *testing.T) {
+	for _, tc := range []struct {
+		label string
+		want  string // empty for no IP
+	}{
+		{"hex-0a000001", "10.0.0.1"},
+		{"HEX-0A000001", "10.0.0.1"},
+		{"hex-00000000", "0.0.0.0"},
+		{"hex-ffffffff", "255.255.255.255"},
+		{"hex-20010db8000000000000000000000001", "2001:db8::1"},
+		{"hex-ffffffffffffffffffffffffffffffff", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"hex-0a00000g", ""},
+		{"hex-0a0000010", ""},
+		{"hex-", ""},
+		{"b32-biaaaai", "10.0.0.1"},
+		{"B32-BIAAAAI", "10.0.0.1"},
+		{"b32-aaaaaaa", "0.0.0.0"},
+		{"b32-eaaq3oaaaaaaaaaaaaaaaaaaae", "2001:db8::1"},
+		// Not canonical: the unused trailing bits are not zero.
+		{"b32-biaaaaj", ""},
+		{"b32-biaaaa1", ""},
+		{"b32-biaaaaii", ""},
+		{"167772161", "10.0.0.1"},
+		{"4294967296", ""},
+	} {
+		got := decodeIPLabel(tc.label)
+		if tc.want == "" {
+			if got != nil {
+				t.Errorf("decodeIPLabel(%q) = %s, want no IP", tc.label, got)
+			}
+			continue
+		}
+		if !got.Equal(net.ParseIP(tc.want)) {
+			t.Errorf("decodeIPLabel(%q) = %s, want %s", tc.label, got, tc.want)
+		}
+	}
+}
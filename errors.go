@@ -0,0 +1,77 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fiorix/freegeoip"
+	"github.com/miekg/dns"
+	"github.com/mvrilo/freegeoip-dns/events"
+)
+
+var internalErrors = newCounter("freegeoip_dns_internal_errors_total", "Queries failed by an internal error, by public error text.", "error")
+
+// internalError is a failure whose detail, e.g. a file name or a decode
+// error, is logged but never sent to clients, which get its public text
+// and the ID of the log line.
+type internalError struct {
+	code   uint16 // extended error code
+	public string
+	err    error
+}
+
+// internal returns an internal error with the public text, sent with
+// the extended error code, and the detail err.
+func internal(code uint16, public string, err error) *internalError {
+	return &internalError{code: code, public: public, err: err}
+}
+
+func (e *internalError) Error() string { return e.public + ": " + e.err.Error() }
+func (e *internalError) Unwrap() error { return e.err }
+
+// newRequestID returns a random ID correlating an answer with its log
+// line.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// failInternal answers SERVFAIL for the internal error e, with its public
+// text and a request ID in an extended error, and logs the ID and the
+// full error. Error lines are written even in silent mode and have the
+// stable format
+//
+//	ERROR id=<request id> name=<query name> error=<quoted error>
+func (h *handle) failInternal(e *internalError, start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	id := newRequestID()
+	name := "-"
+	if len(r.Question) > 0 {
+		name = r.Question[0].Name
+	}
+	log.Printf("ERROR id=%s name=%s error=%q\n", id, name, e.Error())
+	internalErrors.inc(e.public)
+	events.Default.EmitError(events.Error{Query: h.eventQuery(start, w, r), Rcode: dns.RcodeServerFailure, Reason: e.public})
+	h.failed(dns.RcodeServerFailure, start, w, r, ede(e.code, e.public+" (id "+id+")"))
+}
+
+// lookupFail answers SERVFAIL for the database lookup error err.
+func (h *handle) lookupFail(err error, start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	if err == freegeoip.ErrUnavailable {
+		h.fail(dns.RcodeServerFailure, start, w, r, ede(dns.ExtendedErrorCodeNotReady, "database not loaded"))
+		return
+	}
+	file := "-"
+	if meta := h.info.get(); meta != nil {
+		file = meta.File
+	}
+	h.failInternal(internal(dns.ExtendedErrorCodeOther, "database lookup failed", fmt.Errorf("%s: %v", file, err)), start, w, r)
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package events is the event hook API of freegeoip-dns. Code built into
+// the server, e.g. a file added to the main package that registers hooks
+// in its init function, can attach custom logging, billing or anomaly
+// detection without changing the handler:
+//
+//	func init() {
+//		events.OnAnswer(func(a events.Answer) {
+//			bill(a.Client, a.Duration)
+//		})
+//	}
+//
+// Hooks are called synchronously by the goroutine answering the query, so
+// they must be fast; slow work should be handed off to another goroutine.
+package events
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Query is a query received by the server. Client is nil when the
+// server runs in privacy mode.
+type Query struct {
+	Time   time.Time
+	Client net.IP
+	Name   string
+	Type   uint16
+}
+
+// Answer is the answer sent to a query. IP and Country are set for
+// geolocation answers.
+type Answer struct {
+	Query
+	Rcode    int
+	Duration time.Duration
+	IP       net.IP
+	Country  string
+}
+
+// Error is a failure answering a query, sent before its Answer. Denied
+// is set for queries refused by policy, e.g. rate limited, whose Reason
+// is a stable identifier of the policy. Cause is the stable identifier of
+// the cause of NXDOMAIN answers.
+type Error struct {
+	Query
+	Rcode  int
+	Reason string
+	Denied bool
+	Cause  string
+}
+
+// DBReload is a database load, or a failure to load it if Err is not
+// nil.
+type DBReload struct {
+	Time time.Time
+	File string
+	Err  error
+}
+
+// DBClose is the close of a database, when it is replaced or the server
+// stops.
+type DBClose struct {
+	Time time.Time
+}
+
+// Bus dispatches events to the hooks registered for them.
+type Bus struct {
+	mu       sync.RWMutex
+	query    []func(Query)
+	answer   []func(Answer)
+	err      []func(Error)
+	dbReload []func(DBReload)
+	dbClose  []func(DBClose)
+}
+
+// Default is the bus the server publishes its events to.
+var Default = &Bus{}
+
+// OnQuery registers fn to be called for every query received.
+func (b *Bus) OnQuery(fn func(Query)) {
+	b.mu.Lock()
+	b.query = append(b.query, fn)
+	b.mu.Unlock()
+}
+
+// OnAnswer registers fn to be called for every answer sent.
+func (b *Bus) OnAnswer(fn func(Answer)) {
+	b.mu.Lock()
+	b.answer = append(b.answer, fn)
+	b.mu.Unlock()
+}
+
+// OnError registers fn to be called for every failed query.
+func (b *Bus) OnError(fn func(Error)) {
+	b.mu.Lock()
+	b.err = append(b.err, fn)
+	b.mu.Unlock()
+}
+
+// OnDBReload registers fn to be called for every database load.
+func (b *Bus) OnDBReload(fn func(DBReload)) {
+	b.mu.Lock()
+	b.dbReload = append(b.dbReload, fn)
+	b.mu.Unlock()
+}
+
+// OnDBClose registers fn to be called for every database close.
+func (b *Bus) OnDBClose(fn func(DBClose)) {
+	b.mu.Lock()
+	b.dbClose = append(b.dbClose, fn)
+	b.mu.Unlock()
+}
+
+// EmitQuery calls the query hooks.
+func (b *Bus) EmitQuery(q Query) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.query {
+		fn(q)
+	}
+}
+
+// EmitAnswer calls the answer hooks.
+func (b *Bus) EmitAnswer(a Answer) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.answer {
+		fn(a)
+	}
+}
+
+// EmitError calls the error hooks.
+func (b *Bus) EmitError(e Error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.err {
+		fn(e)
+	}
+}
+
+// EmitDBReload calls the database load hooks.
+func (b *Bus) EmitDBReload(r DBReload) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.dbReload {
+		fn(r)
+	}
+}
+
+// EmitDBClose calls the database close hooks.
+func (b *Bus) EmitDBClose(c DBClose) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.dbClose {
+		fn(c)
+	}
+}
+
+// OnQuery registers fn on the Default bus.
+func OnQuery(fn func(Query)) { Default.OnQuery(fn) }
+
+// OnAnswer registers fn on the Default bus.
+func OnAnswer(fn func(Answer)) { Default.OnAnswer(fn) }
+
+// OnError registers fn on the Default bus.
+func OnError(fn func(Error)) { Default.OnError(fn) }
+
+// OnDBReload registers fn on the Default bus.
+func OnDBReload(fn func(DBReload)) { Default.OnDBReload(fn) }
+
+// OnDBClose registers fn on the Default bus.
+func OnDBClose(fn func(DBClose)) { Default.OnDBClose(fn) }
@@ -0,0 +1,68 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var fallbackQueries = newCounter("freegeoip_dns_fallback_queries_total", "Queries sent to the fallback service, by result: relayed or miss.", "result")
+
+// fallback is another geo-DNS service queried for the names the server
+// can't answer, e.g. while migrating between providers.
+type fallback struct {
+	addr   string // host:port
+	domain string // domain of the service
+	client *dns.Client
+}
+
+func newFallback(addr, domain string, timeout time.Duration) *fallback {
+	return &fallback{addr: addr, domain: domain, client: &dns.Client{Timeout: timeout}}
+}
+
+// lookup queries the service for the TXT answer of host, unescaped, so
+// that it is sent as received.
+func (f *fallback) lookup(host string) ([]string, bool) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(join(host, f.domain)), dns.TypeTXT)
+	r, _, err := f.client.Exchange(m, f.addr)
+	if err != nil || r.Rcode != dns.RcodeSuccess {
+		return nil, false
+	}
+	for _, rr := range r.Answer {
+		if t, ok := rr.(*dns.TXT); ok {
+			txts := make([]string, len(t.Txt))
+			for i, s := range t.Txt {
+				txts[i] = unescapeTxt(s)
+			}
+			return txts, true
+		}
+	}
+	return nil, false
+}
+
+// relay answers r, a TXT query, with the answer of the fallback service
+// for name, stripped of options and of domain. It returns false if there
+// is no fallback or it has no answer either.
+func (h *handle) relay(name, domain string, start time.Time, w dns.ResponseWriter, r *dns.Msg) bool {
+	if h.fallback == nil {
+		return false
+	}
+	host, ok := stripDomain(name, domain)
+	if !ok || host == "" {
+		return false
+	}
+	txts, ok := h.fallback.lookup(host)
+	if !ok {
+		fallbackQueries.inc("miss")
+		return false
+	}
+	fallbackQueries.inc("relayed")
+	h.txt(txts, start, w, r)
+	return true
+}
@@ -0,0 +1,46 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFallback(t *testing.T) {
+	// The fallback locates 8.8.8.8, the server doesn't.
+	fb := newTestHandle(t, fixtureDB)
+	if err := fb.policy.set("format", "kv"); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "geo.mmdb")
+	writeTestDB(t, file, "network,country_code,country_name,city\n81.2.69.0/24,GB,United Kingdom,London\n")
+	h := newTestHandle(t, file)
+	h.fallback = newFallback(startServer(t, fb, nil), testDomain, time.Second)
+	addr := startServer(t, h, nil)
+
+	if got := answerText(t, exchange(t, addr, "udp", txtQuery("8.8.8.8"))); !strings.Contains(got, `country_name="United States"`) {
+		t.Errorf("TXT: got %q, want the answer of the fallback", got)
+	}
+	for _, m := range []*dns.Msg{txtQuery("8.8.8.8"), txtQuery("unknown.invalid")} {
+		m.Question[0].Qtype = dns.TypeLOC
+		r := exchange(t, addr, "udp", m)
+		for _, rr := range r.Answer {
+			if rr.Header().Rrtype != dns.TypeLOC {
+				t.Errorf("LOC %s: got the answer %s", m.Question[0].Name, rr)
+			}
+		}
+	}
+	m := txtQuery("8.8.8.8")
+	m.Question[0].Qtype = dns.TypeLOC
+	if r := exchange(t, addr, "udp", m); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Errorf("LOC of an IP not located: got rcode %s with %d answers, want NODATA", dns.RcodeToString[r.Rcode], len(r.Answer))
+	}
+}
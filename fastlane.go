@@ -0,0 +1,102 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fastLane answers the common case, TXT queries for a literal IP right
+// under the domain without option labels, skipping the dispatch, option
+// parsing and resolution of the general path. Its answers are the same.
+type fastLane struct {
+	// suffix is the domain with leading and trailing dots.
+	suffix string
+	// opt is the OPT record of replies to queries without the DO bit,
+	// NSID, padding and extended errors.
+	opt *dns.OPT
+}
+
+// packBuffers are the buffers fast lane answers are packed in.
+var packBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, dns.DefaultMsgSize)
+		return &b
+	},
+}
+
+// newFastLane returns the fast lane of h, or nil if h has per query
+// settings or a domain the fast lane doesn't support.
+func (h *handle) newFastLane() *fastLane {
+	if h.domain == "" || h.wildcard || h.debug || h.dual || h.policy.format != positional ||
+		h.formatter != nil || h.hmacKey != nil || h.faults != nil {
+		return nil
+	}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	return &fastLane{suffix: "." + dns.Fqdn(h.domain), opt: opt}
+}
+
+// fastAnswer answers r if it is in the fast lane, reporting whether it
+// did. Queries it doesn't answer go through question.
+func (h *handle) fastAnswer(start time.Time, w dns.ResponseWriter, r *dns.Msg) bool {
+	q := r.Question[0]
+	if q.Qtype != dns.TypeTXT || q.Qclass != dns.ClassINET || r.IsTsig() != nil {
+		return false
+	}
+	n := len(q.Name) - len(h.fast.suffix)
+	if n <= 0 || !strings.EqualFold(q.Name[n:], h.fast.suffix) {
+		return false
+	}
+	ip := parseIP(q.Name[:n])
+	if ip == nil {
+		return false
+	}
+	query, err := h.lookup(ip)
+	if err != nil {
+		h.lookupFail(err, start, w, r)
+		return true
+	}
+	h.countContinent(query)
+	if query.Country.ISOCode == "" && h.relay(q.Name, h.domain, start, w, r) {
+		return true
+	}
+	fields := h.fields(query, ip, "", "", clientIP(w))
+	m := h.txtReply([]string{response(fields, h.level, h.version, h.omitEmpty)}, r)
+	h.fastFinish(m, w, r, h.staleEDE())
+	h.account(m, start, w, r, &location{ip: ip, country: query.Country.ISOCode})
+	return true
+}
+
+// fastFinish is finish for fast lane answers, which are not signed: it
+// uses the shared OPT record when it can, and packs m in a pooled buffer.
+func (h *handle) fastFinish(m *dns.Msg, w dns.ResponseWriter, r *dns.Msg, extra []dns.EDNS0) {
+	if opt := r.IsEdns0(); opt != nil {
+		if len(extra) == 0 && !opt.Do() && h.instance == "" && !wantsPadding(opt) && clientSubnet(opt) == nil {
+			m.Extra = append(m.Extra, h.fast.opt)
+		} else {
+			o := h.replyOPT(opt, extra)
+			m.Extra = append(m.Extra, o)
+			h.pad(m, o, w, r)
+		}
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncate(udpSize(r))
+	}
+	buf := packBuffers.Get().(*[]byte)
+	defer packBuffers.Put(buf)
+	b, err := m.PackBuffer(*buf)
+	if err != nil {
+		w.WriteMsg(m)
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// faultFlagPrefix is the prefix of the fault injection flags, which are
+// left out of the usage message.
+const faultFlagPrefix = "fault-"
+
+// faults are artificial failures injected for resilience testing of
+// clients, e.g. their retry and caching behavior.
+type faults struct {
+	latency  time.Duration // added to every lookup
+	servfail float64       // fraction of queries answered SERVFAIL
+}
+
+// delay sleeps for the injected latency.
+func (f *faults) delay() {
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+}
+
+// fail reports whether to answer the current query SERVFAIL.
+func (f *faults) fail() bool {
+	return f.servfail > 0 && rand.Float64() < f.servfail
+}
+
+// churn reopens db, run every -fault-reload.
+func churn(db *geoDB) error {
+	if err := db.reopen(); err != nil {
+		return fmt.Errorf("fault injection: database reload: %v", err)
+	}
+	return nil
+}
+
+// usage prints the usage message without the fault injection flags.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, faultFlagPrefix) {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fs.PrintDefaults()
+}
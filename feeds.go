@@ -0,0 +1,225 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// listFlag is a flag that can be given multiple times.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// prefixTable maps network prefixes to values and matches the longest
+// prefix first. IPv4 prefixes are stored in their IPv6-mapped form.
+type prefixTable struct {
+	lens []int
+	nets map[int]map[string]string
+}
+
+func newPrefixTable() *prefixTable {
+	return &prefixTable{nets: make(map[int]map[string]string)}
+}
+
+// insert adds network n with value v, replacing any previous value.
+func (t *prefixTable) insert(n *net.IPNet, v string) {
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	m, ok := t.nets[ones]
+	if !ok {
+		m = make(map[string]string)
+		t.nets[ones] = m
+		t.lens = append(t.lens, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(t.lens)))
+	}
+	m[string(n.IP.To16().Mask(net.CIDRMask(ones, 128)))] = v
+}
+
+// lookup returns the value of the longest prefix containing ip.
+func (t *prefixTable) lookup(ip net.IP) (string, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return "", false
+	}
+	for _, ones := range t.lens {
+		if v, ok := t.nets[ones][string(ip.Mask(net.CIDRMask(ones, 128)))]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// openSource returns a reader for src, fetching it if src is a URL.
+func openSource(src string) (io.ReadCloser, error) {
+	u, err := url.Parse(src)
+	if err != nil || len(u.Scheme) == 0 {
+		return os.Open(src)
+	}
+	resp, err := http.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", src, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// acl is a list of allowed networks.
+type acl struct {
+	table *prefixTable
+}
+
+// newACL returns an acl of the given CIDRs or IP addresses.
+func newACL(cidrs []string) (*acl, error) {
+	a := &acl{table: newPrefixTable()}
+	for _, c := range cidrs {
+		n, err := parseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		a.table.insert(n, "")
+	}
+	return a, nil
+}
+
+// contains reports whether ip is allowed.
+func (a *acl) contains(ip net.IP) bool {
+	_, ok := a.table.lookup(ip)
+	return ok
+}
+
+// parseCIDR parses a CIDR or a single IP address as a host prefix.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// readPrefixes reads one CIDR or IP address per line from r into t with
+// value v. Text after '#' or ';' is treated as a comment, which covers
+// the Spamhaus DROP and most plain text blocklist formats.
+func readPrefixes(r io.Reader, t *prefixTable, v string) error {
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		l := s.Text()
+		if i := strings.IndexAny(l, "#;"); i >= 0 {
+			l = l[:i]
+		}
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		n, err := parseCIDR(strings.Fields(l)[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		t.insert(n, v)
+	}
+	return s.Err()
+}
+
+// loadPrefixFile reads a prefix list from the named file.
+func loadPrefixFile(name string, v string) (*prefixTable, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := newPrefixTable()
+	if err = readPrefixes(f, t, v); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return t, nil
+}
+
+// threatFeed is a named local IP blocklist.
+type threatFeed struct {
+	name  string
+	path  string
+	table *prefixTable
+}
+
+// threatFeeds holds the threat intel feeds matched against looked up IPs.
+type threatFeeds struct {
+	mu    sync.RWMutex
+	feeds []*threatFeed
+}
+
+// newThreatFeeds parses feed specs in the form name=path and loads them.
+func newThreatFeeds(specs []string) (*threatFeeds, error) {
+	tf := &threatFeeds{}
+	for _, spec := range specs {
+		p := strings.SplitN(spec, "=", 2)
+		if len(p) != 2 || p[0] == "" || p[1] == "" {
+			return nil, fmt.Errorf("invalid threat feed %q, want name=path", spec)
+		}
+		tf.feeds = append(tf.feeds, &threatFeed{name: p[0], path: p[1]})
+	}
+	return tf, tf.load()
+}
+
+// load (re)reads all feeds. A feed that fails to load keeps its previous
+// contents, if any.
+func (tf *threatFeeds) load() error {
+	var errs []string
+	for _, f := range tf.feeds {
+		t, err := loadPrefixFile(f.path, f.name)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		tf.mu.Lock()
+		f.table = t
+		tf.mu.Unlock()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("threat feeds: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// lookup returns the names of the feeds listing ip, comma separated.
+func (tf *threatFeeds) lookup(ip net.IP) string {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	var names []string
+	for _, f := range tf.feeds {
+		if f.table == nil {
+			continue
+		}
+		if _, ok := f.table.lookup(ip); ok {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
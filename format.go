@@ -0,0 +1,199 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Formatter writes the response of the fields of a lookup, with the
+// settings of the query. Formatters are registered by name, which selects
+// them in -format, the format setting of domain policies and query labels.
+type Formatter interface {
+	Format(fields []field, opts *queryOptions) (string, error)
+}
+
+// RecordFormatter is a Formatter writing the whole database record of the
+// IP rather than only the fields of the response.
+type RecordFormatter interface {
+	Formatter
+	FormatRecord(ip net.IP, query *Query, fields []field, opts *queryOptions) (string, error)
+}
+
+// formatters maps the format names to their formatter.
+var formatters = make(map[string]Formatter)
+
+// registerFormatter registers f by name, which must be unique. Formats are
+// registered at init, or at startup before the format settings are parsed.
+func registerFormatter(name string, f Formatter) {
+	if _, dup := formatters[name]; dup {
+		panic("format " + name + " registered twice")
+	}
+	formatters[name] = f
+}
+
+// formatNames returns the names of the registered formats, sorted.
+func formatNames() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// positional writes the response in the positional schema of the response
+// version, the default format.
+var positional Formatter = positionalFormat{}
+
+func init() {
+	registerFormatter("positional", positional)
+	registerFormatter("plain", positional)
+	registerFormatter("json", recordFormat{})
+	registerFormatter("kv", fieldsFormat(kvFormat))
+	registerFormatter("csv", fieldsFormat(csvFormat))
+}
+
+type positionalFormat struct{}
+
+func (positionalFormat) Format(fields []field, opts *queryOptions) (string, error) {
+	return response(fields, opts.level, opts.version, opts.omitEmpty), nil
+}
+
+// fieldsFormat is a Formatter writing the fields selected for the query.
+type fieldsFormat func(fields []field) string
+
+func (f fieldsFormat) Format(fields []field, opts *queryOptions) (string, error) {
+	return f(selectFields(fields, opts.level, opts.omitEmpty)), nil
+}
+
+// recordFormat writes the database record of the IP, the Query, as JSON,
+// with the names in all the languages of the database. The extra fields
+// selected for the query, like the static fields and those of the other
+// databases, are under extra.
+type recordFormat struct{}
+
+// Format writes the fields as a JSON object, for the answers without a
+// record.
+func (recordFormat) Format(fields []field, opts *queryOptions) (string, error) {
+	return jsonFormat(selectFields(fields, opts.level, opts.omitEmpty)), nil
+}
+
+func (recordFormat) FormatRecord(ip net.IP, query *Query, fields []field, opts *queryOptions) (string, error) {
+	var extra []field
+	for _, f := range selectFields(fields, opts.level, opts.omitEmpty) {
+		if f.keyed {
+			extra = append(extra, f)
+		}
+	}
+	record := struct {
+		IP string `json:"ip"`
+		*Query
+		Extra json.RawMessage `json:"extra,omitempty"`
+	}{IP: ip.String(), Query: query}
+	if len(extra) > 0 {
+		record.Extra = json.RawMessage(jsonFormat(extra))
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(record)
+	return strings.TrimSuffix(b.String(), "\n"), err
+}
+
+// templateFormat writes the fields selected for the query with a
+// text/template, given the map of field names to values. Fields missing
+// are empty.
+type templateFormat struct {
+	t *template.Template
+}
+
+// newTemplateFormat parses the template text of a templateFormat.
+func newTemplateFormat(text string) (*templateFormat, error) {
+	t, err := template.New("format").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &templateFormat{t: t}, nil
+}
+
+func (f *templateFormat) Format(fields []field, opts *queryOptions) (string, error) {
+	data := make(map[string]string)
+	for _, fd := range selectFields(fields, opts.level, opts.omitEmpty) {
+		data[fd.name] = fd.value
+	}
+	var b strings.Builder
+	if err := f.t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// selectFields returns the fields up to level, without the empty ones if
+// omitEmpty is set.
+func selectFields(fields []field, level int, omitEmpty bool) []field {
+	var ret []field
+	for _, f := range fields {
+		if f.level <= level && (!omitEmpty || f.value != "") {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// jsonFormat writes the fields as a JSON object, in order.
+func jsonFormat(fields []field) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		enc.Encode(f.name)
+		b.Truncate(b.Len() - 1) // newline written by Encode
+		b.WriteByte(':')
+		enc.Encode(f.value)
+		b.Truncate(b.Len() - 1)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// kvFormat writes the fields as name=value pairs separated by spaces,
+// quoting values with spaces or quotes.
+func kvFormat(fields []field) string {
+	ret := make([]string, len(fields))
+	for i, f := range fields {
+		v := f.value
+		if v == "" || strings.ContainsAny(v, " \"=") {
+			v = strconv.Quote(v)
+		}
+		ret[i] = f.name + "=" + v
+	}
+	return strings.Join(ret, " ")
+}
+
+// csvFormat writes the field values as a CSV record, without header.
+func csvFormat(fields []field) string {
+	vs := make([]string, len(fields))
+	for i, f := range fields {
+		vs[i] = f.value
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write(vs)
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
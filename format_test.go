@@ -0,0 +1,53 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestJSONFormat(t *testing.T) {
+	h := newTestHandle(t, fixtureDB)
+	if err := h.policy.set("format", "json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.policy.set("field.source", "geo-1"); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, h, nil)
+	m := txtQuery("8.8.8.8")
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	got := answerText(t, exchange(t, addr, "udp", m))
+
+	var record struct {
+		IP string `json:"ip"`
+		Query
+		Extra map[string]string `json:"extra"`
+	}
+	if err := json.Unmarshal([]byte(got), &record); err != nil {
+		t.Fatalf("got %q, not a JSON object: %v", got, err)
+	}
+	if record.IP != "8.8.8.8" || record.Country.ISOCode != "US" || record.City.Names["en"] != "Mountain View" || record.Location.TimeZone != "America/Los_Angeles" {
+		t.Errorf("got the record %q, want the one of 8.8.8.8", got)
+	}
+	if record.Extra["source"] != "geo-1" {
+		t.Errorf("got the extra fields %v, want source=geo-1", record.Extra)
+	}
+
+	var b strings.Builder
+	if err := printAnswer(&b, &dns.TXT{Txt: txtStrings(got)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"country.iso_code", "city.names.en", "location.latitude", "extra.source"} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("printAnswer: got %q, want a %s line", b.String(), line)
+		}
+	}
+}
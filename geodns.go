@@ -0,0 +1,154 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// earthRadius is the mean radius of the Earth, in km.
+const earthRadius = 6371.0
+
+var routedAddresses = newCounter("freegeoip_dns_geodns_answers_total", "A and AAAA answers of geo-routed names, by name and endpoint, or none without an endpoint of the family.", "name", "endpoint")
+
+// endpoint is an address answering the A or AAAA queries of a route,
+// placed by its coordinates or, without, by its region: a country or
+// continent code.
+type endpoint struct {
+	Address   string   `json:"address"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Region    string   `json:"region"`
+
+	ip net.IP
+}
+
+// loadEndpoints checks the endpoints of the route named name.
+func (rt *route) loadEndpoints(name string) error {
+	for i, e := range rt.Endpoints {
+		if e == nil {
+			return fmt.Errorf("route %q has an empty endpoint %d", name, i)
+		}
+		if e.ip = net.ParseIP(e.Address); e.ip == nil {
+			return fmt.Errorf("route %q has an invalid endpoint address %q", name, e.Address)
+		}
+		if ip4 := e.ip.To4(); ip4 != nil {
+			e.ip = ip4
+		}
+		if (e.Latitude == nil) != (e.Longitude == nil) {
+			return fmt.Errorf("route %q endpoint %s has a latitude or a longitude but not both", name, e.Address)
+		}
+		if e.Latitude != nil && (math.Abs(*e.Latitude) > 90 || math.Abs(*e.Longitude) > 180) {
+			return fmt.Errorf("route %q endpoint %s has invalid coordinates", name, e.Address)
+		}
+		if e.Latitude == nil && e.Region == "" {
+			return fmt.Errorf("route %q endpoint %s has neither coordinates nor region", name, e.Address)
+		}
+		e.Region = strings.ToUpper(e.Region)
+	}
+	return nil
+}
+
+// nearest returns the endpoint of rt, of the family of qtype, for the
+// client located in q: the one of its country if any, else the nearest
+// one with coordinates if q has some, else the one of its continent,
+// else the first one.
+func (rt *route) nearest(q *Query, qtype uint16) *endpoint {
+	var family []*endpoint
+	for _, e := range rt.Endpoints {
+		if (e.ip.To4() != nil) == (qtype == dns.TypeA) {
+			family = append(family, e)
+		}
+	}
+	if len(family) == 0 {
+		return nil
+	}
+	if e := inRegion(family, q.Country.ISOCode); e != nil {
+		return e
+	}
+	if lat, lon := q.Location.Latitude, q.Location.Longitude; lat != 0 || lon != 0 {
+		var best *endpoint
+		bestDist := math.Inf(1)
+		for _, e := range family {
+			if e.Latitude == nil {
+				continue
+			}
+			if d := haversine(lat, lon, *e.Latitude, *e.Longitude); d < bestDist {
+				best, bestDist = e, d
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	if e := inRegion(family, q.Continent.Code); e != nil {
+		return e
+	}
+	return family[0]
+}
+
+// inRegion returns the first endpoint of region, or nil.
+func inRegion(endpoints []*endpoint, region string) *endpoint {
+	if region == "" {
+		return nil
+	}
+	for _, e := range endpoints {
+		if e.Region == strings.ToUpper(region) {
+			return e
+		}
+	}
+	return nil
+}
+
+// haversine returns the great-circle distance in km between two points
+// given in degrees.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(1, a)))
+}
+
+// routeAddress answers the A or AAAA query r for the route rt with the
+// endpoint nearest to the client, located by its client subnet
+// if sent, else by its address. The ECS option of the reply is scoped to
+// the subnet, since the answer depends on it.
+func (h *handle) routeAddress(rt *route, start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	m := h.reply(r)
+	m.Authoritative = true
+	ip, ecs := selfIP(w, r)
+	var client Query
+	if ip != nil && h.db.Lookup(ip, &client) != nil {
+		client = Query{} // not located
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	var extra []dns.EDNS0
+	if ecs != nil {
+		extra = append(extra, ecs)
+	}
+	e := rt.nearest(&client, q.Qtype)
+	if e == nil {
+		routedAddresses.inc(name, "none")
+		h.write(m, start, w, r, extra...)
+		return
+	}
+	routedAddresses.inc(name, e.Address)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: rt.TTL}
+	if q.Qtype == dns.TypeA {
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: e.ip})
+	} else {
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: e.ip})
+	}
+	h.write(m, start, w, r, extra...)
+}
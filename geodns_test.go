@@ -0,0 +1,159 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testEndpoints = `{
+  "www": {
+    "endpoints": [
+      {"address": "192.0.2.1", "region": "de"},
+      {"address": "192.0.2.2", "latitude": 40.7128, "longitude": -74.006},
+      {"address": "192.0.2.3", "latitude": 35.6895, "longitude": 139.6917},
+      {"address": "192.0.2.4", "region": "SA"},
+      {"address": "2001:db8::1", "region": "DE"},
+      {"address": "2001:db8::2", "latitude": 37.386, "longitude": -122.0838}
+    ]
+  },
+  "regions": {
+    "endpoints": [
+      {"address": "192.0.2.1", "region": "DE"},
+      {"address": "192.0.2.4", "region": "SA"}
+    ]
+  },
+  "v4": {
+    "endpoints": [{"address": "192.0.2.1", "region": "DE"}]
+  }
+}`
+
+// loadTestEndpoints returns the routes of testEndpoints.
+func loadTestEndpoints(t *testing.T) routes {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "routes.json")
+	if err := ioutil.WriteFile(file, []byte(testEndpoints), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := loadRoutes(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestHaversine(t *testing.T) {
+	for _, tc := range []struct {
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{51.5142, -0.0931, 51.5142, -0.0931, 0},
+		{51.5074, -0.1278, 48.8566, 2.3522, 344},     // London, Paris
+		{40.7128, -74.006, 35.6895, 139.6917, 10849}, // New York, Tokyo
+		{0, 0, 0, 180, math.Pi * earthRadius},
+		{90, 0, -90, 0, math.Pi * earthRadius},
+	} {
+		if got := haversine(tc.lat1, tc.lon1, tc.lat2, tc.lon2); math.Abs(got-tc.want) > 1 {
+			t.Errorf("haversine(%v, %v, %v, %v) = %.0f, want %.0f", tc.lat1, tc.lon1, tc.lat2, tc.lon2, got, tc.want)
+		}
+	}
+}
+
+func TestNearest(t *testing.T) {
+	rs := loadTestEndpoints(t)
+	located := func(continent, country string, lat, lon float64) *Query {
+		var q Query
+		q.Continent.Code = continent
+		q.Country.ISOCode = country
+		q.Location.Latitude, q.Location.Longitude = lat, lon
+		return &q
+	}
+	for _, tc := range []struct {
+		desc  string
+		route string
+		q     *Query
+		qtype uint16
+		want  string
+	}{
+		{"country matched before coordinates", "www", located("EU", "de", 35.6895, 139.6917), dns.TypeA, "192.0.2.1"},
+		{"nearest coordinates", "www", located("NA", "US", 37.386, -122.0838), dns.TypeA, "192.0.2.2"},
+		{"nearest coordinates", "www", located("AS", "JP", 35.6895, 139.6917), dns.TypeA, "192.0.2.3"},
+		{"continent without coordinates", "www", located("SA", "BR", 0, 0), dns.TypeA, "192.0.2.4"},
+		{"continent without endpoints with coordinates", "regions", located("SA", "BR", -23.5475, -46.6361), dns.TypeA, "192.0.2.4"},
+		{"first without any match", "regions", located("EU", "GB", 51.5142, -0.0931), dns.TypeA, "192.0.2.1"},
+		{"first not located", "www", &Query{}, dns.TypeA, "192.0.2.1"},
+		{"country of the family", "www", located("EU", "DE", 52.52, 13.405), dns.TypeAAAA, "2001:db8::1"},
+		{"nearest coordinates of the family", "www", located("AS", "JP", 35.6895, 139.6917), dns.TypeAAAA, "2001:db8::2"},
+		{"first of the family", "www", &Query{}, dns.TypeAAAA, "2001:db8::1"},
+		{"no endpoint of the family", "v4", located("EU", "DE", 52.52, 13.405), dns.TypeAAAA, ""},
+	} {
+		e := rs[tc.route].nearest(tc.q, tc.qtype)
+		got := ""
+		if e != nil {
+			got = e.Address
+		}
+		if got != tc.want {
+			t.Errorf("%s: %s %s: got %q, want %q", tc.desc, dns.TypeToString[tc.qtype], tc.route, got, tc.want)
+		}
+	}
+}
+
+func TestRouteAddress(t *testing.T) {
+	h := newTestHandle(t, fixtureDB)
+	h.routes = loadTestEndpoints(t)
+	addr := startServer(t, h, nil)
+	for _, tc := range []struct {
+		name   string
+		qtype  uint16
+		subnet string
+		want   string
+	}{
+		// 127.0.0.1 can't be located.
+		{"www", dns.TypeA, "", "192.0.2.1"},
+		{"www", dns.TypeAAAA, "", "2001:db8::1"},
+		// Mountain View is nearer to New York than to Tokyo.
+		{"www", dns.TypeA, "8.8.8.0/24", "192.0.2.2"},
+		{"www", dns.TypeAAAA, "8.8.8.0/24", "2001:db8::2"},
+		// Berlin, by its country.
+		{"www", dns.TypeAAAA, "2001:db8:2::/48", "2001:db8::1"},
+		{"www", dns.TypeA, "2001:db8:2::/48", "192.0.2.1"},
+		// São Paulo, by its continent.
+		{"regions", dns.TypeA, "192.0.2.0/24", "192.0.2.4"},
+		{"v4", dns.TypeAAAA, "2001:db8:2::/48", ""},
+	} {
+		r := exchange(t, addr, "udp", subnetQuery(t, tc.name, tc.qtype, tc.subnet))
+		desc := dns.TypeToString[tc.qtype] + " " + tc.name + " with ECS " + tc.subnet
+		if r.Rcode != dns.RcodeSuccess || !r.Authoritative {
+			t.Errorf("%s: got rcode %s, authoritative %v, want an authoritative NOERROR", desc, dns.RcodeToString[r.Rcode], r.Authoritative)
+		}
+		checkSubnetScope(t, r, tc.subnet)
+		if tc.want == "" {
+			if len(r.Answer) != 0 {
+				t.Errorf("%s: got %v, want no answers", desc, r.Answer)
+			}
+			continue
+		}
+		if len(r.Answer) != 1 {
+			t.Errorf("%s: got %v, want 1 answer", desc, r.Answer)
+			continue
+		}
+		var got string
+		switch rr := r.Answer[0].(type) {
+		case *dns.A:
+			got = rr.A.String()
+		case *dns.AAAA:
+			got = rr.AAAA.String()
+		}
+		if r.Answer[0].Header().Rrtype != tc.qtype || got != tc.want {
+			t.Errorf("%s: got %s, want %s", desc, r.Answer[0], tc.want)
+		}
+	}
+}
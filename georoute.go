@@ -0,0 +1,253 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultRouteTTL is the TTL of geo-routed answers when the route sets
+// none.
+const defaultRouteTTL = 60
+
+// defaultPool is the pool of clients whose region has no pool.
+const defaultPool = "default"
+
+// Answer orders of a route, for clients that always take the first record.
+const (
+	orderFixed      = "fixed"       // as listed in the pool
+	orderShuffle    = "shuffle"     // shuffled in every answer
+	orderClientHash = "client-hash" // shuffled the same way for each client
+)
+
+// routes are the geo-routed names of a domain, relative to it, loaded
+// from a JSON file:
+//
+//	{
+//	  "_api._tcp.service": {
+//	    "ttl": 60,
+//	    "order": "shuffle",
+//	    "pools": {
+//	      "DE": {"srv": [{"target": "api.fra.example.com.", "port": 8443}],
+//	             "addresses": ["192.0.2.1", "2001:db8::1"], "alpn": ["h2"]},
+//	      "EU": {"srv": [{"target": "api.ams.example.com.", "port": 443}]},
+//	      "default": {"srv": [{"target": "api.iad.example.com.", "port": 443}]}
+//	    }
+//	  },
+//	  "www": {
+//	    "endpoints": [
+//	      {"address": "192.0.2.1", "latitude": 50.11, "longitude": 8.68},
+//	      {"address": "198.51.100.1", "region": "SA"}
+//	    ]
+//	  }
+//	}
+//
+// Pools are keyed by country code, continent code or "default"; clients
+// get the pool of their country, else of their continent, else the
+// default one. The order of the answers is fixed unless set otherwise.
+// A and AAAA queries are answered with the nearest endpoint instead.
+type routes map[string]*route
+
+type route struct {
+	TTL       uint32           `json:"ttl"`
+	Order     string           `json:"order"`
+	Pools     map[string]*pool `json:"pools"`
+	Endpoints []*endpoint      `json:"endpoints"`
+}
+
+// pool is the set of endpoints of a region.
+type pool struct {
+	SRV []srvTarget `json:"srv"`
+	// Addresses and ALPN are the ipv4hint, ipv6hint and alpn
+	// parameters of HTTPS and SVCB answers.
+	Addresses []string `json:"addresses"`
+	ALPN      []string `json:"alpn"`
+
+	ipv4, ipv6 []net.IP
+}
+
+type srvTarget struct {
+	Target   string `json:"target"`
+	Port     uint16 `json:"port"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+}
+
+// loadRoutes reads the routes in file.
+func loadRoutes(file string) (routes, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rs routes
+	if err := json.NewDecoder(f).Decode(&rs); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	ret := make(routes, len(rs))
+	for name, rt := range rs {
+		if rt == nil || len(rt.Pools) == 0 && len(rt.Endpoints) == 0 {
+			return nil, fmt.Errorf("%s: route %q has no pools or endpoints", file, name)
+		}
+		if err := rt.loadEndpoints(name); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if rt.TTL == 0 {
+			rt.TTL = defaultRouteTTL
+		}
+		switch rt.Order {
+		case "":
+			rt.Order = orderFixed
+		case orderFixed, orderShuffle, orderClientHash:
+		default:
+			return nil, fmt.Errorf("%s: route %q has an unknown order %q, want fixed, shuffle or client-hash", file, name, rt.Order)
+		}
+		pools := make(map[string]*pool, len(rt.Pools))
+		for region, p := range rt.Pools {
+			if p == nil {
+				return nil, fmt.Errorf("%s: route %q has an empty pool %q", file, name, region)
+			}
+			for i := range p.SRV {
+				p.SRV[i].Target = dns.Fqdn(p.SRV[i].Target)
+			}
+			for _, a := range p.Addresses {
+				ip := net.ParseIP(a)
+				switch {
+				case ip == nil:
+					return nil, fmt.Errorf("%s: route %q has an invalid address %q", file, name, a)
+				case ip.To4() != nil:
+					p.ipv4 = append(p.ipv4, ip.To4())
+				default:
+					p.ipv6 = append(p.ipv6, ip)
+				}
+			}
+			pools[strings.ToUpper(region)] = p
+		}
+		rt.Pools = pools
+		ret[strings.ToLower(strings.TrimSuffix(name, "."))] = rt
+	}
+	return ret, nil
+}
+
+// lookup returns the route of the query name, relative to domain.
+func (rs routes) lookup(name, domain string) (*route, bool) {
+	rel, ok := stripDomain(name, domain)
+	if !ok {
+		return nil, false
+	}
+	rt, ok := rs[strings.ToLower(rel)]
+	return rt, ok
+}
+
+// pool returns the pool of clients located in q.
+func (rt *route) pool(q *Query) *pool {
+	for _, region := range []string{q.Country.ISOCode, q.Continent.Code, defaultPool} {
+		if p, ok := rt.Pools[strings.ToUpper(region)]; region != "" && ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// clientPool returns the pool of rt for the client at ip. Clients that
+// can't be located get the default pool.
+func (h *handle) clientPool(rt *route, ip net.IP) *pool {
+	var q Query
+	if err := h.db.Lookup(ip, &q); err != nil {
+		return rt.Pools[strings.ToUpper(defaultPool)]
+	}
+	return rt.pool(&q)
+}
+
+// route answers the geo-routed query r with the records of the pool of
+// the client, or for A and AAAA queries, its nearest endpoint. Behind a
+// resolver sending EDNS Client Subnet, the client is the subnet.
+func (h *handle) route(rt *route, start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		h.routeAddress(rt, start, w, r)
+		return
+	}
+	m := h.reply(r)
+	m.Authoritative = true
+	ip, ecs := selfIP(w, r)
+	var extra []dns.EDNS0
+	if ecs != nil {
+		extra = append(extra, ecs)
+	}
+	p := h.clientPool(rt, ip)
+	if p == nil {
+		h.write(m, start, w, r, extra...)
+		return
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: rt.TTL}
+	switch q.Qtype {
+	case dns.TypeSRV:
+		for _, t := range p.SRV {
+			m.Answer = append(m.Answer, &dns.SRV{Hdr: hdr, Priority: t.Priority, Weight: t.Weight, Port: t.Port, Target: t.Target})
+		}
+	case dns.TypeHTTPS:
+		if svcb := p.svcb(hdr); svcb != nil {
+			m.Answer = append(m.Answer, &dns.HTTPS{SVCB: *svcb})
+		}
+	case dns.TypeSVCB:
+		if svcb := p.svcb(hdr); svcb != nil {
+			m.Answer = append(m.Answer, svcb)
+		}
+	}
+	rt.sort(m.Answer, ip)
+	h.write(m, start, w, r, extra...)
+}
+
+// sort reorders the answers to client according to the route order.
+func (rt *route) sort(rrs []dns.RR, client net.IP) {
+	swap := func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] }
+	switch rt.Order {
+	case orderShuffle:
+		rand.Shuffle(len(rrs), swap)
+	case orderClientHash:
+		f := fnv.New64a()
+		f.Write(client)
+		rand.New(rand.NewSource(int64(f.Sum64()))).Shuffle(len(rrs), swap)
+	}
+}
+
+// svcb returns the SVCB record of the pool, in service mode with the
+// queried name as target, or nil if the pool has no parameters.
+func (p *pool) svcb(hdr dns.RR_Header) *dns.SVCB {
+	var kv []dns.SVCBKeyValue
+	if len(p.ALPN) > 0 {
+		kv = append(kv, &dns.SVCBAlpn{Alpn: p.ALPN})
+	}
+	if len(p.ipv4) > 0 {
+		kv = append(kv, &dns.SVCBIPv4Hint{Hint: p.ipv4})
+	}
+	if len(p.ipv6) > 0 {
+		kv = append(kv, &dns.SVCBIPv6Hint{Hint: p.ipv6})
+	}
+	if len(kv) == 0 {
+		return nil
+	}
+	return &dns.SVCB{Hdr: hdr, Priority: 1, Target: ".", Value: kv}
+}
+
+// isRouted reports whether queries of type qtype are geo-routed.
+func isRouted(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeSRV, dns.TypeHTTPS, dns.TypeSVCB, dns.TypeA, dns.TypeAAAA:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testRoutes = `{
+  "_api._tcp.service": {
+    "pools": {
+      "US": {"srv": [{"target": "api.us.example.com.", "port": 443}], "alpn": ["h2"]},
+      "EU": {"srv": [{"target": "api.eu.example.com.", "port": 443}], "alpn": ["h3"]},
+      "default": {"srv": [{"target": "api.example.com.", "port": 443}], "alpn": ["http/1.1"]}
+    }
+  }
+}`
+
+// subnetQuery returns a query of type qtype for name under testDomain,
+// with an EDNS Client Subnet option of subnet if not empty.
+func subnetQuery(t *testing.T, name string, qtype uint16, subnet string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(join(name, testDomain)), qtype)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	if subnet != "" {
+		_, n, err := net.ParseCIDR(subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := n.Mask.Size()
+		ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: n.IP}
+		if n.IP.To4() == nil {
+			ecs.Family = 2
+		}
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, ecs)
+	}
+	return m
+}
+
+func TestRouteClientSubnet(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.json")
+	if err := ioutil.WriteFile(file, []byte(testRoutes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandle(t, fixtureDB)
+	var err error
+	if h.routes, err = loadRoutes(file); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, h, nil)
+	for _, tc := range []struct {
+		subnet string
+		target string
+		alpn   string
+	}{
+		// 127.0.0.1 can't be located.
+		{"", "api.example.com.", "http/1.1"},
+		{"8.8.8.0/24", "api.us.example.com.", "h2"},
+		{"2001:db8:2::/48", "api.eu.example.com.", "h3"},
+	} {
+		r := exchange(t, addr, "udp", subnetQuery(t, "_api._tcp.service", dns.TypeSRV, tc.subnet))
+		if len(r.Answer) != 1 {
+			t.Fatalf("SRV with ECS %q: got %v, want 1 answer", tc.subnet, r.Answer)
+		}
+		if srv, ok := r.Answer[0].(*dns.SRV); !ok || srv.Target != tc.target {
+			t.Errorf("SRV with ECS %q: got %s, want the target %s", tc.subnet, r.Answer[0], tc.target)
+		}
+		checkSubnetScope(t, r, tc.subnet)
+
+		r = exchange(t, addr, "udp", subnetQuery(t, "_api._tcp.service", dns.TypeHTTPS, tc.subnet))
+		if len(r.Answer) != 1 {
+			t.Fatalf("HTTPS with ECS %q: got %v, want 1 answer", tc.subnet, r.Answer)
+		}
+		https, ok := r.Answer[0].(*dns.HTTPS)
+		if !ok || len(https.Value) != 1 || https.Value[0].String() != tc.alpn {
+			t.Errorf("HTTPS with ECS %q: got %s, want alpn %s", tc.subnet, r.Answer[0], tc.alpn)
+		}
+		checkSubnetScope(t, r, tc.subnet)
+	}
+}
+
+// checkSubnetScope checks that the ECS option of r is scoped to the
+// prefix of subnet, or that r has none without subnet.
+func checkSubnetScope(t *testing.T, r *dns.Msg, subnet string) {
+	t.Helper()
+	ecs := clientSubnet(r.IsEdns0())
+	if subnet == "" {
+		if ecs != nil {
+			t.Errorf("without ECS: got the ECS option %s", ecs)
+		}
+		return
+	}
+	_, n, _ := net.ParseCIDR(subnet)
+	ones, _ := n.Mask.Size()
+	if ecs == nil || ecs.SourceScope != uint8(ones) {
+		t.Errorf("with ECS %q: got the ECS option %v, want it scoped to /%d", subnet, ecs, ones)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// unknownContinent counts the lookups of IPs without a continent.
+const unknownContinent = "unknown"
+
+// continentStats counts lookups by continent of the IP looked up, per
+// minute over a rolling window.
+type continentStats struct {
+	mu      sync.Mutex
+	minutes []minuteCounts // ring indexed by minute
+}
+
+type minuteCounts struct {
+	minute int64
+	counts map[string]uint64
+}
+
+// newContinentStats returns stats over a window of the given minutes.
+func newContinentStats(minutes int) *continentStats {
+	return &continentStats{minutes: make([]minuteCounts, minutes)}
+}
+
+// add counts a lookup of an IP in the continent with code.
+func (s *continentStats) add(code string) {
+	if code == "" {
+		code = unknownContinent
+	}
+	minute := time.Now().Unix() / 60
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := &s.minutes[minute%int64(len(s.minutes))]
+	if mc.minute != minute || mc.counts == nil {
+		mc.minute, mc.counts = minute, make(map[string]uint64)
+	}
+	mc.counts[code]++
+}
+
+// counts returns the lookups by continent over the last n minutes, up to
+// the window, and the number of minutes counted.
+func (s *continentStats) counts(n int) (map[string]uint64, int) {
+	if n <= 0 || n > len(s.minutes) {
+		n = len(s.minutes)
+	}
+	now := time.Now().Unix() / 60
+	ret := make(map[string]uint64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, mc := range s.minutes {
+		if mc.minute > now-int64(n) {
+			for code, c := range mc.counts {
+				ret[code] += c
+			}
+		}
+	}
+	return ret, n
+}
+
+// countContinent counts the lookup of query, if enabled.
+func (h *handle) countContinent(query *Query) {
+	if h.geoStats != nil {
+		h.geoStats.add(query.Continent.Code)
+	}
+}
+
+// statsMinutes returns the minutes of a stats query name, [N.]stats.<domain>,
+// 0 for the whole window, or false if name is not a stats query.
+func (h *handle) statsMinutes(name string) (int, bool) {
+	suffix := strings.ToLower(dns.Fqdn(join("stats", h.domain)))
+	name = strings.ToLower(name)
+	if name == suffix {
+		return 0, true
+	}
+	if !strings.HasSuffix(name, "."+suffix) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(name, "."+suffix))
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// stats answers a stats query with the lookups by continent over the
+// last minutes, as minutes=N total=N <continent>=N... Only queries with a
+// valid TSIG signature are accepted.
+func (h *handle) stats(minutes int, start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		h.refuse(refuseUnsignedStats, start, w, r)
+		return
+	}
+	counts, n := h.geoStats.counts(minutes)
+	codes := make([]string, 0, len(counts))
+	var total uint64
+	for code, c := range counts {
+		codes = append(codes, code)
+		total += c
+	}
+	sort.Strings(codes)
+	fields := []string{"minutes=" + strconv.Itoa(n), "total=" + strconv.FormatUint(total, 10)}
+	for _, code := range codes {
+		fields = append(fields, code+"="+strconv.FormatUint(counts[code], 10))
+	}
+	h.txt([]string{strings.Join(fields, " ")}, start, w, r)
+}
+
+// statsHandler serves the lookups by continent over the last minutes
+// given in the query parameter, the whole window by default, as JSON.
+func (h *handle) statsHandler(w http.ResponseWriter, r *http.Request) {
+	minutes := 0
+	if v := r.FormValue("minutes"); v != "" {
+		var err error
+		if minutes, err = strconv.Atoi(v); err != nil || minutes <= 0 {
+			http.Error(w, "invalid minutes", http.StatusBadRequest)
+			return
+		}
+	}
+	counts, n := h.geoStats.counts(minutes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"minutes": n, "continents": counts})
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The bulk lookup service, for log enrichment jobs needing many lookups,
+// is defined in geo.proto. Its messages are small enough to be encoded
+// by hand, without generated code.
+
+var grpcLookups = newCounter("freegeoip_dns_grpc_lookups_total", "IPs looked up with the gRPC bulk lookup service.")
+
+// lookupRequest is the LookupRequest message.
+type lookupRequest struct {
+	ip string
+}
+
+// geoRecord is the Record message.
+type geoRecord struct {
+	ip     string
+	fields []field
+	err    string
+}
+
+// geoCodec encodes the messages of the service in the protobuf wire
+// format.
+type geoCodec struct{}
+
+func (geoCodec) Name() string { return "proto" }
+
+func (geoCodec) Marshal(v interface{}) ([]byte, error) {
+	rec, ok := v.(*geoRecord)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	var b []byte
+	b = appendString(b, 1, rec.ip)
+	for _, f := range rec.fields {
+		var fb []byte
+		fb = appendString(fb, 1, f.name)
+		fb = appendString(fb, 2, f.value)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, fb)
+	}
+	if rec.err != "" {
+		b = appendString(b, 3, rec.err)
+	}
+	return b, nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func (geoCodec) Unmarshal(data []byte, v interface{}) error {
+	req, ok := v.(*lookupRequest)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T", v)
+	}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if num == 1 && typ == protowire.BytesType {
+			var s string
+			if s, n = protowire.ConsumeString(data); n < 0 {
+				return protowire.ParseError(n)
+			}
+			req.ip = s
+		} else if n = protowire.ConsumeFieldValue(num, typ, data); n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+var geoServiceDesc = grpc.ServiceDesc{
+	ServiceName: "freegeoip.dns.Geo",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Lookup",
+		Handler:       lookupStream,
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+	Metadata: "geo.proto",
+}
+
+// lookupStream answers each IP received on the stream with its record,
+// in order.
+func lookupStream(srv interface{}, stream grpc.ServerStream) error {
+	h := srv.(*handle)
+	for {
+		var req lookupRequest
+		err := stream.RecvMsg(&req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(h.record(req.ip)); err != nil {
+			return err
+		}
+	}
+}
+
+var errRecordIP = errors.New("invalid IP")
+
+// record returns the geolocation record of the IP s, with the fields of the
+// default profile.
+func (h *handle) record(s string) *geoRecord {
+	rec := &geoRecord{ip: s}
+	ip := parseIP(s)
+	if ip == nil {
+		rec.err = errRecordIP.Error()
+		return rec
+	}
+	query, err := h.lookup(ip)
+	if err != nil {
+		rec.err = err.Error()
+		return rec
+	}
+	fields := append(queryFields(query, ip, h.lang), h.enrich(ip)...)
+	if h.overrides != nil {
+		fields = h.overrides.apply(ip, fields)
+	}
+	rec.fields = selectFields(fields, h.level, false)
+	grpcLookups.inc()
+	return rec
+}
+
+// serveGRPC serves the bulk lookup service on addr.
+func serveGRPC(network, addr string, h *handle) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer(grpc.ForceServerCodec(geoCodec{}))
+	s.RegisterService(&geoServiceDesc, h)
+	return s.Serve(l)
+}
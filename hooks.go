@@ -0,0 +1,66 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mvrilo/freegeoip-dns/events"
+)
+
+// eventQuery returns the event of the query r, received at start. The
+// client is left out in privacy mode.
+func (h *handle) eventQuery(start time.Time, w dns.ResponseWriter, r *dns.Msg) events.Query {
+	q := events.Query{Time: start}
+	if !h.privacy {
+		q.Client = clientIP(w)
+	}
+	if len(r.Question) > 0 {
+		q.Name, q.Type = r.Question[0].Name, r.Question[0].Qtype
+	}
+	return q
+}
+
+// failReason returns the reason of a failure, from the text of its
+// extended error, if any.
+func failReason(extra []dns.EDNS0) string {
+	for _, e := range extra {
+		if e, ok := e.(*dns.EDNS0_EDE); ok {
+			return e.ExtraText
+		}
+	}
+	return ""
+}
+
+// emitDBReload publishes the load of the database file, or the error
+// loading it.
+func emitDBReload(file string, err error) {
+	events.Default.EmitDBReload(events.DBReload{Time: time.Now(), File: file, Err: err})
+}
+
+// emitDBClose publishes the close of the database.
+func emitDBClose() {
+	events.Default.EmitDBClose(events.DBClose{Time: time.Now()})
+}
+
+var (
+	dbEvents    = newCounter("freegeoip_dns_db_events_total", "Database events, by database, ip or asn, and event: open, error or close.", "db", "event")
+	dbLastEvent = newGauge("freegeoip_dns_db_last_event_timestamp_seconds", "Unix time of the last database event, by database and event.", "db", "event")
+)
+
+// Database events.
+const (
+	dbOpen  = "open"
+	dbError = "error"
+	dbClose = "close"
+)
+
+// countDBEvent counts an event of the named database.
+func countDBEvent(db, event string) {
+	dbEvents.inc(db, event)
+	dbLastEvent.set(float64(time.Now().Unix()), db, event)
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fiorix/freegeoip"
+)
+
+// asnQuery is the object used to query the maxmind ASN database.
+type asnQuery struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// hostingASNs is a curated list of autonomous systems operated by cloud,
+// hosting and CDN providers rather than eyeball networks.
+var hostingASNs = []uint{
+	13335,  // Cloudflare
+	14061,  // DigitalOcean
+	14618,  // Amazon AWS
+	16509,  // Amazon AWS
+	8075,   // Microsoft Azure
+	396982, // Google Cloud
+	16276,  // OVH
+	24940,  // Hetzner
+	63949,  // Linode
+	20473,  // Vultr (Choopa)
+	12876,  // Scaleway
+	60781,  // Leaseweb NL
+	28753,  // Leaseweb DE
+	51167,  // Contabo
+	31898,  // Oracle Cloud
+	45102,  // Alibaba Cloud
+	132203, // Tencent Cloud
+	36351,  // IBM Cloud (SoftLayer)
+	20940,  // Akamai
+	54113,  // Fastly
+	19994,  // Rackspace
+	27357,  // Rackspace
+	54825,  // Equinix Metal
+	47583,  // Hostinger
+	26496,  // GoDaddy
+	9009,   // M247
+	40676,  // Psychz
+}
+
+// hostingDetector flags addresses announced by hosting networks.
+type hostingDetector struct {
+	db   *freegeoip.DB
+	asns map[uint]bool
+}
+
+// newHostingDetector returns a detector using the ASN database db, the
+// curated list and the ASNs listed in file, if not empty.
+func newHostingDetector(db *freegeoip.DB, file string) (*hostingDetector, error) {
+	hd := &hostingDetector{db: db, asns: make(map[uint]bool)}
+	for _, asn := range hostingASNs {
+		hd.asns[asn] = true
+	}
+	if file == "" {
+		return hd, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		l := s.Text()
+		if i := strings.IndexByte(l, '#'); i >= 0 {
+			l = l[:i]
+		}
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		l = strings.TrimPrefix(strings.ToUpper(l), "AS")
+		asn, err := strconv.ParseUint(l, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: invalid ASN %q", file, line, s.Text())
+		}
+		hd.asns[uint(asn)] = true
+	}
+	return hd, s.Err()
+}
+
+// fields returns the ASN fields of ip, and whether it belongs to a
+// hosting network. It returns nothing if the ASN of ip is unknown.
+func (hd *hostingDetector) fields(ip net.IP) []field {
+	var q asnQuery
+	if err := hd.db.Lookup(ip, &q); err != nil || q.Number == 0 {
+		return nil
+	}
+	return []field{
+		extraField("asn", "AS"+strconv.FormatUint(uint64(q.Number), 10)),
+		extraField("as_org", q.Organization),
+		extraField("is_hosting", strconv.FormatBool(hd.asns[q.Number])),
+	}
+}
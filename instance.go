@@ -0,0 +1,73 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// chaosNames are the CHAOS class TXT names answered with the instance ID.
+var chaosNames = []string{"id.server.", "hostname.bind."}
+
+// versionNames are the CHAOS class TXT names answered with the version.
+var versionNames = []string{"version.bind.", "version.server."}
+
+// chaos answers CHAOS class queries identifying the instance and its
+// version.
+func (h *handle) chaos(start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	if q.Qtype != dns.TypeTXT {
+		h.fail(dns.RcodeRefused, start, w, r)
+		return
+	}
+	var txt string
+	switch {
+	case h.build != nil && hasName(versionNames, q.Name):
+		txt = h.build.String()
+	case h.instance != "" && hasName(chaosNames, q.Name):
+		txt = h.instance
+	case h.instance == "":
+		h.fail(dns.RcodeRefused, start, w, r)
+		return
+	default:
+		h.nxdomain(nxUnknownName, start, w, r)
+		return
+	}
+	m := h.reply(r)
+	m.Authoritative = true
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: []string{txt},
+	})
+	h.write(m, start, w, r)
+}
+
+// hasName reports whether name is one of names, case insensitively.
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsid returns the NSID option answering a request for it, or nil.
+func (h *handle) nsid(opt *dns.OPT) dns.EDNS0 {
+	if h.instance == "" {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0NSID {
+			return &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(h.instance))}
+		}
+	}
+	return nil
+}
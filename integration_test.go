@@ -0,0 +1,313 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testDomain is the domain of the test servers.
+const testDomain = "geo.test"
+
+// fixtureDB is the synthetic database of testdata, see the README.
+const fixtureDB = "testdata/fixture.mmdb"
+
+// newTestHandle returns a handler of testDomain with the default
+// settings of the server, looking up the database file with mmap.
+func newTestHandle(t testing.TB, file string) *handle {
+	t.Helper()
+	h := &handle{silent: true, lang: "en", info: &dbInfo{}, domain: testDomain, policy: policy{format: positional, negativeTTL: 300}}
+	var err error
+	opts := dbOptions{updateIntvl: time.Hour, maxRetryIntvl: time.Minute, mmap: true}
+	if h.db, err = newGeoDB(file, opts, true, h.info.load, startupFail); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.db.swap(nil, nil) })
+	if h.level, err = parseProfile("full"); err != nil {
+		t.Fatal(err)
+	}
+	if h.version, err = parseVersion("v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.policy.set("unsupported", "nxdomain"); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// startServer serves h over UDP and TCP on an ephemeral port of
+// 127.0.0.1, through the transports of the server, and returns their
+// address. tsigSecret are the TSIG keys accepted, if any.
+func startServer(t testing.TB, h *handle, tsigSecret map[string]string) string {
+	t.Helper()
+	mux := dns.NewServeMux()
+	mux.Handle(dns.Fqdn(h.domain), h)
+	env := &transportEnv{addr: "127.0.0.1:0", net: "udp", tsigSecret: tsigSecret, limits: defaultStreamLimits}
+	udp := &dnsTransport{name: "udp", network: "udp", addr: env.addr, srv: &dns.Server{Net: "udp", TsigSecret: tsigSecret}}
+	if err := udp.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	addr := udp.srv.PacketConn.LocalAddr().String()
+	tcp := newStreamTransport("tcp", "tcp", addr, nil, env, "tcp")
+	if err := tcp.Listen(); err != nil {
+		udp.srv.PacketConn.Close()
+		t.Fatal(err)
+	}
+	serveTransports(t, mux, udp, tcp)
+	return addr
+}
+
+// serveTransports serves mux on the listening transports until the end
+// of the test.
+func serveTransports(t testing.TB, mux dns.Handler, trs ...Transport) {
+	for _, tr := range trs {
+		tr := tr
+		served := make(chan struct{})
+		go func() {
+			tr.Serve(mux)
+			close(served)
+		}()
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			tr.Shutdown(ctx)
+			<-served
+		})
+	}
+}
+
+// startTLSServer serves h over DNS over TLS on an ephemeral port of
+// 127.0.0.1, with a self-signed certificate and the given limits, and
+// returns its address and the TLS config of the clients.
+func startTLSServer(t testing.TB, h *handle, limits streamLimits) (string, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	cfg := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}, MinVersion: tls.VersionTLS12}
+
+	mux := dns.NewServeMux()
+	mux.Handle(dns.Fqdn(h.domain), h)
+	env := &transportEnv{limits: limits}
+	tr := newStreamTransport("tls", "tcp", "127.0.0.1:0", cfg, env, "tcp-tls")
+	if err := tr.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	serveTransports(t, mux, tr)
+	return tr.srv.Listener.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+}
+
+// exchange sends m to addr over network, udp or tcp.
+func exchange(t testing.TB, addr, network string, m *dns.Msg) *dns.Msg {
+	t.Helper()
+	c := &dns.Client{Net: network, Timeout: 2 * time.Second}
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("%s query %s: %v", network, m.Question[0].Name, err)
+	}
+	return r
+}
+
+// txtQuery returns a TXT query for ip under testDomain.
+func txtQuery(ip string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(join(queryLabel(ip), testDomain)), dns.TypeTXT)
+	return m
+}
+
+// answerText returns the strings of the TXT answer of r, joined and
+// unescaped.
+func answerText(t testing.TB, r *dns.Msg) string {
+	t.Helper()
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("got rcode %s with %d answers, want NOERROR with 1", dns.RcodeToString[r.Rcode], len(r.Answer))
+	}
+	txt, ok := r.Answer[0].(*dns.TXT)
+	if !ok {
+		t.Fatalf("got answer %s, want TXT", r.Answer[0])
+	}
+	return unescapeTxt(strings.Join(txt.Txt, ""))
+}
+
+func TestIntegrationTXT(t *testing.T) {
+	addr := startServer(t, newTestHandle(t, fixtureDB), nil)
+	for _, tc := range []struct {
+		ip   string
+		want []string
+	}{
+		{"8.8.8.8", []string{"8.8.8.8", "US", "United States", "Mountain View", "America/Los_Angeles"}},
+		{"81.2.69.142", []string{"GB", "London", "EC1A"}},
+		{"2001:db8:1::1", []string{"CH", "Zürich"}},
+		{"2001:db8:2::1", []string{"DE", "Berlin"}},
+		{"203.0.113.9", []string{"RU", "Москва"}},
+	} {
+		got := answerText(t, exchange(t, addr, "udp", txtQuery(tc.ip)))
+		for _, s := range tc.want {
+			if !strings.Contains(got, s) {
+				t.Errorf("%s: got %q, want it to contain %q", tc.ip, got, s)
+			}
+		}
+	}
+}
+
+func TestIntegrationNXDOMAIN(t *testing.T) {
+	addr := startServer(t, newTestHandle(t, fixtureDB), nil)
+	invalid := new(dns.Msg)
+	invalid.SetQuestion(`bad\ label.`+testDomain+".", dns.TypeTXT)
+	unsupported := new(dns.Msg)
+	unsupported.SetQuestion(dns.Fqdn(join("8.8.8.8", testDomain)), dns.TypeMX)
+	for _, m := range []*dns.Msg{invalid, unsupported} {
+		r := exchange(t, addr, "udp", m)
+		if r.Rcode != dns.RcodeNameError {
+			t.Errorf("%s %s: got rcode %s, want NXDOMAIN", m.Question[0].Name, dns.TypeToString[m.Question[0].Qtype], dns.RcodeToString[r.Rcode])
+		}
+		if len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("%s: got authority %v, want the SOA of %s", m.Question[0].Name, r.Ns, testDomain)
+		}
+	}
+}
+
+// newLargeHandle returns a handler whose answers don't fit in 512 bytes,
+// with a static field of n bytes.
+func newLargeHandle(t testing.TB, n int) *handle {
+	h := newTestHandle(t, fixtureDB)
+	if err := h.policy.set("format", "kv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.policy.set("field.pad", strings.Repeat("x", n)); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestIntegrationTruncation(t *testing.T) {
+	addr := startServer(t, newLargeHandle(t, 600), nil)
+
+	r := exchange(t, addr, "udp", txtQuery("8.8.8.8"))
+	if !r.Truncated || len(r.Answer) != 0 {
+		t.Errorf("without EDNS: got truncated=%v with %d answers, want a truncated answer without records", r.Truncated, len(r.Answer))
+	}
+
+	m := txtQuery("8.8.8.8")
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	r = exchange(t, addr, "udp", m)
+	if r.Truncated {
+		t.Error("with an EDNS buffer of 4096 bytes: got a truncated answer")
+	}
+	if got := answerText(t, r); !strings.Contains(got, "pad=") {
+		t.Errorf("with EDNS: got %q, want the pad field", got)
+	}
+}
+
+func TestIntegrationTCPFallback(t *testing.T) {
+	addr := startServer(t, newLargeHandle(t, 600), nil)
+	m := txtQuery("8.8.8.8")
+	if r := exchange(t, addr, "udp", m); !r.Truncated {
+		t.Fatal("got an answer over UDP, want it truncated")
+	}
+	r := exchange(t, addr, "tcp", m)
+	if r.Truncated {
+		t.Error("got a truncated answer over TCP")
+	}
+	got := answerText(t, r)
+	for _, s := range []string{"Mountain View", "pad=" + strings.Repeat("x", 600)} {
+		if !strings.Contains(got, s) {
+			t.Errorf("got %q over TCP, want it to contain %q", got, s)
+		}
+	}
+}
+
+// writeTestDB writes the database of the networks in csv to file, as
+// build-db does.
+func writeTestDB(t testing.TB, file, csv string) {
+	t.Helper()
+	rows, err := readNetworks(strings.NewReader(csv), "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw := newMMDBWriter("freegeoip-dns-Test", "Test database", []string{"en"})
+	for _, row := range rows {
+		mw.insert(row.network, row.record)
+	}
+	var b bytes.Buffer
+	if _, err := mw.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeDB(file, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIntegrationReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "geo.mmdb")
+	b, err := ioutil.ReadFile(fixtureDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandle(t, file)
+	if h.notifyACL, err = newACL([]string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, h, nil)
+	if got := answerText(t, exchange(t, addr, "udp", txtQuery("8.8.8.8"))); !strings.Contains(got, "Mountain View") {
+		t.Fatalf("before the reload: got %q, want Mountain View", got)
+	}
+
+	writeTestDB(t, file, "network,country_code,country_name,city\n8.8.8.0/24,CA,Canada,Toronto\n")
+	notify := new(dns.Msg)
+	notify.SetNotify(testDomain + ".")
+	if r := exchange(t, addr, "udp", notify); r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("NOTIFY: got rcode %s, want NOERROR", dns.RcodeToString[r.Rcode])
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := answerText(t, exchange(t, addr, "udp", txtQuery("8.8.8.8")))
+		if strings.Contains(got, "Toronto") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after the reload: got %q, want Toronto", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
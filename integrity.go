@@ -0,0 +1,124 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+)
+
+var dbIntegrityChecks = newCounter("freegeoip_dns_db_integrity_checks_total", "Background integrity checks of the loaded database, by result: ok or failed.", "result")
+
+// anchor is an IP whose country is known, looked up by the integrity
+// checks.
+type anchor struct {
+	ip      net.IP
+	country string
+}
+
+// integrityChecker samples the loaded database in the background, so that
+// corruption is found before clients get SERVFAIL answers.
+type integrityChecker struct {
+	db      *geoDB
+	info    *dbInfo
+	samples int
+	anchors []anchor
+}
+
+// run checks the database, run every -integrity-interval, and when the
+// check fails, verifies the whole file and downloads or reopens it again
+// if corrupt.
+func (c *integrityChecker) run() error {
+	if !c.db.ready() {
+		return nil
+	}
+	err := c.check()
+	if err == nil {
+		dbIntegrityChecks.inc("ok")
+		return nil
+	}
+	dbIntegrityChecks.inc("failed")
+	log.Println("WARNING database integrity check failed, verifying the database:", err)
+	result, err := c.db.repair(c.info)
+	dbRepairs.inc(result)
+	if err != nil {
+		return fmt.Errorf("database repair: %v", err)
+	}
+	return nil
+}
+
+// check checks the metadata of the loaded database, then looks up the
+// anchors, which must be in their country, and samples random addresses,
+// which must be decoded without error.
+func (c *integrityChecker) check() error {
+	meta := c.info.get()
+	switch {
+	case meta == nil:
+		return errors.New("no metadata")
+	case meta.DatabaseType == "":
+		return errors.New("metadata without database type")
+	case meta.NodeCount == 0:
+		return errors.New("metadata without nodes")
+	case meta.IPVersion != 4 && meta.IPVersion != 6:
+		return fmt.Errorf("metadata of IP version %d", meta.IPVersion)
+	}
+	for _, a := range c.anchors {
+		var query Query
+		if err := c.db.lookup(a.ip, &query); err != nil {
+			return fmt.Errorf("anchor %s: %v", a.ip, err)
+		}
+		if !strings.EqualFold(query.Country.ISOCode, a.country) {
+			return fmt.Errorf("anchor %s: got country %q, want %q", a.ip, query.Country.ISOCode, a.country)
+		}
+	}
+	for i := 0; i < c.samples; i++ {
+		ip := make(net.IP, net.IPv4len)
+		rand.Read(ip)
+		if meta.IPVersion == 6 && i%2 == 1 {
+			ip = make(net.IP, net.IPv6len)
+			rand.Read(ip)
+		}
+		var query Query
+		if err := c.db.lookup(ip, &query); err != nil {
+			return fmt.Errorf("sample %s: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+// readAnchors returns the anchors of file, an IP and its country code
+// per line. Blank lines and lines starting with # are skipped.
+func readAnchors(file string) ([]anchor, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var anchors []anchor
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := strings.Fields(line)
+		var ip net.IP
+		if len(p) == 2 {
+			ip = parseIP(p[0])
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: invalid anchor %q, want ip country_code", file, n, line)
+		}
+		anchors = append(anchors, anchor{ip: ip, country: p[1]})
+	}
+	return anchors, s.Err()
+}
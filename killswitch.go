@@ -0,0 +1,137 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Subsystems that can be switched off at runtime.
+const (
+	switchResolve    = "resolve"
+	switchGeoRouting = "geo-routing"
+	switchEnrichment = "enrichment"
+	switchCache      = "cache"
+)
+
+// switchDocs documents the subsystems that can be switched off, by name,
+// so that -disable-features and the admin API can check the names.
+var switchDocs = map[string]string{
+	switchResolve:    "Hostname resolution: hostname queries are answered SERVFAIL, IP queries still answered",
+	switchGeoRouting: "Answers of -geo-routes: the routed names are answered as if not routed",
+	switchEnrichment: "Threat, Tor, cloud and hosting fields of -threat-feed, -tor-exits, -cloud-ranges and -asn-db",
+	switchCache:      "Lookup cache of -cache-size: lookups go to the database",
+}
+
+var featureEnabled = newGauge("freegeoip_dns_feature_enabled", "Whether the subsystem is switched on, by feature: resolve, geo-routing, enrichment or cache.", "feature")
+
+// switches are the kill switches of the subsystems, all on at startup
+// but the ones of -disable-features, so that operators can turn off one
+// that misbehaves without restarting or redeploying.
+var switches = newKillSwitches()
+
+type killSwitches struct {
+	off map[string]*int32 // fixed set of switchDocs, 1 if off
+}
+
+func newKillSwitches() *killSwitches {
+	k := &killSwitches{off: make(map[string]*int32, len(switchDocs))}
+	for name := range switchDocs {
+		k.off[name] = new(int32)
+		featureEnabled.set(1, name)
+	}
+	return k
+}
+
+// on reports whether the named subsystem is switched on.
+func (k *killSwitches) on(name string) bool {
+	return atomic.LoadInt32(k.off[name]) == 0
+}
+
+// set switches the named subsystem on or off.
+func (k *killSwitches) set(name string, on bool) error {
+	off, ok := k.off[name]
+	if !ok {
+		return fmt.Errorf("unknown feature %q, want one of %s", name, strings.Join(switchNames(), ", "))
+	}
+	v, state := int32(1), "off"
+	if on {
+		v, state = 0, "on"
+	}
+	if atomic.SwapInt32(off, v) != v {
+		log.Printf("feature %s switched %s", name, state)
+	}
+	featureEnabled.set(float64(1-v), name)
+	return nil
+}
+
+// disable switches off the comma separated subsystems in names.
+func (k *killSwitches) disable(names string) error {
+	for _, name := range strings.Split(names, ",") {
+		if name == "" {
+			continue
+		}
+		if err := k.set(name, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// states returns whether each subsystem is switched on, by name.
+func (k *killSwitches) states() map[string]bool {
+	ret := make(map[string]bool, len(k.off))
+	for name := range k.off {
+		ret[name] = k.on(name)
+	}
+	return ret
+}
+
+// switchNames returns the names of the subsystems, sorted.
+func switchNames() []string {
+	names := make([]string, 0, len(switchDocs))
+	for name := range switchDocs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// featuresHandler serves the state of the kill switches as JSON, and on
+// POST, switches the subsystem of the name parameter on or off with the
+// enabled one, e.g. name=resolve&enabled=false. POST requests must
+// carry the -admin-key as a bearer token.
+func (h *handle) featuresHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if !bearerAuthorized(r, h.adminKey) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		on, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "invalid enabled", http.StatusBadRequest)
+			return
+		}
+		if err := switches.set(r.FormValue("name"), on); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(switches.states())
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// inflight is the number of queries being answered. Each query runs in
+// its own handler goroutine, so it is also the number of active handlers.
+var inflight int64
+
+func init() {
+	newGaugeFunc("freegeoip_dns_goroutines", "Number of goroutines.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	newGaugeFunc("freegeoip_dns_inflight_queries", "Queries being answered, one handler goroutine each.", func() float64 {
+		return float64(atomic.LoadInt64(&inflight))
+	})
+}
+
+// leakAlarm logs a warning when the number of goroutines or in-flight
+// queries stays above its threshold for a whole period, which usually
+// means handlers are blocked behind slow resolvers. Zero thresholds are
+// not checked.
+type leakAlarm struct {
+	goroutines int
+	inflight   int
+	period     time.Duration
+
+	gSince, qSince time.Time // when the thresholds started being exceeded
+}
+
+// check checks the thresholds, run every tenth of the period.
+func (a *leakAlarm) check() error {
+	now := time.Now()
+	g := runtime.NumGoroutine()
+	q := int(atomic.LoadInt64(&inflight))
+	a.gSince = a.exceeded("goroutines", g, a.goroutines, a.gSince, now)
+	a.qSince = a.exceeded("in-flight queries", q, a.inflight, a.qSince, now)
+	return nil
+}
+
+// exceeded returns when n started exceeding max, logging a warning when
+// it has for a whole period and restarting the period.
+func (a *leakAlarm) exceeded(what string, n, max int, since, now time.Time) time.Time {
+	if max <= 0 || n <= max {
+		return time.Time{}
+	}
+	if since.IsZero() {
+		return now
+	}
+	if now.Sub(since) < a.period {
+		return since
+	}
+	log.Printf("WARNING %d %s, above %d for %s", n, what, max, now.Sub(since).Round(time.Second))
+	return now
+}
@@ -0,0 +1,38 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenNet returns the network of a listener on addr, base being "udp"
+// or "tcp". It is network if set, one of base, base4 or base6. Otherwise
+// it is inferred from addr: IPv4 only for IPv4 hosts, IPv6 only for IPv6
+// hosts but "::", and dual-stack, base, for host names and empty hosts.
+func listenNet(base, network, addr string) (string, error) {
+	if network != "" {
+		if network != base && network != base+"4" && network != base+"6" {
+			return "", fmt.Errorf("invalid network %q for %s, want %s, %s4 or %s6", network, addr, base, base, base)
+		}
+		return network, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return base, nil
+	case ip.To4() != nil:
+		return base + "4", nil
+	case ip.Equal(net.IPv6unspecified):
+		return base, nil
+	}
+	return base + "6", nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+
+	"github.com/miekg/dns"
+)
+
+// isLookupType reports whether queries of qtype are answered with the
+// location of the queried IP: as fields in TXT records, or as LOC ones.
+func isLookupType(qtype uint16) bool {
+	return qtype == dns.TypeTXT || qtype == dns.TypeLOC
+}
+
+// LOC precisions, as written by locSize, of the records without an
+// accuracy radius: the defaults of RFC 1876, 10km horizontally and 10m
+// vertically. The size of the location is 1m.
+const (
+	locSizeDefault  = 0x12
+	locHorizDefault = 0x16
+	locVertDefault  = 0x13
+)
+
+// locReply returns the reply to the LOC query r with the records of the
+// queried IPs: a LOC record for each with coordinates, none for the
+// others.
+func (h *handle) locReply(queries []*Query, r *dns.Msg) *dns.Msg {
+	m := h.reply(r)
+	for _, query := range queries {
+		if rr := locRecord(r.Question[0].Name, h.policy.ttl, query); rr != nil {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	return m
+}
+
+// locRecord returns the LOC record (RFC 1876) of the coordinates of
+// query, at ground level, with its accuracy radius as horizontal
+// precision, or nil if query has no coordinates.
+func locRecord(name string, ttl uint32, query *Query) *dns.LOC {
+	l := query.Location
+	if l.Latitude == 0 && l.Longitude == 0 {
+		return nil
+	}
+	rr := &dns.LOC{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeLOC, Class: dns.ClassINET, Ttl: ttl},
+		Size:      locSizeDefault,
+		HorizPre:  locHorizDefault,
+		VertPre:   locVertDefault,
+		Latitude:  locAngle(l.Latitude),
+		Longitude: locAngle(l.Longitude),
+		Altitude:  dns.LOC_ALTITUDEBASE * 100, // 0m, in cm above 100km below
+	}
+	if l.AccuracyRadius > 0 {
+		rr.HorizPre = locSize(uint64(l.AccuracyRadius) * 1000 * 100)
+	}
+	return rr
+}
+
+// locAngle returns the LOC encoding of an angle in degrees: thousandths
+// of arc seconds from the equator or the prime meridian, offset by 2^31.
+func locAngle(deg float64) uint32 {
+	return uint32(int64(dns.LOC_EQUATOR) + int64(math.Round(deg*dns.LOC_DEGREES)))
+}
+
+// locSize returns the LOC encoding of a size in centimeters, as a
+// mantissa and a power of ten, rounded up to a precision of at least cm.
+func locSize(cm uint64) uint8 {
+	var exp uint8
+	for cm > 9 && exp < 9 {
+		cm = (cm + 9) / 10
+		exp++
+	}
+	if cm > 9 {
+		cm = 9
+	}
+	return uint8(cm)<<4 | exp
+}
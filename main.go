@@ -6,20 +6,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"math/rand"
 	"net"
-	"net/url"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/fiorix/freegeoip"
 	"github.com/miekg/dns"
+	"github.com/mvrilo/freegeoip-dns/events"
 )
 
 const (
@@ -27,30 +33,6 @@ const (
 	maxmindFile = "http://geolite.maxmind.com/download/geoip/database/GeoLite2-City.mmdb.gz"
 )
 
-// maxmindQuery is the object used to query the maxmind database.
-type Query struct {
-	Country struct {
-		ISOCode string            `maxminddb:"iso_code"`
-		Names   map[string]string `maxminddb:"names"`
-	} `maxminddb:"country"`
-	Region []struct {
-		ISOCode string            `maxminddb:"iso_code"`
-		Names   map[string]string `maxminddb:"names"`
-	} `maxminddb:"subdivisions"`
-	City struct {
-		Names map[string]string `maxminddb:"names"`
-	} `maxminddb:"city"`
-	Location struct {
-		Latitude  float64 `maxminddb:"latitude"`
-		Longitude float64 `maxminddb:"longitude"`
-		MetroCode uint    `maxminddb:"metro_code"`
-		TimeZone  string  `maxminddb:"time_zone"`
-	} `maxminddb:"location"`
-	Postal struct {
-		Code string `maxminddb:"code"`
-	} `maxminddb:"postal"`
-}
-
 func roundFloat(val float64, roundOn float64, places int) (newVal float64) {
 	var round float64
 	pow := math.Pow(10, float64(places))
@@ -64,48 +46,200 @@ func roundFloat(val float64, roundOn float64, places int) (newVal float64) {
 	return round / pow
 }
 
-func response(query *Query, ip net.IP, lang string) string {
-	ret := []string{
-		ip.String(),
-		query.Country.ISOCode,
-		query.Country.Names[lang],
-	}
+type handle struct {
+	db     *geoDB
+	silent bool
+	lang   string
+	domain string
+	// wildcard handlers serve any subdomain of domain, given as
+	// -domain *.<domain>.
+	wildcard bool
+	limiter  *rateLimiter
+	throttle *throttle
+	threats  *threatFeeds
+	tor      *torExits
+	cloud    *cloudRanges
+	hosting  *hostingDetector
+	info     *dbInfo
+	level    int
+	version  *responseVersion
+
+	overrides *overrides
+	notifyACL *acl
+	instance  string
+	debug     bool
+	omitEmpty bool
+	// privacy mode keeps client addresses out of logs and telemetry.
+	privacy bool
+	cluster *cluster
+	// dbKey authenticates downloads of the loaded database.
+	dbKey string
+	// adminKey authenticates the admin endpoints changing the state of
+	// the server.
+	adminKey string
+	// paddingBlock is the block size answers over encrypted transports
+	// are padded to, 0 to disable padding.
+	paddingBlock int
+	// geoStats counts lookups by continent, if enabled.
+	geoStats *continentStats
+	// prefixStats counts queries by source prefix, if enabled.
+	prefixStats *prefixStats
+	// cache caches the records of the queried IPs, if enabled.
+	cache *lookupCache
+	// tunnelEndpoints looks up IPv6 addresses embedding an IPv4 address
+	// as is.
+	tunnelEndpoints bool
+	// fast answers literal IP queries with the default options, nil
+	// if the handler has settings the fast lane doesn't support.
+	fast *fastLane
+
+	resolveTimeout time.Duration
+	maxDBAge       time.Duration
+	cnameField     bool
+	routes         routes
+	uriTemplate    string
+	hmacKey        []byte
+	fallback       *fallback
+	mirror         *mirror
+	script         *script
+	plugins        plugins
+	formatter      *plugin
+	faults         *faults
+	recorder       *recorder
+	build          *buildInfo
+	policy         policy
+	dual           bool
+	candidates     int
+	debugResolver  bool
+}
 
-	if len(query.Region) > 0 {
-		ret = append(ret, []string{
-			query.Region[0].ISOCode,
-			query.Region[0].Names[lang],
-		}...)
+// enrich returns the extra fields appended to the response for ip.
+func (h *handle) enrich(ip net.IP) []field {
+	if !switches.on(switchEnrichment) {
+		return nil
+	}
+	var fields []field
+	if h.threats != nil {
+		if t := h.threats.lookup(ip); t != "" {
+			fields = append(fields, extraField("threat", t))
+		}
+	}
+	if h.tor != nil {
+		fields = append(fields, extraField("is_tor_exit", strconv.FormatBool(h.tor.contains(ip))))
+	}
+	if h.cloud != nil {
+		if c := h.cloud.lookup(ip); c != "" {
+			fields = append(fields, extraField("cloud", c))
+		}
+	}
+	if h.hosting != nil {
+		fields = append(fields, h.hosting.fields(ip)...)
 	}
+	return fields
+}
 
-	ret = append(ret, []string{
-		query.City.Names[lang],
-		query.Postal.Code,
-		query.Location.TimeZone,
-		strconv.FormatFloat(query.Location.Latitude, 'f', 2, 64),
-		strconv.FormatFloat(query.Location.Longitude, 'f', 2, 64),
-		strconv.Itoa(int(query.Location.MetroCode)),
-	}...)
+// queryOptions are the per query settings given as leading labels, e.g.
+// v2.minimal.8.8.8.8.<domain>.
+type queryOptions struct {
+	level   int
+	version *responseVersion
+	debug   bool
+	// omitEmpty leaves empty fields out, writing the others as
+	// name=value since their position is lost.
+	omitEmpty bool
+	// format is the encoding of the response.
+	format Formatter
+	// dual answers for hostnames with an IPv4 and an IPv6 address,
+	// labeled ipv4= and ipv6=.
+	dual bool
+}
 
-	return strings.Join(ret, "    ")
+// parseLabel sets the option named by label, if any.
+func (opts *queryOptions) parseLabel(label string) bool {
+	label = strings.ToLower(label)
+	if level, ok := profiles[label]; ok {
+		opts.level = level
+		return true
+	}
+	if v, ok := versions[label]; ok {
+		opts.version = v
+		return true
+	}
+	if f, ok := formatters[label]; ok {
+		opts.format = f
+		return true
+	}
+	switch label {
+	case "debug":
+		opts.debug = true
+		return true
+	case "omitempty":
+		opts.omitEmpty = true
+		return true
+	case "dual":
+		opts.dual = true
+		return true
+	}
+	return false
 }
 
-// openDB opens and returns the IP database.
-func openDB(dsn string, updateIntvl, maxRetryIntvl time.Duration) (db *freegeoip.DB, err error) {
-	u, err := url.Parse(dsn)
-	if err != nil || len(u.Scheme) == 0 {
-		db, err = freegeoip.Open(dsn)
-	} else {
-		db, err = freegeoip.OpenURL(dsn, updateIntvl, maxRetryIntvl)
+// queryDomain returns the domain the query name, stripped of options, is
+// under. For wildcard handlers this is the subdomain of h.domain right
+// above the queried IP or hostname, which is also returned.
+func (h *handle) queryDomain(name string) (domain, sub string) {
+	if !h.wildcard {
+		return h.domain, ""
+	}
+	rel, ok := stripDomain(name, h.domain)
+	i := strings.LastIndexByte(rel, '.')
+	if !ok || i < 0 {
+		return h.domain, ""
 	}
-	return
+	return rel[i+1:] + "." + h.domain, strings.ToLower(rel[i+1:])
 }
 
-type handle struct {
-	db     *freegeoip.DB
-	silent bool
-	lang   string
-	domain string
+// options returns the options of the query name and the name stripped of
+// their labels. Settings not given default to those of the handler.
+func (h *handle) options(name string) (queryOptions, string) {
+	opts := queryOptions{level: h.level, version: h.version, debug: h.debug, omitEmpty: h.omitEmpty, dual: h.dual, format: h.policy.format}
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 || !opts.parseLabel(name[:i]) {
+			return opts, name
+		}
+		name = name[i+1:]
+	}
+}
+
+// denyReason is the reason a query was refused by policy. The values are
+// stable: they are reported in refusal log lines, in the text of the
+// Prohibited extended error and in query error events, so that clients
+// and operators can tell policy denials from failures.
+type denyReason string
+
+// Deny reasons.
+const (
+	refuseRateLimit      denyReason = "ratelimit"          // -ratelimit
+	refuseOverload       denyReason = "overload"           // -max-qps
+	refuseUnsignedUpdate denyReason = "unsigned-update"    // UPDATE without TSIG
+	refuseNotify         denyReason = "notify-not-allowed" // NOTIFY outside -notify-allow
+	refuseClusterBan     denyReason = "cluster-ban"        // rate limited by a peer
+	refusePlugin         denyReason = "plugin"             // plugin access policy
+	refuseUnsignedAdmin  denyReason = "unsigned-admin"     // admin command without TSIG
+	refuseUnsignedStats  denyReason = "unsigned-stats"     // stats query without TSIG
+)
+
+var deniedQueries = newCounter("freegeoip_dns_denied_queries_total", "Queries refused by policy, by reason.", "reason")
+
+// clientIP returns the address of the client that sent the query.
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
 }
 
 func (h *handle) log(err int, start time.Time, w dns.ResponseWriter, r *dns.Msg) {
@@ -116,118 +250,1158 @@ func (h *handle) log(err int, start time.Time, w dns.ResponseWriter, r *dns.Msg)
 	q := r.Question[0]
 	info := fmt.Sprintf("Question: Type=%s Class=%s Name=%s", dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass], q.Name)
 
-	var code string
-	switch err {
-	case dns.RcodeServerFailure:
-		code = "SERVFAIL"
-	case dns.RcodeNameError:
-		code = "NXDOMAIN"
-	default:
-		code = "RESOLVED"
+	code := "RESOLVED"
+	if err != dns.RcodeSuccess {
+		code = dns.RcodeToString[err]
 	}
 
 	log.Printf("%s (%s) %s\n", info, code, time.Now().Sub(start))
 }
 
-func (h *handle) fail(err int, start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+// reply returns a new reply to r.
+func (h *handle) reply(r *dns.Msg) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.Rcode = err
+	return m
+}
+
+// write adds the EDNS and TSIG records requested by r to m, and the SOA
+// of the domain to negative answers, sends it and logs it. The EDNS
+// options in extra, e.g. extended errors, are added if r supports EDNS.
+// All replies are sent through write, except the combined answers to
+// multi-question queries.
+func (h *handle) write(m *dns.Msg, start time.Time, w dns.ResponseWriter, r *dns.Msg, extra ...dns.EDNS0) {
+	h.send(m, start, w, r, nil, extra...)
+}
+
+// location is the IP located by a geolocation answer, and its country.
+type location struct {
+	ip      net.IP
+	country string
+}
+
+// send is write for geolocation answers, whose location, if not nil, is
+// published with the answer event.
+func (h *handle) send(m *dns.Msg, start time.Time, w dns.ResponseWriter, r *dns.Msg, loc *location, extra ...dns.EDNS0) {
+	h.addSOA(m, r)
+	h.finish(m, w, r, extra...)
+	h.account(m, start, w, r, loc)
+}
+
+// account counts and logs the answer m to r, and publishes it.
+func (h *handle) account(m *dns.Msg, start time.Time, w dns.ResponseWriter, r *dns.Msg, loc *location) {
+	queriesTotal.inc(dns.RcodeToString[m.Rcode])
+	queryDuration.observe(time.Since(start).Seconds())
+	ev := events.Answer{Query: h.eventQuery(start, w, r), Rcode: m.Rcode, Duration: time.Since(start)}
+	if loc != nil {
+		ev.IP, ev.Country = loc.ip, loc.country
+	}
+	events.Default.EmitAnswer(ev)
+	h.log(m.Rcode, start, w, r)
+}
+
+// finish adds the EDNS and TSIG records requested by r to m, padding it
+// or truncating it to the UDP size of r, and sends it.
+func (h *handle) finish(m *dns.Msg, w dns.ResponseWriter, r *dns.Msg, extra ...dns.EDNS0) {
+	if opt := r.IsEdns0(); opt != nil {
+		o := h.replyOPT(opt, extra)
+		m.Extra = append(m.Extra, o)
+		h.pad(m, o, w, r)
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncate(udpSize(r))
+	}
+	if t := r.IsTsig(); t != nil && w.TsigStatus() == nil {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
 	w.WriteMsg(m)
-	h.log(err, start, w, r)
+}
+
+// replyOPT returns the OPT record of replies to queries with opt. An ECS
+// option of the query is echoed with a scope of 0 unless extra has one:
+// the answers don't depend on the client but for self queries.
+func (h *handle) replyOPT(opt *dns.OPT, extra []dns.EDNS0) *dns.OPT {
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	o.SetUDPSize(dns.DefaultMsgSize)
+	o.SetDo(opt.Do())
+	if nsid := h.nsid(opt); nsid != nil {
+		o.Option = append(o.Option, nsid)
+	}
+	if ecs := clientSubnet(opt); ecs != nil && !hasSubnet(extra) {
+		o.Option = append(o.Option, ecsReply(ecs, 0))
+	}
+	o.Option = append(o.Option, extra...)
+	return o
+}
+
+// udpSize returns the max size of UDP replies to r: the size advertised
+// in its EDNS record, up to ours, or 512 bytes without EDNS.
+func udpSize(r *dns.Msg) int {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	size := int(opt.UDPSize())
+	if size < dns.MinMsgSize {
+		return dns.MinMsgSize
+	}
+	if size > dns.DefaultMsgSize {
+		return dns.DefaultMsgSize
+	}
+	return size
+}
+
+func (h *handle) fail(err int, start time.Time, w dns.ResponseWriter, r *dns.Msg, extra ...dns.EDNS0) {
+	events.Default.EmitError(events.Error{Query: h.eventQuery(start, w, r), Rcode: err, Reason: failReason(extra)})
+	h.failed(err, start, w, r, extra...)
+}
+
+// failed answers r with the error rcode err.
+func (h *handle) failed(err int, start time.Time, w dns.ResponseWriter, r *dns.Msg, extra ...dns.EDNS0) {
+	m := h.reply(r)
+	m.Rcode = err
+	h.write(m, start, w, r, extra...)
+}
+
+// refuse answers REFUSED and writes a refusal line to the log. Refusal
+// lines are written even in silent mode and have the stable format
+//
+//	REFUSED client=<ip> reason=<reason> time=<RFC3339 timestamp>
+//
+// so that tools like fail2ban can match on them.
+func (h *handle) refuse(reason denyReason, start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	client := "-"
+	if !h.privacy {
+		client = clientIP(w).String()
+	}
+	log.Printf("REFUSED client=%s reason=%s time=%s\n", client, reason, start.UTC().Format(time.RFC3339))
+	deniedQueries.inc(string(reason))
+	events.Default.EmitError(events.Error{Query: h.eventQuery(start, w, r), Rcode: dns.RcodeRefused, Reason: string(reason), Denied: true})
+	h.failed(dns.RcodeRefused, start, w, r, ede(dns.ExtendedErrorCodeProhibited, string(reason)))
+}
+
+// txt answers r with a single TXT record holding the strings txts.
+func (h *handle) txt(txts []string, start time.Time, w dns.ResponseWriter, r *dns.Msg, extra ...dns.EDNS0) {
+	h.write(h.txtReply(txts, r), start, w, r, extra...)
+}
+
+// txtReply returns the reply to r with a single TXT record holding the
+// strings txts. Strings longer than the 255 bytes allowed in TXT records
+// are split.
+func (h *handle) txtReply(txts []string, r *dns.Msg) *dns.Msg {
+	q := r.Question[0]
+	m := h.reply(r)
+
+	txt := new(dns.TXT)
+	txt.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: h.policy.ttl}
+	for _, s := range txts {
+		txt.Txt = append(txt.Txt, txtStrings(s)...)
+	}
+
+	m.Answer = append(m.Answer, txt)
+	return m
+}
+
+// maxTxtLen is the max length of a TXT string.
+const maxTxtLen = 255
+
+// txtStrings splits s in TXT strings of up to 255 bytes, escaping the
+// backslashes the dns package would take for escape sequences.
+func txtStrings(s string) []string {
+	var ret []string
+	for {
+		n := len(s)
+		if n > maxTxtLen {
+			n = maxTxtLen
+		}
+		ret = append(ret, strings.Replace(s[:n], `\`, `\\`, -1))
+		if s = s[n:]; s == "" {
+			return ret
+		}
+	}
 }
 
 func (h *handle) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	start := time.Now()
+	atomic.AddInt64(&inflight, 1)
+	defer atomic.AddInt64(&inflight, -1)
+	if h.recorder != nil {
+		h.recorder.record(start, r)
+	}
+	events.Default.EmitQuery(h.eventQuery(start, w, r))
+	if h.prefixStats != nil {
+		h.prefixStats.add(clientIP(w))
+	}
+	client := clientIP(w).String()
+	if h.cluster != nil {
+		if !h.privacy {
+			h.cluster.top.add(client)
+		}
+		if h.cluster.peerBans.banned(client) {
+			h.refuse(refuseClusterBan, start, w, r)
+			return
+		}
+	}
+	if h.limiter != nil && !h.limiter.allow(client) {
+		if h.cluster != nil && !h.privacy {
+			h.cluster.refused(client)
+		}
+		h.refuse(refuseRateLimit, start, w, r)
+		return
+	}
+	if h.throttle != nil && !h.throttle.wait() {
+		h.refuse(refuseOverload, start, w, r)
+		return
+	}
+	if h.plugins != nil {
+		for _, q := range r.Question {
+			if !h.plugins.allowed(clientIP(w), q.Name, q.Qtype) {
+				h.refuse(refusePlugin, start, w, r)
+				return
+			}
+		}
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		// Only EDNS version 0 is supported (RFC 6891 6.1.3).
+		h.fail(dns.RcodeBadVers, start, w, r)
+		return
+	}
+	if h.mirror != nil && h.mirror.sample(r) && !h.selfQuery(r) {
+		w = h.mirror.writer(w, r)
+	}
+	switch r.Opcode {
+	case dns.OpcodeUpdate:
+		h.update(start, w, r)
+		return
+	case dns.OpcodeNotify:
+		h.notify(start, w, r)
+		return
+	}
+	// Messages without a question never get here: acceptMsg rejects them
+	// and dns.ServeMux, which all transports dispatch to, refuses them.
+	if len(r.Question) > 1 {
+		h.questions(start, w, r)
+		return
+	}
+	if h.fast == nil || !h.fastAnswer(start, w, r) {
+		h.question(start, w, r)
+	}
+}
+
+// question answers a query with a single question.
+func (h *handle) question(start time.Time, w dns.ResponseWriter, r *dns.Msg) {
 	q := r.Question[0]
-	if q.Qtype == dns.TypeTXT && q.Qclass == dns.ClassINET {
-		ip := queryIP(q, h.domain)
-		if ip == nil {
-			h.fail(dns.RcodeNameError, start, w, r)
+	if q.Qclass == dns.ClassCHAOS {
+		h.chaos(start, w, r)
+		return
+	}
+	if h.routes != nil && q.Qclass == dns.ClassINET && isRouted(q.Qtype) && switches.on(switchGeoRouting) {
+		if rt, ok := h.routes.lookup(q.Name, h.domain); ok {
+			h.route(rt, start, w, r)
+			return
+		}
+	}
+	if q.Qtype == dns.TypeURI && q.Qclass == dns.ClassINET && h.uriTemplate != "" {
+		h.uri(start, w, r)
+		return
+	}
+	if isLookupType(q.Qtype) && q.Qclass == dns.ClassINET {
+		if q.Qtype == dns.TypeTXT {
+			if cmd, ok := h.adminCommand(q.Name); ok {
+				h.admin(cmd, start, w, r)
+				return
+			}
+			if h.geoStats != nil {
+				if minutes, ok := h.statsMinutes(q.Name); ok {
+					h.stats(minutes, start, w, r)
+					return
+				}
+			}
+			if strings.EqualFold(q.Name, dns.Fqdn(join("dbmeta", h.domain))) {
+				meta := h.info.get()
+				if meta == nil {
+					h.fail(dns.RcodeServerFailure, start, w, r, ede(dns.ExtendedErrorCodeNotReady, "database not loaded"))
+					return
+				}
+				h.txt([]string{meta.String()}, start, w, r)
+				return
+			}
+		}
+		if h.domain != "" && strings.EqualFold(q.Name, dns.Fqdn(h.domain)) {
+			if q.Qtype == dns.TypeTXT {
+				h.txt([]string{h.capabilities()}, start, w, r)
+			} else {
+				h.write(h.reply(r), start, w, r)
+			}
 			return
 		}
 
-		var query Query
-		if err := h.db.Lookup(ip, &query); err != nil {
-			h.fail(dns.RcodeServerFailure, start, w, r)
+		opts, name := h.options(q.Name)
+		resolveStart := time.Now()
+		domain, sub := h.queryDomain(name)
+		var ips []net.IP
+		var cname string
+		var err error
+		extra := h.staleEDE()
+		host, ok := stripDomain(name, domain)
+		self := ok && strings.EqualFold(host, selfLabel)
+		if self {
+			ip, ecs := selfIP(w, r)
+			if ip == nil {
+				h.nxdomain(nxInvalidName, start, w, r)
+				return
+			}
+			ips = []net.IP{ip}
+			if ecs != nil {
+				extra = append(extra, ecs)
+			}
+		} else if ips, cname, err = h.queryIPs(name, domain, opts.dual); err != nil {
+			if q.Qtype == dns.TypeTXT && err != errResolveTimeout && err != errResolverDown && err != errResolveDisabled && h.relay(name, domain, start, w, r) {
+				return
+			}
+			h.resolveFail(err, name, domain, start, w, r)
 			return
 		}
 
-		m := new(dns.Msg)
-		m.SetReply(r)
+		lookupStart := time.Now()
+		if h.faults != nil {
+			h.faults.delay()
+			if h.faults.fail() {
+				h.fail(dns.RcodeServerFailure, start, w, r, ede(dns.ExtendedErrorCodeOther, "injected fault"))
+				return
+			}
+		}
+		var loc *location
+		answers := make([][]field, len(ips))
+		queries := make([]*Query, len(ips))
+		for i, ip := range ips {
+			var query *Query
+			if self {
+				query, err = h.lookupClient(ip)
+			} else {
+				query, err = h.lookup(ip)
+			}
+			if err != nil {
+				h.lookupFail(err, start, w, r)
+				return
+			}
+			h.countContinent(query)
+			// The fallback service would locate the server, not the
+			// client, for self queries. It only answers TXT.
+			if !self && q.Qtype == dns.TypeTXT && query.Country.ISOCode == "" && len(ips) == 1 && h.relay(name, domain, start, w, r) {
+				return
+			}
+			if loc == nil {
+				loc = &location{ip: ip, country: query.Country.ISOCode}
+				if self {
+					// The answer IP of self queries is the client's.
+					loc.ip = nil
+				}
+			}
+			queries[i] = query
+			if q.Qtype != dns.TypeTXT {
+				continue
+			}
+			answers[i] = h.fields(query, ip, cname, sub, clientIP(w))
+			if h.candidates > 0 && opts.format != positional {
+				answers[i] = append(answers[i], candidateFields(query, h.candidates, h.lang)...)
+			}
+			if opts.format != positional {
+				answers[i] = append(answers[i], h.policy.fields...)
+			}
+			if opts.debug && h.instance != "" {
+				answers[i] = append(answers[i], field{name: "instance", value: h.instance, level: levelMinimal, keyed: true})
+			}
+		}
+		lookupEnd := time.Now()
+		if q.Qtype == dns.TypeLOC {
+			h.send(h.locReply(queries, r), start, w, r, loc, extra...)
+			return
+		}
+		var resps []string
+		for i, fields := range answers {
+			var resp string
+			if opts.format == positional && h.formatter != nil {
+				if resp, err = h.formatter.formatResponse(fields, opts.level); err != nil {
+					h.formatter.fail(err)
+				}
+			} else if rf, ok := opts.format.(RecordFormatter); ok {
+				resp, err = rf.FormatRecord(ips[i], queries[i], fields, &opts)
+			} else {
+				resp, err = opts.format.Format(fields, &opts)
+			}
+			if err != nil {
+				h.failInternal(internal(dns.ExtendedErrorCodeOther, "formatter failed", err), start, w, r)
+				return
+			}
+			if opts.dual {
+				resp = familyLabel(ips[i]) + resp
+			}
+			resps = append(resps, resp)
+		}
+		txts := resps
+		if opts.debug {
+			txts = append(txts, fmt.Sprintf("resolve_us=%d lookup_us=%d total_us=%d",
+				lookupStart.Sub(resolveStart)/time.Microsecond,
+				lookupEnd.Sub(lookupStart)/time.Microsecond,
+				time.Since(start)/time.Microsecond)+h.resolverDebug(clientIP(w)))
+		}
+		if h.hmacKey != nil {
+			txts = append(txts, signResponse(h.hmacKey, q.Name, strings.Join(resps, "\n")))
+		}
+		h.send(h.txtReply(txts, r), start, w, r, loc, extra...)
+		phaseDurations.observe(resolveStart.Sub(start).Seconds(), "parse")
+		phaseDurations.observe(lookupStart.Sub(resolveStart).Seconds(), "resolve")
+		phaseDurations.observe(lookupEnd.Sub(lookupStart).Seconds(), "lookup")
+		phaseDurations.observe(time.Since(lookupEnd).Seconds(), "encode")
+		return
+	}
+	if h.policy.unsupported == dns.RcodeSuccess {
+		h.write(h.reply(r), start, w, r)
+		return
+	}
+	if h.policy.unsupported == dns.RcodeNameError {
+		h.nxdomain(nxUnsupportedType, start, w, r)
+		return
+	}
+	h.fail(h.policy.unsupported, start, w, r)
+}
+
+// queryIPs returns the IP queried by name, or with dual, an IP of each
+// family of hostnames with both.
+func (h *handle) queryIPs(name, domain string, dual bool) ([]net.IP, string, error) {
+	if dual {
+		return queryDualIP(name, domain, h.resolveTimeout)
+	}
+	ip, cname, err := queryIP(name, domain, h.resolveTimeout)
+	if err != nil {
+		return nil, "", err
+	}
+	return []net.IP{ip}, cname, nil
+}
 
-		txt := new(dns.TXT)
-		txt.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}
-		txt.Txt = []string{response(&query, ip, h.lang)}
+// fields returns the response fields of query for ip, with the extra
+// fields, overrides, script and plugins applied.
+func (h *handle) fields(query *Query, ip net.IP, cname, sub string, client net.IP) []field {
+	fields := append(queryFields(query, ip, h.lang), h.enrich(ip)...)
+	if sub != "" {
+		fields = append(fields, extraField("subdomain", sub))
+	}
+	if h.cnameField && cname != "" {
+		fields = append(fields, extraField("cname", cname))
+	}
+	if h.overrides != nil {
+		fields = h.overrides.apply(ip, fields)
+	}
+	if h.script != nil {
+		fields = h.script.apply(ip, client, fields)
+	}
+	if h.plugins != nil {
+		fields = h.plugins.apply(ip, client, fields)
+	}
+	return fields
+}
 
-		m.Answer = append(m.Answer, txt)
-		w.WriteMsg(m)
-		h.log(m.Rcode, start, w, r)
-		return
+// resolverDebug returns the debug fields locating the source of the
+// query, usually a recursive resolver, or nothing unless enabled.
+func (h *handle) resolverDebug(client net.IP) string {
+	if !h.debugResolver || client == nil {
+		return ""
 	}
-	h.fail(dns.RcodeNameError, start, w, r)
+	var query Query
+	if err := h.db.Lookup(client, &query); err != nil {
+		return ""
+	}
+	return fmt.Sprintf(" resolver=%s resolver_country=%s resolver_city=%q", client, query.Country.ISOCode, query.City.Names[h.lang])
+}
+
+// commands are the subcommands run as freegeoip-dns <command> [flags].
+var commands = map[string]func(args []string) error{
+	"build-db":    buildDBCmd,
+	"conformance": conformanceCmd,
+	"diff-db":     diffDBCmd,
+	"query":       queryCmd,
+	"replay":      replayCmd,
+	"rollback":    rollbackCmd,
+	"schema":      schemaCmd,
+	"selftest":    selftestCmd,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	addr := flag.String("addr", ":5300", "Address in form of ip:port to listen on")
-	domain := flag.String("domain", "", "Domain for the DNS queries")
+	addrNet := flag.String("net", "", "Network of the DNS listener: udp (dual-stack), udp4 or udp6, inferred from -addr if empty")
+	tcpReadTimeout := flag.Duration("tcp-read-timeout", defaultStreamLimits.readTimeout, "Time clients of the stream listeners have to send each query once they connect or start it")
+	tcpIdleTimeout := flag.Duration("tcp-idle-timeout", defaultStreamLimits.idleTimeout, "Time stream connections are kept open without queries")
+	tcpMaxQueries := flag.Int("tcp-max-queries", defaultStreamLimits.maxQueries, "Max queries per TCP or TLS connection before it is closed, 0 for no limit")
+	tcpMaxConns := flag.Int("tcp-max-conns", defaultStreamLimits.maxConns, "Max open connections of each of the stream listeners, 0 for no limit")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "Time to finish the queries being answered on SIGINT or SIGTERM before exiting")
+	newTransports := defineTransports(flag.CommandLine)
+	domain := flag.String("domain", "", "Domain for the DNS queries, comma separated for multiple domains")
 	ipdb := flag.String("db", maxmindFile, "IP database file or URL")
 	updateIntvl := flag.Duration("update", 24*time.Hour, "Database update check interval")
 	retryIntvl := flag.Duration("retry", time.Hour, "Max time to wait before retrying update")
+	dbDir := flag.String("db-dir", filepath.Join(os.TempDir(), "freegeoip-dns"), "Directory to store downloaded databases")
+	startupPolicy := flag.String("startup-policy", startupFail, "What to do when the database is unavailable at startup: wait until it loads, fail, or serve-degraded answering SERVFAIL until it loads")
+	dbLoad := flag.String("db-load", "memory", "How to load the database: memory, for lower latency, or mmap, for lower memory usage")
+	dbKeep := flag.Int("db-keep", 3, "Number of previous database versions kept for rollback")
+	downloadRate := flag.Int64("download-rate", 0, "Max database download rate in KiB per second, 0 for unlimited")
+	privacy := flag.Bool("privacy-mode", false, "Don't log queries nor keep or export client addresses, see Privacy mode in the README")
 	silent := flag.Bool("silent", false, "Do not log requests to stderr")
 	lang := flag.String("lang", "en", "Language to return the fields, e.g. country name")
+	rateLimit := flag.Float64("ratelimit", 0, "Max queries per second per client, 0 to disable")
+	rateBurst := flag.Int("ratelimit-burst", 10, "Max burst of queries per client")
+	maxQPS := flag.Float64("max-qps", 0, "Max queries per second of the server, over all clients, 0 to disable")
+	maxQPSBurst := flag.Int("max-qps-burst", 100, "Max burst of queries of the server over -max-qps")
+	maxQPSWait := flag.Duration("max-qps-wait", 100*time.Millisecond, "Max delay of queries over -max-qps before they are refused")
+	var threats listFlag
+	flag.Var(&threats, "threat-feed", "Threat intel feed in the form name=path, may be repeated")
+	torList := flag.String("tor-exits", "", "Tor exit list file or URL, e.g. "+torExitList)
+	var cloud listFlag
+	flag.Var(&cloud, "cloud-ranges", "Cloud provider ranges as provider[=file-or-url] (aws, gcp, azure, cloudflare), may be repeated")
+	asndb := flag.String("asn-db", "", "ASN database file or URL, enables the asn and is_hosting fields")
+	hostingList := flag.String("hosting-asns", "", "File with additional hosting ASNs, one per line")
+	accessLogFile := flag.String("access-log", "", "Write a JSON line for every answer to this file, rotated daily or at -access-log-rotate-size")
+	accessLogRotate := flag.Int64("access-log-rotate-size", 100, "Size in MiB to rotate the access log at")
+	accessLogMaxAge := flag.Duration("access-log-max-age", 7*24*time.Hour, "Delete rotated access logs older than this, 0 to keep them")
+	accessLogMaxSize := flag.Int64("access-log-max-size", 1024, "Delete the oldest rotated access logs beyond this total size in MiB, 0 for no limit")
+	otlpLogs := flag.String("otlp-logs", "", "Export logs and a record for every answer to this OpenTelemetry collector OTLP/HTTP endpoint, e.g. http://127.0.0.1:4318")
+	logSink := flag.String("log-sink", "", "Insert access log rows into clickhouse://[user:password@]host:port/db.table or bigquery://project/dataset/table")
+	publishTo := flag.String("publish", "", "Publish an event for every answer to nats://host:port/subject or kafka://broker1:port,broker2:port/topic")
+	grpcAddr := flag.String("grpc-addr", "", "Address in form of ip:port for the gRPC bulk lookup service, disabled if empty")
+	grpcNet := flag.String("grpc-net", "", "Network of the gRPC listener: tcp (dual-stack), tcp4 or tcp6, inferred from -grpc-addr if empty")
+	adminAddr := flag.String("admin-addr", "", "Address in form of ip:port for the HTTP admin endpoints, disabled if empty")
+	adminNet := flag.String("admin-net", "", "Network of the admin listener: tcp (dual-stack), tcp4 or tcp6, inferred from -admin-addr if empty")
+	profile := flag.String("profile", "full", "Response profile: minimal, standard or full")
+	respVersion := flag.String("response-version", "v1", "Response schema version: v1 or v2")
+	var domainProfiles listFlag
+	flag.Var(&domainProfiles, "domain-profile", "Response profile of a domain in the form domain=profile, may be repeated")
+	var tsigKeys listFlag
+	flag.Var(&tsigKeys, "tsig-key", "TSIG key allowed to send DNS UPDATE, NOTIFY and admin commands in the form name:base64secret, may be repeated")
+	var notifyAllow listFlag
+	flag.Var(&notifyAllow, "notify-allow", "IP or CIDR allowed to trigger a database reload with DNS NOTIFY, may be repeated")
+	instance := flag.String("instance-id", "", "Instance or site ID returned in NSID, CHAOS id.server queries, debug responses and metrics")
+	dual := flag.Bool("dual-stack", false, "Answer for hostnames with both A and AAAA records with a response for an address of each family, labeled ipv4= and ipv6=")
+	candidates := flag.Int("candidates", 0, "Max alternate location candidates, with their confidence, added to json, kv and csv responses from databases that have them")
+	omitEmpty := flag.Bool("omit-empty", false, "Leave empty fields out of all responses, writing the others as name=value, as with the omitempty. query label")
+	debug := flag.Bool("debug", false, "Include debug fields in all responses, as with the debug. query label")
+	debugResolver := flag.Bool("debug-resolver", false, "Locate the source of the query, usually a recursive resolver, in debug responses")
+	var peers listFlag
+	flag.Var(&peers, "peer", "Admin endpoint URL of a cluster peer, e.g. http://10.0.0.2:8080, may be repeated")
+	fallbackAddr := flag.String("fallback", "", "Address in form of host:port of a geo-DNS service to relay the queries that can't be answered to, e.g. unknown IPs")
+	fallbackDomain := flag.String("fallback-domain", "", "Domain of the -fallback service")
+	mirrorAddr := flag.String("mirror", "", "Address in form of host:port of a shadow server to mirror queries to, logging the answers that differ, disabled if empty")
+	mirrorFraction := flag.Float64("mirror-fraction", 0.1, "Fraction of the queries mirrored to -mirror")
+	var pluginFiles listFlag
+	flag.Var(&pluginFiles, "plugin", "WebAssembly plugin module with an access policy, enricher or formatter, may be repeated")
+	scriptFile := flag.String("script", "", "Starlark script with a respond function customizing the response fields")
+	hmacKey := flag.String("hmac-key", "", "Key to sign responses with an HMAC in a final hmac= TXT string, disabled if empty")
+	paddingBlock := flag.Int("padding-block", defaultPaddingBlock, "Block size answers over encrypted transports are padded to when asked with EDNS padding (RFC 7830), 0 to disable")
+	adminKey := flag.String("admin-key", "", "Bearer token authenticating the privileged admin endpoints, /db/rollback, /stats/ and POST /features, which are disabled if empty")
+	dbKey := flag.String("db-key", "", "Bearer token authenticating downloads of the loaded database at /db/file on -admin-addr, disabled if empty")
+	clusterKey := flag.String("cluster-key", "", "Shared key authenticating cluster peers, required with -peer")
+	clusterIntvl := flag.Duration("cluster-interval", 10*time.Second, "Interval to poll cluster peers")
+	clusterDB := flag.Bool("cluster-db", false, "Download the database on the cluster leader only, and from the leader on the other nodes")
+	banTTL := flag.Duration("ban-ttl", 5*time.Minute, "How long peers refuse a client rate limited by another node")
+	resolveTimeout := flag.Duration("resolve-timeout", 5*time.Second, "Timeout for resolving queried hostnames")
+	adaptiveResolve := flag.Bool("resolve-timeout-adaptive", false, "Tune the timeout for resolving queried hostnames to their observed latency, between -resolve-timeout-floor and -resolve-timeout")
+	timeoutFloor := flag.Duration("resolve-timeout-floor", 250*time.Millisecond, "Min timeout for resolving queried hostnames tuned by -resolve-timeout-adaptive")
+	breakerFailures := flag.Int("resolve-breaker", 0, "Consecutive hostname resolution failures or timeouts suspending resolution, 0 to disable")
+	breakerCooldown := flag.Duration("resolve-breaker-cooldown", 5*time.Second, "First suspension of hostname resolution by -resolve-breaker, doubled while it keeps failing")
+	breakerMaxCooldown := flag.Duration("resolve-breaker-max-cooldown", 2*time.Minute, "Max suspension of hostname resolution by -resolve-breaker")
+	cnameField := flag.Bool("cname", false, "Include the canonical name of queried hostnames in the cname field")
+	ttl := flag.Duration("ttl", 0, "TTL of TXT answers")
+	negativeTTL := flag.Duration("negative-ttl", 5*time.Minute, "How long resolvers cache NXDOMAIN and NODATA answers, the SOA minimum")
+	unsupported := flag.String("unsupported-rcode", "nxdomain", "Answer to queries for unsupported types: nxdomain, nodata, refused or notimp")
+	respFormat := flag.String("format", "positional", "Response format of TXT answers: positional (or plain), json, kv, csv or template")
+	formatTemplate := flag.String("format-template", "", "text/template of the template format, given the map of field names to values")
+	var staticFields listFlag
+	flag.Var(&staticFields, "field", "Static field appended to the responses of named formats, like json and kv, in the form name=value, may be repeated")
+	var domainPolicies listFlag
+	flag.Var(&domainPolicies, "domain-policy", "Policy of a domain overriding -ttl, -negative-ttl, -unsupported-rcode, -format and -field, in the form domain:ttl=1m,negative-ttl=1h,unsupported=nodata,format=json,field.env=prod, may be repeated")
+	statsWindow := flag.Duration("stats-window", 0, "Window of the lookup counts by continent answered to stats.<domain> queries and, with -admin-key, at /stats/continents, rounded to minutes, 0 to disable")
+	prefixWindow := flag.Duration("prefix-stats-window", 0, "Window of the query counts by source /24 and /48 prefix served at /stats/prefixes with -admin-key, rounded to minutes, 0 to disable")
+	prefixMax := flag.Int("prefix-stats-max", 10000, "Max source prefixes counted per minute by -prefix-stats-window, beyond which sources are counted in coarser prefixes")
+	tunnelEndpoints := flag.Bool("tunnel-endpoints", false, "Look up 6to4 and Teredo addresses as is, rather than by the IPv4 address they embed")
+	cacheSize := flag.Int("cache-size", 0, "Max records of queried IPs kept in the lookup cache, flushed on database loads, 0 to disable")
+	cacheWarm := flag.String("cache-warm", "", "File of frequently queried IPs, one per line, looked up to warm up the cache before reporting ready")
+	cacheWarmPeers := flag.Bool("cache-warm-peers", false, "Warm up the cache with the IPs in the caches of the cluster peers")
+	repairRate := flag.Float64("repair-error-rate", 0, "Verify the database, and download it again if corrupt, when this fraction of lookups fails, 0 to disable")
+	repairIntvl := flag.Duration("repair-interval", time.Minute, "Interval of the lookup error rate checks of -repair-error-rate")
+	integrityIntvl := flag.Duration("integrity-interval", 0, "Interval of the background integrity checks of the database, 0 to disable")
+	integritySamples := flag.Int("integrity-samples", 100, "Random addresses looked up by each integrity check")
+	integrityAnchors := flag.String("integrity-anchors", "", "File of IPs and their country codes, one pair per line, looked up by each integrity check")
+	maxDBAge := flag.Duration("max-db-age", 0, "Mark answers as stale when the database was built longer than this ago, 0 to disable")
+	taskJitter := flag.Float64("task-jitter", 0.1, "Max fraction of their interval added at random to the intervals of the maintenance tasks")
+	disableTasks := flag.String("disable-tasks", "", "Comma separated maintenance tasks not to run, see Maintenance tasks in the README")
+	disableFeatures := flag.String("disable-features", "", "Comma separated subsystems switched off at startup: resolve, geo-routing, enrichment or cache, see Kill switches in the README")
+	warnGoroutines := flag.Int("warn-goroutines", 0, "Log a warning when the number of goroutines stays above this for -warn-period, 0 to disable")
+	warnInflight := flag.Int("warn-inflight", 0, "Log a warning when the number of in-flight queries stays above this for -warn-period, 0 to disable")
+	warnPeriod := flag.Duration("warn-period", time.Minute, "How long -warn-goroutines or -warn-inflight must be exceeded to log a warning")
+	uriTemplate := flag.String("uri-template", "", "Answer URI queries with this URL, where {ip} is replaced by the queried IP, e.g. https://freegeoip.net/json/{ip}")
+	geoRoutes := flag.String("geo-routes", "", "JSON file with the geo-routed names, e.g. SRV records by client region")
+	record := flag.String("record", "", "Append the queries received to this file, for the replay command")
+	faultLatency := flag.Duration(faultFlagPrefix+"latency", 0, "Inject this latency in every lookup, for testing")
+	faultServfail := flag.Float64(faultFlagPrefix+"servfail", 0, "Answer this fraction of queries SERVFAIL, for testing")
+	faultReload := flag.Duration(faultFlagPrefix+"reload", 0, "Reload the database at this interval, for testing")
+	printCfg := flag.Bool("print-config", false, "Print the effective configuration as JSON, with secrets redacted, and exit")
 	version := flag.Bool("version", false, "Show version and exit")
+	versionJSON := flag.Bool("json", false, "With -version, show the version, build and enabled features as JSON")
+	flag.Usage = usage
 	flag.Parse()
 
+	if *privacy {
+		if *record != "" || *accessLogFile != "" || *prefixWindow > 0 {
+			log.Fatal("-record, -access-log and -prefix-stats-window are not allowed in privacy mode")
+		}
+		*silent = true
+	}
+
+	if *printCfg {
+		if err := printConfig(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *version {
+		if *versionJSON {
+			if err := getBuildInfo().writeJSON(os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
 		log.Printf("freegeoip v%s\n", VERSION)
 		return
 	}
 
-	db, err := openDB(*ipdb, *updateIntvl, *retryIntvl)
-	if err != nil {
+	if err := resolveSecrets(); err != nil {
 		log.Fatal(err)
 	}
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	tasks.jitter = *taskJitter
+	if err := tasks.disable(*disableTasks); err != nil {
+		log.Fatal(err)
+	}
+	if err := switches.disable(*disableFeatures); err != nil {
+		log.Fatal(err)
+	}
 
-	server := &dns.Server{Addr: *addr, Net: "udp"}
-	dns.Handle(*domain+".", &handle{db, *silent, *lang, *domain})
+	dnsNet, err := listenNet("udp", *addrNet, *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tsigSecret map[string]string
+	if len(tsigKeys) > 0 {
+		tsigSecret = make(map[string]string)
+		for _, k := range tsigKeys {
+			p := strings.SplitN(k, ":", 2)
+			if len(p) != 2 {
+				log.Fatalf("invalid TSIG key %q, want name:base64secret", k)
+			}
+			tsigSecret[dns.Fqdn(p[0])] = p[1]
+		}
+	}
+	transports, err := newTransports(&transportEnv{addr: *addr, net: dnsNet, tsigSecret: tsigSecret,
+		limits: streamLimits{readTimeout: *tcpReadTimeout, idleTimeout: *tcpIdleTimeout, maxQueries: *tcpMaxQueries, maxConns: *tcpMaxConns}})
+	if err != nil {
+		log.Fatal(err)
+	}
+	h := &handle{silent: *silent, lang: *lang, info: &dbInfo{}, instance: *instance, debug: *debug, omitEmpty: *omitEmpty, dual: *dual, candidates: *candidates, debugResolver: *debugResolver, privacy: *privacy,
+		resolveTimeout: *resolveTimeout, maxDBAge: *maxDBAge, cnameField: *cnameField,
+		uriTemplate: *uriTemplate, tunnelEndpoints: *tunnelEndpoints}
+	if *instance != "" {
+		metrics.setLabel("instance", *instance)
+	}
+	dbOpts := dbOptions{updateIntvl: *updateIntvl, maxRetryIntvl: *retryIntvl, rate: *downloadRate * 1024, dir: *dbDir, keep: *dbKeep, mmap: *dbLoad == "mmap"}
+	if *dbLoad != "memory" && *dbLoad != "mmap" {
+		log.Fatalf("invalid -db-load %q, want memory or mmap", *dbLoad)
+	}
+	h.info.mode = *dbLoad
+	cleanDir(*dbDir)
+	if *cacheSize > 0 {
+		h.cache = newLookupCache(*cacheSize)
+	}
+	if minutes := int(statsWindow.Minutes()); minutes > 0 {
+		h.geoStats = newContinentStats(minutes)
+	}
+	if minutes := int(prefixWindow.Minutes()); minutes > 0 {
+		h.prefixStats = newPrefixStats(minutes, *prefixMax)
+	}
+	onOpen := func(file string) {
+		if h.cache != nil {
+			h.cache.flush()
+		}
+		h.info.load(file)
+		emitDBReload(file, nil)
+	}
+	dsn, clusterDBFile, clusterDBSum := *ipdb, "", ""
+	if len(peers) > 0 {
+		if *adminAddr == "" || *instance == "" || *clusterKey == "" {
+			log.Fatal("cluster mode requires -admin-addr, -instance-id and -cluster-key")
+		}
+		h.cluster = newCluster(*instance, peers, *clusterKey, *banTTL)
+		if *clusterDB {
+			clusterDBFile = filepath.Join(*dbDir, "cluster-db.mmdb.gz")
+			dsn, clusterDBSum = h.cluster.startupDB(*ipdb, clusterDBFile)
+		}
+	}
+	if h.db, err = newGeoDB(dsn, dbOpts, *silent, onOpen, *startupPolicy); err != nil {
+		log.Fatal(err)
+	}
+	if *repairRate > 0 {
+		tasks.start(&task{name: "db-repair", intvl: *repairIntvl, run: func() error { return checkLookupErrors(h.db, h.info, *repairRate) }})
+	}
+	if *integrityIntvl > 0 {
+		c := &integrityChecker{db: h.db, info: h.info, samples: *integritySamples}
+		if *integrityAnchors != "" {
+			if c.anchors, err = readAnchors(*integrityAnchors); err != nil {
+				log.Fatal(err)
+			}
+		}
+		tasks.start(&task{name: "db-integrity", intvl: *integrityIntvl, run: c.run})
+	}
+	if len(notifyAllow) > 0 {
+		if h.notifyACL, err = newACL(notifyAllow); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(tsigKeys) > 0 {
+		h.overrides = newOverrides()
+	}
+	if h.cluster != nil {
+		tasks.start(&task{name: "cluster-top-reset", intvl: *clusterIntvl * 6, run: h.cluster.top.reset})
+		tasks.start(&task{name: "cluster-poll", intvl: *clusterIntvl, run: h.cluster.poll})
+		if *clusterDB {
+			tasks.start(&task{name: "cluster-db-sync", intvl: *clusterIntvl, run: h.cluster.dbSync(h.db, *ipdb, clusterDBFile, clusterDBSum)})
+		}
+	}
+	if *cacheWarm != "" || *cacheWarmPeers {
+		if h.cache == nil {
+			log.Fatal("-cache-warm and -cache-warm-peers require -cache-size")
+		}
+		h.cache.warming = 1
+		go h.warmCache(*cacheWarm, *cacheWarmPeers)
+	}
+	if h.level, err = parseProfile(*profile); err != nil {
+		log.Fatal(err)
+	}
+	if h.version, err = parseVersion(*respVersion); err != nil {
+		log.Fatal(err)
+	}
+	h.policy.ttl, h.policy.negativeTTL = uint32(ttl.Seconds()), uint32(negativeTTL.Seconds())
+	if err := h.policy.set("unsupported", *unsupported); err != nil {
+		log.Fatal(err)
+	}
+	if *formatTemplate != "" {
+		f, err := newTemplateFormat(*formatTemplate)
+		if err != nil {
+			log.Fatalf("invalid -format-template: %v", err)
+		}
+		registerFormatter("template", f)
+	}
+	if err := h.policy.set("format", *respFormat); err != nil {
+		log.Fatal(err)
+	}
+	for _, sf := range staticFields {
+		p := strings.SplitN(sf, "=", 2)
+		if len(p) != 2 {
+			log.Fatalf("invalid field %q, want name=value", sf)
+		}
+		if err := h.policy.set("field."+p[0], p[1]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	policies, err := parseDomainPolicies(domainPolicies, h.policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	levels := make(map[string]int)
+	for _, dp := range domainProfiles {
+		p := strings.SplitN(dp, "=", 2)
+		if len(p) != 2 {
+			log.Fatalf("invalid domain profile %q, want domain=profile", dp)
+		}
+		if levels[p[0]], err = parseProfile(p[1]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *rateLimit > 0 {
+		h.limiter = newRateLimiter(*rateLimit, *rateBurst)
+	}
+	if *breakerFailures > 0 {
+		resolveBreaker = newBreaker(*breakerFailures, *breakerCooldown, *breakerMaxCooldown)
+	}
+	if *adaptiveResolve {
+		tuneResolveTimeout(*timeoutFloor, *resolveTimeout)
+	}
+	if *maxQPS > 0 {
+		h.throttle = newThrottle(*maxQPS, *maxQPSBurst, *maxQPSWait)
+	}
+	if len(threats) > 0 {
+		if h.threats, err = newThreatFeeds(threats); err != nil {
+			log.Fatal(err)
+		}
+		tasks.start(&task{name: "threat-feeds", intvl: *updateIntvl, run: h.threats.load})
+	}
+	if *torList != "" {
+		if h.tor, err = newTorExits(*torList); err != nil {
+			log.Fatal(err)
+		}
+		tasks.start(&task{name: "tor-exits", intvl: *updateIntvl, run: h.tor.load})
+	}
+	if len(cloud) > 0 {
+		if h.cloud, err = newCloudRanges(cloud); err != nil {
+			log.Fatal(err)
+		}
+		tasks.start(&task{name: "cloud-ranges", intvl: *updateIntvl, run: h.cloud.load})
+	}
+	if *asndb != "" {
+		adb, err := openDB(*asndb, dbOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if h.hosting, err = newHostingDetector(adb, *hostingList); err != nil {
+			log.Fatal(err)
+		}
+		go watchEvents(adb, "asn", *silent, nil)
+	}
+	if *fallbackAddr != "" {
+		h.fallback = newFallback(*fallbackAddr, *fallbackDomain, *resolveTimeout)
+	}
+	if *mirrorAddr != "" {
+		h.mirror = newMirror(*mirrorAddr, *mirrorFraction, *resolveTimeout)
+	}
+	if len(pluginFiles) > 0 {
+		if h.plugins, err = loadPlugins(pluginFiles); err != nil {
+			log.Fatal(err)
+		}
+		h.formatter = h.plugins.formatter()
+	}
+	if *scriptFile != "" {
+		if h.script, err = loadScript(*scriptFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *hmacKey != "" {
+		h.hmacKey = []byte(*hmacKey)
+	}
+	h.dbKey = *dbKey
+	h.adminKey = *adminKey
+	h.paddingBlock = *paddingBlock
+	if *geoRoutes != "" {
+		if h.routes, err = loadRoutes(*geoRoutes); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *record != "" {
+		if h.recorder, err = newRecorder(*record); err != nil {
+			log.Fatal(err)
+		}
+		tasks.start(&task{name: "record-flush", intvl: time.Second, run: h.recorder.flush})
+	}
+	if *faultLatency > 0 || *faultServfail > 0 {
+		h.faults = &faults{latency: *faultLatency, servfail: *faultServfail}
+	}
+	if *faultReload > 0 {
+		tasks.start(&task{name: "fault-reload", intvl: *faultReload, run: func() error { return churn(h.db) }})
+	}
+	if h.faults != nil || *faultReload > 0 {
+		log.Println("WARNING fault injection enabled")
+	}
+	if *warnGoroutines > 0 || *warnInflight > 0 {
+		a := &leakAlarm{goroutines: *warnGoroutines, inflight: *warnInflight, period: *warnPeriod}
+		tasks.start(&task{name: "leak-alarm", intvl: *warnPeriod / 10, run: a.check})
+	}
+	go dumpStatsOnSignal(h.info)
+	h.build = getBuildInfo()
+	exportBuildInfo(h.build)
+	for _, name := range versionNames {
+		dns.Handle(name, h)
+	}
+	if *instance != "" {
+		for _, name := range chaosNames {
+			dns.Handle(name, h)
+		}
+	}
+	for _, d := range strings.Split(*domain, ",") {
+		dh := *h
+		dh.domain = d
+		if strings.HasPrefix(d, "*.") {
+			dh.domain, dh.wildcard = d[2:], true
+		}
+		if level, ok := levels[d]; ok {
+			dh.level = level
+		}
+		if p, ok := policies[d]; ok {
+			dh.policy = p
+		}
+		dh.fast = dh.newFastLane()
+		dns.Handle(dh.domain+".", &dh)
+	}
+
+	if *accessLogFile != "" {
+		l := &accessLog{file: *accessLogFile, rotateSize: *accessLogRotate << 20, maxAge: *accessLogMaxAge, maxSize: *accessLogMaxSize << 20}
+		if err := l.open(); err != nil {
+			log.Fatal(err)
+		}
+		l.purge(time.Now())
+		go l.run()
+		tasks.start(&task{name: "access-log-rotate", intvl: time.Second, run: l.maintain})
+	}
+	if *otlpLogs != "" {
+		e := newOTLPExporter(*otlpLogs, *instance)
+		log.SetOutput(io.MultiWriter(os.Stderr, e))
+		e.exportAnswers()
+	}
+	if *logSink != "" {
+		s, err := newSink(*logSink)
+		if err != nil {
+			log.Fatal(err)
+		}
+		exportLog(s)
+	}
+	if *publishTo != "" {
+		p, err := newPublisher(*publishTo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		publishEvents(p)
+	}
+	if *grpcAddr != "" {
+		network, err := listenNet("tcp", *grpcNet, *grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(serveGRPC(network, *grpcAddr, h))
+		}()
+	}
+	if *adminAddr != "" {
+		network, err := listenNet("tcp", *adminNet, *adminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(serveAdmin(network, *adminAddr, h))
+		}()
+		if err := watchSocket(*addr, 10*time.Second); err != nil && !*silent {
+			log.Println(err)
+		}
+	}
 
 	if !*silent {
-		log.Println("freegeoip dns server starting on", *addr)
-		go logEvents(db)
+		log.Println("config:", configSummary())
+		transports.onLifecycle(transportHooks{started: func(t Transport) {
+			log.Println("freegeoip dns server starting on", t)
+		}})
+	}
+	if err := transports.serve(dns.DefaultServeMux, *shutdownTimeout); err != nil {
+		log.Fatal(err)
 	}
-	log.Fatal(server.ListenAndServe())
 }
 
-func queryIP(q dns.Question, domain string) net.IP {
-	h := q.Name
-	if domain != "" {
-		h = strings.Split(q.Name, "."+domain)[0]
+// Hostname resolution errors.
+var (
+	errInvalidName     = errors.New("invalid query name")
+	errHostNotFound    = errors.New("host not found")
+	errResolveTimeout  = errors.New("hostname resolution timed out")
+	errResolveFailed   = errors.New("hostname resolution failed")
+	errResolverDown    = errors.New("hostname resolution suspended")
+	errResolveDisabled = errors.New("hostname resolution switched off")
+)
+
+// resolveError returns the rcode answered for a queryIP error.
+func resolveError(err error) int {
+	if err == errResolveTimeout || err == errResolverDown || err == errResolveDisabled {
+		return dns.RcodeServerFailure
 	}
-	if ip := net.ParseIP(h); ip != nil {
-		return ip
+	return dns.RcodeNameError
+}
+
+// resolveEDE returns the extended error explaining a queryIP error.
+func resolveEDE(err error) dns.EDNS0 {
+	switch err {
+	case errResolveTimeout:
+		return ede(dns.ExtendedErrorCodeNoReachableAuthority, "hostname resolution timed out")
+	case errResolverDown:
+		return ede(dns.ExtendedErrorCodeNoReachableAuthority, "hostname resolution suspended, resolvers failing")
+	case errResolveDisabled:
+		return ede(dns.ExtendedErrorCodeNotSupported, "hostname resolution switched off")
+	case errInvalidName:
+		return ede(dns.ExtendedErrorCodeOther, "invalid query name")
 	}
-	ip, err := net.LookupIP(h)
-	if err != nil {
-		return nil // Not found.
+	return ede(dns.ExtendedErrorCodeOther, "hostname not found")
+}
+
+// Limits of hostnames, from RFC 1035.
+const (
+	maxHostLen  = 253
+	maxLabelLen = 63
+)
+
+// queryIP returns the IP queried in name, stripped of domain, resolving
+// hostnames within timeout, or the one tuned by resolveTimeouts. For
+// hostnames it also returns their canonical name, if known.
+func queryIP(name, domain string, timeout time.Duration) (net.IP, string, error) {
+	h, ok := stripDomain(name, domain)
+	if !ok || !validHost(h) {
+		return nil, "", errInvalidName
 	}
-	if len(ip) == 0 {
-		return nil
+	if ip := parseIP(h); ip != nil {
+		return ip, "", nil
+	}
+	if !switches.on(switchResolve) {
+		return nil, "", errResolveDisabled
+	}
+	if !resolveBreaker.allow() {
+		return nil, "", errResolverDown
+	}
+	begin := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeouts.timeout(timeout))
+	defer cancel()
+	if res := getResolver(); res != nil {
+		ips, cname, err := res.lookup(ctx, h)
+		resolveBreaker.record(resolveFailed(err))
+		resolveTimeouts.observe(time.Since(begin))
+		if err != nil {
+			return nil, "", err
+		}
+		return ips[rand.Intn(len(ips))], cname, nil
+	}
+	ip, err := net.DefaultResolver.LookupIPAddr(ctx, h)
+	resolveBreaker.record(ctx.Err() == context.DeadlineExceeded)
+	resolveTimeouts.observe(time.Since(begin))
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, "", errResolveTimeout
+	}
+	if err != nil || len(ip) == 0 {
+		return nil, "", errHostNotFound
+	}
+	return ip[rand.Intn(len(ip))].IP, "", nil
+}
+
+// parseIP parses an IP as pasted from logs, stripping ports, brackets
+// and zones: 1.2.3.4:443, [2001:db8::1], [2001:db8::1]:443 or fe80::1%eth0.
+// Single labels are decoded with decodeIPLabel. It returns nil if h is
+// not an IP.
+func parseIP(h string) net.IP {
+	if strings.HasPrefix(h, "[") {
+		i := strings.IndexByte(h, ']')
+		if i < 0 {
+			return nil
+		}
+		if rest := h[i+1:]; rest != "" && !isPort(strings.TrimPrefix(rest, ":")) {
+			return nil
+		}
+		h = h[1:i]
+	} else if i := strings.IndexByte(h, ':'); i >= 0 && i == strings.LastIndexByte(h, ':') {
+		// A single colon can only be an IPv4 address with a port.
+		if !isPort(h[i+1:]) {
+			return nil
+		}
+		h = h[:i]
+		if ip := net.ParseIP(h); ip == nil || ip.To4() == nil {
+			return nil
+		}
+	}
+	if i := strings.IndexByte(h, '%'); i >= 0 && strings.Contains(h[:i], ":") {
+		h = h[:i]
+	}
+	if !strings.ContainsAny(h, ".:") {
+		return decodeIPLabel(h)
+	}
+	return net.ParseIP(h)
+}
+
+// isPort reports whether s is a port number.
+func isPort(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 16)
+	return err == nil
+}
+
+// stripDomain returns name without the trailing dot and domain, compared
+// case insensitively. It returns false if name is not under domain.
+func stripDomain(name, domain string) (string, bool) {
+	name = strings.TrimSuffix(name, ".")
+	if domain == "" {
+		return name, true
+	}
+	suffix := "." + strings.TrimSuffix(domain, ".")
+	if len(name) <= len(suffix) || !strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+		return "", false
+	}
+	return name[:len(name)-len(suffix)], true
+}
+
+// validHost reports whether h can be a hostname or IP: not empty, within
+// the length limits, without empty labels and without the escaped bytes
+// the dns package uses for dots, spaces and non-ASCII inside labels.
+func validHost(h string) bool {
+	if h == "" || len(h) > maxHostLen || strings.IndexByte(h, '\\') >= 0 {
+		return false
+	}
+	for _, l := range strings.Split(h, ".") {
+		if l == "" || len(l) > maxLabelLen {
+			return false
+		}
+	}
+	for i := 0; i < len(h); i++ {
+		if h[i] <= ' ' || h[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// join joins DNS labels, skipping empty ones.
+func join(labels ...string) string {
+	var ret []string
+	for _, l := range labels {
+		if l != "" {
+			ret = append(ret, l)
+		}
 	}
-	return ip[rand.Intn(len(ip))]
+	return strings.Join(ret, ".")
 }
 
-// logEvents logs database events.
-func logEvents(db *freegeoip.DB) {
+// watchEvents logs the events of the named database unless silent,
+// counts them and calls onOpen, if not nil, with the name of each
+// database file loaded. The errors and close of the IP database are
+// published as events.
+func watchEvents(db *freegeoip.DB, name string, silent bool, onOpen func(file string)) {
 	for {
 		select {
 		case file := <-db.NotifyOpen():
-			log.Println("database loaded:", file)
+			countDBEvent(name, dbOpen)
+			if !silent {
+				log.Println("database loaded:", file)
+			}
+			if onOpen != nil {
+				onOpen(file)
+			}
 		case err := <-db.NotifyError():
-			log.Println("database error:", err)
+			countDBEvent(name, dbError)
+			if !silent {
+				log.Println("database error:", err)
+			}
+			if name == "ip" {
+				emitDBReload("", err)
+			}
 		case <-db.NotifyClose():
+			countDBEvent(name, dbClose)
+			if name == "ip" {
+				emitDBClose()
+			}
 			return
 		}
 	}
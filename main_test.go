@@ -0,0 +1,96 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryNames are seeds of the query name fuzz targets: IPs in the forms
+// parseIP accepts, hostnames, and malformed names.
+var queryNames = []string{
+	"8.8.8.8.geo.test.",
+	"8.8.8.8.GEO.TEST",
+	"8.8.8.8:53.geo.test.",
+	"[2001:db8::1]:53.geo.test.",
+	"fe80::1%eth0.geo.test.",
+	"hex-20010db8000000000000000000000001.geo.test.",
+	"HEX-0a000001.geo.test.",
+	"b32-biaaaai.geo.test.",
+	"deadbeef.geo.test.",
+	"134744072.geo.test.",
+	"www.example.com.geo.test.",
+	"geo.test.",
+	".geo.test.",
+	"a..b.geo.test.",
+	`bad\ label.geo.test.`,
+	`\000.geo.test.`,
+	"8.8.8.8.geo.test.geo.test.",
+	"8.8.8.8.notgeo.test.",
+	strings.Repeat("a", 64) + ".geo.test.",
+	strings.Repeat("a.", 127) + "geo.test.",
+	"",
+	".",
+}
+
+func FuzzStripDomain(f *testing.F) {
+	for _, name := range queryNames {
+		f.Add(name, testDomain)
+		f.Add(name, "")
+	}
+	f.Fuzz(func(t *testing.T, name, domain string) {
+		rel, ok := stripDomain(name, domain)
+		if !ok {
+			if rel != "" {
+				t.Errorf("stripDomain(%q, %q) = %q, false, want no name", name, domain, rel)
+			}
+			return
+		}
+		name = strings.TrimSuffix(name, ".")
+		if domain == "" {
+			if rel != name {
+				t.Errorf("stripDomain(%q, \"\") = %q, want %q", name, rel, name)
+			}
+			return
+		}
+		domain = strings.TrimSuffix(domain, ".")
+		if rel == "" || !strings.EqualFold(rel+"."+domain, name) || rel != name[:len(rel)] {
+			t.Errorf("stripDomain(%q, %q) = %q, want the labels of %q before .%s", name, domain, rel, name, domain)
+		}
+	})
+}
+
+func FuzzQueryIP(f *testing.F) {
+	for _, name := range queryNames {
+		f.Add(name)
+	}
+	// Hostnames are not resolved, so that the targets don't depend on the
+	// network.
+	switches.set(switchResolve, false)
+	defer switches.set(switchResolve, true)
+	f.Fuzz(func(t *testing.T, name string) {
+		ip, _, err := queryIP(name, testDomain, time.Second)
+		h, ok := stripDomain(name, testDomain)
+		switch {
+		case err == errInvalidName:
+			if ok && validHost(h) {
+				t.Errorf("queryIP(%q): got %v for the valid host %q", name, err, h)
+			}
+		case err == errResolveDisabled:
+			if parseIP(h) != nil {
+				t.Errorf("queryIP(%q): got %v for the IP %q", name, err, h)
+			}
+		case err != nil:
+			t.Errorf("queryIP(%q): got unexpected error %v", name, err)
+		case ip == nil:
+			t.Errorf("queryIP(%q): got no IP and no error", name)
+		case !ok || !validHost(h):
+			t.Errorf("queryIP(%q): got %s for the invalid host %q", name, ip, h)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// dbMeta is the metadata of the loaded IP database.
+type dbMeta struct {
+	File         string    `json:"file"`
+	DatabaseType string    `json:"database_type"`
+	BuildEpoch   uint      `json:"build_epoch"`
+	BuildTime    time.Time `json:"build_time"`
+	Languages    []string  `json:"languages"`
+	NodeCount    uint      `json:"node_count"`
+	IPVersion    uint      `json:"ip_version"`
+	RecordSize   uint      `json:"record_size"`
+	Size         int       `json:"size"`
+}
+
+// String returns the metadata as key=value fields.
+func (m *dbMeta) String() string {
+	return strings.Join([]string{
+		"type=" + m.DatabaseType,
+		"build_epoch=" + strconv.FormatUint(uint64(m.BuildEpoch), 10),
+		"build_time=" + m.BuildTime.Format(time.RFC3339),
+		"languages=" + strings.Join(m.Languages, ","),
+		"node_count=" + strconv.FormatUint(uint64(m.NodeCount), 10),
+		"ip_version=" + strconv.FormatUint(uint64(m.IPVersion), 10),
+	}, "    ")
+}
+
+// mmdbMetadataMaxSize is the max size of the metadata section, at the end
+// of mmdb files.
+const mmdbMetadataMaxSize = 128 << 10
+
+// readMeta reads the metadata of the mmdb file, which may be gzipped.
+func readMeta(file string) (*dbMeta, error) {
+	tail, size, err := readTail(file, mmdbMetadataMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	md, err := decodeMetadata(tail)
+	if err != nil {
+		return nil, err
+	}
+	return &dbMeta{
+		File:         file,
+		DatabaseType: md.DatabaseType,
+		BuildEpoch:   md.BuildEpoch,
+		BuildTime:    time.Unix(int64(md.BuildEpoch), 0).UTC(),
+		Languages:    md.Languages,
+		NodeCount:    md.NodeCount,
+		IPVersion:    md.IPVersion,
+		RecordSize:   md.RecordSize,
+		Size:         size,
+	}, nil
+}
+
+// readTail returns the last n bytes of the mmdb file, which may be
+// gzipped, and its size uncompressed. Gzipped files are streamed, keeping
+// only their end, rather than uncompressed in memory.
+func readTail(file string, n int) ([]byte, int, error) {
+	gz, err := isGzip(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	if !gz {
+		st, err := f.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+		if st.Size() > int64(n) {
+			if _, err := f.Seek(st.Size()-int64(n), io.SeekStart); err != nil {
+				return nil, 0, err
+			}
+		}
+		tail, err := ioutil.ReadAll(f)
+		return tail, int(st.Size()), err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	var tail []byte
+	size := 0
+	buf := make([]byte, 32<<10)
+	for {
+		k, err := zr.Read(buf)
+		size += k
+		if tail = append(tail, buf[:k]...); len(tail) > 2*n {
+			tail = append(tail[:0], tail[len(tail)-n:]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(tail) > n {
+		tail = tail[len(tail)-n:]
+	}
+	return tail, size, nil
+}
+
+// decodeMetadata decodes the metadata section at the end of b, the end
+// of a mmdb file. maxminddb only decodes metadata of whole databases, so
+// the section is decoded as the data section of a database without
+// search tree.
+func decodeMetadata(b []byte) (*maxminddb.Metadata, error) {
+	i := bytes.LastIndex(b, []byte(mmdbMetadataStart))
+	if i < 0 {
+		return nil, errors.New("invalid MaxMind DB file: no metadata")
+	}
+	var db bytes.Buffer
+	db.Write(make([]byte, 16)) // data section separator
+	db.Write(b[i+len(mmdbMetadataStart):])
+	db.WriteString(mmdbMetadataStart)
+	encodeMMDB(&db, map[string]interface{}{"node_count": uint32(0), "record_size": uint16(24), "ip_version": uint16(6)})
+	r, err := maxminddb.FromBytes(db.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	var md maxminddb.Metadata
+	if err := r.Decode(0, &md); err != nil {
+		return nil, fmt.Errorf("invalid MaxMind DB metadata: %v", err)
+	}
+	return &md, nil
+}
+
+// dbInfo tracks the metadata of the currently loaded database.
+type dbInfo struct {
+	mode string // how the database is loaded: memory or mmap
+	mu   sync.RWMutex
+	meta *dbMeta
+}
+
+// load reads the metadata of a newly opened database file.
+func (di *dbInfo) load(file string) {
+	m, err := readMeta(file)
+	if err != nil {
+		log.Println("database metadata:", err)
+		return
+	}
+	di.mu.Lock()
+	di.meta = m
+	di.mu.Unlock()
+	dbSizeBytes.set(float64(m.Size), di.mode)
+}
+
+var dbSizeBytes = newGauge("freegeoip_dns_db_size_bytes", "Size of the uncompressed database, held on the heap in memory mode or mapped from disk in mmap mode.", "mode")
+
+// get returns the current metadata, or nil if none was loaded yet.
+func (di *dbInfo) get() *dbMeta {
+	di.mu.RLock()
+	defer di.mu.RUnlock()
+	return di.meta
+}
+
+// ServeHTTP serves the metadata as JSON.
+func (di *dbInfo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := di.get()
+	if m == nil {
+		http.Error(w, "database not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestReadMeta(t *testing.T) {
+	b, err := ioutil.ReadFile(fixtureDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := r.Metadata
+	dir := t.TempDir()
+	gz := filepath.Join(dir, "fixture.mmdb.gz")
+	if err := writeDB(gz, b); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{fixtureDB, gz} {
+		m, err := readMeta(file)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		want := &dbMeta{file, md.DatabaseType, md.BuildEpoch, time.Unix(int64(md.BuildEpoch), 0).UTC(), md.Languages, md.NodeCount, md.IPVersion, md.RecordSize, len(b)}
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("%s: got %+v, want %+v", file, m, want)
+		}
+		if err := verifyDB(file); err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+	}
+
+	// Only the end of files is read, past a search tree of any size.
+	big := append(make([]byte, 1<<20), b...)
+	for _, name := range []string{"big.mmdb", "big.mmdb.gz"} {
+		file := filepath.Join(dir, name)
+		if err := writeDB(file, big); err != nil {
+			t.Fatal(err)
+		}
+		m, err := readMeta(file)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if m.NodeCount != md.NodeCount || m.Size != len(big) {
+			t.Errorf("%s: got %d nodes and %d bytes, want %d and %d", name, m.NodeCount, m.Size, md.NodeCount, len(big))
+		}
+	}
+
+	// A database whose search tree points out of the data section.
+	corrupt := append([]byte(nil), b...)
+	for i := 0; i < 64; i++ {
+		corrupt[i] = 0xff
+	}
+	for _, name := range []string{"corrupt.mmdb", "corrupt.mmdb.gz"} {
+		file := filepath.Join(t.TempDir(), name)
+		if err := writeDB(file, corrupt); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyDB(file); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+		files, _ := filepath.Glob(filepath.Join(filepath.Dir(file), ".download-*"))
+		if len(files) > 0 {
+			t.Errorf("%s: got %v left", name, files)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// registry is a minimal registry of metrics exposed in the Prometheus
+// text format.
+type registry struct {
+	mu      sync.Mutex
+	labels  []string // constant labels added to all metrics, as name="value"
+	metrics []metric
+}
+
+// metric is a metric family written by the registry.
+type metric interface {
+	write(w io.Writer, constLabels []string)
+}
+
+// metrics holds the metrics of the server.
+var metrics = &registry{}
+
+// setLabel adds a constant label to all metrics.
+func (r *registry) setLabel(name, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.labels = append(r.labels, name+"="+strconv.Quote(value))
+}
+
+func (r *registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP writes all metrics.
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	labels := r.labels
+	ms := r.metrics
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range ms {
+		m.write(w, labels)
+	}
+}
+
+// formatLabels returns the label set of a sample.
+func formatLabels(constLabels, names, values []string) string {
+	l := append([]string(nil), constLabels...)
+	for i, n := range names {
+		l = append(l, n+"="+strconv.Quote(values[i]))
+	}
+	if len(l) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(l, ",") + "}"
+}
+
+// vec is a metric family with a value per label set.
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newVec(typ, name, help string, labels []string) *vec {
+	v := &vec{name: name, help: help, typ: typ, labels: labels, values: make(map[string]float64)}
+	metrics.register(v)
+	return v
+}
+
+func (v *vec) key(lvs []string) string {
+	if len(lvs) != len(v.labels) {
+		panic(fmt.Sprintf("%s: got %d label values, want %d", v.name, len(lvs), len(v.labels)))
+	}
+	return strings.Join(lvs, "\xff")
+}
+
+func (v *vec) write(w io.Writer, constLabels []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var lvs []string
+		if len(v.labels) > 0 {
+			lvs = strings.Split(k, "\xff")
+		}
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(constLabels, v.labels, lvs), strconv.FormatFloat(v.values[k], 'g', -1, 64))
+	}
+}
+
+// snapshot returns the current values by label values, joined with ",".
+func (v *vec) snapshot() map[string]float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ret := make(map[string]float64, len(v.values))
+	for k, x := range v.values {
+		ret[strings.Replace(k, "\xff", ",", -1)] = x
+	}
+	return ret
+}
+
+// counter is a monotonically increasing metric.
+type counter struct{ *vec }
+
+// newCounter registers a counter with the given label names.
+func newCounter(name, help string, labels ...string) counter {
+	return counter{newVec("counter", name, help, labels)}
+}
+
+// add adds d to the counter of the given label values.
+func (c counter) add(d float64, lvs ...string) {
+	k := c.key(lvs)
+	c.mu.Lock()
+	c.values[k] += d
+	c.mu.Unlock()
+}
+
+// inc increments the counter of the given label values.
+func (c counter) inc(lvs ...string) { c.add(1, lvs...) }
+
+// gauge is a metric that can go up and down.
+type gauge struct{ *vec }
+
+// newGauge registers a gauge with the given label names.
+func newGauge(name, help string, labels ...string) gauge {
+	return gauge{newVec("gauge", name, help, labels)}
+}
+
+// set sets the gauge of the given label values.
+func (g gauge) set(x float64, lvs ...string) {
+	k := g.key(lvs)
+	g.mu.Lock()
+	g.values[k] = x
+	g.mu.Unlock()
+}
+
+// gaugeFunc is a gauge whose value is computed when written.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// newGaugeFunc registers a gauge computed by fn.
+func newGaugeFunc(name, help string, fn func() float64) {
+	metrics.register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer, constLabels []string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(constLabels, nil, nil), strconv.FormatFloat(g.fn(), 'g', -1, 64))
+}
+
+func init() {
+	newGaugeFunc("freegeoip_dns_heap_inuse_bytes", "Bytes in in-use heap spans.", func() float64 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return float64(ms.HeapInuse)
+	})
+}
+
+// histogram counts observations in buckets, per label set.
+type histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// latencyBuckets are the histogram buckets of query latencies, in
+// seconds, from 10µs to 5s.
+var latencyBuckets = []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// newHistogram registers a histogram with the given buckets and label
+// names.
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	h := &histogram{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+	metrics.register(h)
+	return h
+}
+
+// observe records x for the given label values.
+func (h *histogram) observe(x float64, lvs ...string) {
+	if len(lvs) != len(h.labels) {
+		panic(fmt.Sprintf("%s: got %d label values, want %d", h.name, len(lvs), len(h.labels)))
+	}
+	k := strings.Join(lvs, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[k]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = v
+	}
+	for i, b := range h.buckets {
+		if x <= b {
+			v.counts[i]++
+		}
+	}
+	v.sum += x
+	v.count++
+}
+
+func (h *histogram) write(w io.Writer, constLabels []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var lvs []string
+		if len(h.labels) > 0 {
+			lvs = strings.Split(k, "\xff")
+		}
+		v := h.values[k]
+		names := append(append([]string(nil), h.labels...), "le")
+		for i, b := range h.buckets {
+			le := strconv.FormatFloat(b, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(constLabels, names, append(lvs, le)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(constLabels, names, append(lvs, "+Inf")), v.count)
+		labels := formatLabels(constLabels, h.labels, lvs)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, strconv.FormatFloat(v.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, v.count)
+	}
+}
+
+var (
+	queriesTotal   = newCounter("freegeoip_dns_queries_total", "DNS queries answered, by rcode.", "rcode")
+	queryDuration  = newHistogram("freegeoip_dns_query_duration_seconds", "Time to answer DNS queries.", latencyBuckets)
+	phaseDurations = newHistogram("freegeoip_dns_query_phase_duration_seconds", "Time spent answering geolocation queries, by phase: parse, resolve, lookup or encode.", latencyBuckets, "phase")
+)
@@ -0,0 +1,140 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	mirrorQueueLen = 1024 // max queries waiting to be mirrored
+	mirrorWorkers  = 4    // queries mirrored at once
+)
+
+var mirrorQueries = newCounter("freegeoip_dns_mirror_queries_total", "Queries mirrored to the shadow server, by result: match, diff, error or dropped.", "result")
+
+// mirror duplicates a fraction of the queries to a shadow server, e.g. a
+// new version or one with another database, and logs the answers that
+// differ from ours, to validate upgrades before the cutover. Queries are
+// mirrored in the background and dropped when the shadow can't keep up,
+// never delaying the answers.
+type mirror struct {
+	addr     string // host:port
+	fraction float64
+	client   *dns.Client
+	queue    chan mirrored
+}
+
+// mirrored is a query and our answer to it.
+type mirrored struct {
+	query, answer *dns.Msg
+}
+
+func newMirror(addr string, fraction float64, timeout time.Duration) *mirror {
+	mr := &mirror{
+		addr:     addr,
+		fraction: fraction,
+		client:   &dns.Client{Timeout: timeout},
+		queue:    make(chan mirrored, mirrorQueueLen),
+	}
+	for i := 0; i < mirrorWorkers; i++ {
+		go mr.run()
+	}
+	return mr
+}
+
+// sample reports whether r is to be mirrored. Only queries are, without
+// TSIG, which the shadow can't verify, so as not to send it updates.
+func (mr *mirror) sample(r *dns.Msg) bool {
+	return r.Opcode == dns.OpcodeQuery && r.IsTsig() == nil && rand.Float64() < mr.fraction
+}
+
+// writer returns a dns.ResponseWriter writing to w and mirroring r with
+// the answer written.
+func (mr *mirror) writer(w dns.ResponseWriter, r *dns.Msg) dns.ResponseWriter {
+	return &mirrorWriter{ResponseWriter: w, mirror: mr, query: r.Copy()}
+}
+
+// mirrorWriter is the dns.ResponseWriter of the mirrored queries.
+type mirrorWriter struct {
+	dns.ResponseWriter
+	mirror *mirror
+	query  *dns.Msg
+}
+
+func (w *mirrorWriter) WriteMsg(m *dns.Msg) error {
+	w.enqueue(m.Copy())
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Write mirrors the answers packed by the fast lane.
+func (w *mirrorWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err == nil {
+		w.enqueue(m)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *mirrorWriter) enqueue(m *dns.Msg) {
+	select {
+	case w.mirror.queue <- mirrored{query: w.query, answer: m}:
+	default:
+		mirrorQueries.inc("dropped")
+	}
+}
+
+// ConnectionState passes the TLS state of w through, for padding.
+func (w *mirrorWriter) ConnectionState() *tls.ConnectionState {
+	if cs, ok := w.ResponseWriter.(dns.ConnectionStater); ok {
+		return cs.ConnectionState()
+	}
+	return nil
+}
+
+// run sends the queued queries to the shadow and compares its answers.
+func (mr *mirror) run() {
+	for q := range mr.queue {
+		r, _, err := mr.client.Exchange(q.query, mr.addr)
+		if err != nil {
+			mirrorQueries.inc("error")
+			continue
+		}
+		local, shadow := answerSummary(q.answer), answerSummary(r)
+		if local == shadow {
+			mirrorQueries.inc("match")
+			continue
+		}
+		mirrorQueries.inc("diff")
+		name, qtype := "-", "-"
+		if len(q.query.Question) > 0 {
+			name, qtype = q.query.Question[0].Name, dns.TypeToString[q.query.Question[0].Qtype]
+		}
+		log.Printf("MIRROR diff name=%s type=%s local=%q shadow=%q", name, qtype, local, shadow)
+	}
+}
+
+// answerSummary returns the rcode and the sorted answer records of m,
+// without their TTLs, which the comparisons of answers are made on.
+// Authority and additional records, like the NSID of the server, are
+// left out.
+func answerSummary(m *dns.Msg) string {
+	rrs := make([]string, 0, len(m.Answer))
+	for _, rr := range m.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rrs = append(rrs, rr.String())
+	}
+	sort.Strings(rrs)
+	return strings.Join(append([]string{dns.RcodeToString[m.Rcode]}, rrs...), "; ")
+}
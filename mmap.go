@@ -0,0 +1,124 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// openMmap opens the database at dsn, a file or URL, with mmap. Gzipped
+// databases are uncompressed next to the original file first. It returns
+// the reader and the name of the file mapped.
+func openMmap(dsn string, opts dbOptions) (*maxminddb.Reader, string, error) {
+	file := dsn
+	if isURL(dsn) {
+		d, err := localCopy(dsn, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		file = d.file
+	}
+	plain, err := uncompress(file)
+	if err != nil {
+		return nil, "", err
+	}
+	mm, err := maxminddb.Open(plain)
+	return mm, plain, err
+}
+
+// isGzip reports whether the named file is gzipped.
+func isGzip(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	if _, err = io.ReadFull(f, magic); err != nil {
+		return false, nil
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// uncompress returns the name of an uncompressed copy of file, which is
+// file itself if not gzipped. The copy is recreated when older than file,
+// and replaced atomically so that existing mappings of the old copy stay
+// valid.
+func uncompress(file string) (string, error) {
+	gz, err := isGzip(file)
+	if err != nil || !gz {
+		return file, err
+	}
+	plain := strings.TrimSuffix(file, ".gz")
+	if plain == file {
+		plain = file + ".mmdb"
+	}
+	src, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if dst, err := os.Stat(plain); err == nil && !dst.ModTime().Before(src.ModTime()) {
+		return plain, nil
+	}
+	tmp, err := gunzipTemp(file, filepath.Dir(plain))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	return plain, os.Rename(tmp, plain)
+}
+
+// gunzipTemp uncompresses the gzipped file to a new temporary file in
+// dir, and returns its name.
+func gunzipTemp(file, dir string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(dir, ".download-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, zr)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// watchFile starts the task calling onChange when the modification time
+// of file changes, checking every intvl, until done is closed.
+func watchFile(file string, intvl time.Duration, done <-chan struct{}, onChange func()) {
+	st, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	mod := st.ModTime()
+	tasks.start(&task{name: "db-watch", intvl: intvl, done: done, run: func() error {
+		if st, err := os.Stat(file); err == nil && !st.ModTime().Equal(mod) {
+			mod = st.ModTime()
+			onChange()
+		}
+		return nil
+	}})
+}
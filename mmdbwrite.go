@@ -0,0 +1,266 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// mmdbMetadataStart marks the start of the metadata of mmdb files.
+const mmdbMetadataStart = "\xab\xcd\xefMaxMind.com"
+
+// mmdbWriter builds an IPv6 mmdb file, in the MaxMind DB format 2.0,
+// with 32 bit records. IPv4 networks are stored in ::/96, where readers
+// look them up.
+type mmdbWriter struct {
+	dbType      string
+	description string
+	languages   []string
+	root        *mmdbNode
+	records     []string       // encoded records, by data index - 1
+	index       map[string]int // data index by encoded record
+}
+
+// mmdbNode is a node of the search tree: a leaf, without children, with
+// the data index of its record, 0 if none, or an inner node.
+type mmdbNode struct {
+	child [2]*mmdbNode
+	data  int
+	id    uint32
+}
+
+func (n *mmdbNode) leaf() bool { return n.child[0] == nil }
+
+// split makes the leaf n an inner node whose children have its record.
+func (n *mmdbNode) split() {
+	n.child[0], n.child[1] = &mmdbNode{data: n.data}, &mmdbNode{data: n.data}
+	n.data = 0
+}
+
+func newMMDBWriter(dbType, description string, languages []string) *mmdbWriter {
+	return &mmdbWriter{
+		dbType:      dbType,
+		description: description,
+		languages:   languages,
+		root:        &mmdbNode{},
+		index:       make(map[string]int),
+	}
+}
+
+// insert sets the record of network, replacing that of the addresses of
+// network already inserted. Networks are best inserted from the least to
+// the most specific.
+func (mw *mmdbWriter) insert(network *net.IPNet, record map[string]interface{}) {
+	var b bytes.Buffer
+	encodeMMDB(&b, record)
+	data, ok := mw.index[b.String()]
+	if !ok {
+		mw.records = append(mw.records, b.String())
+		data = len(mw.records)
+		mw.index[b.String()] = data
+	}
+	ip, bits := network.IP.To16(), 128
+	ones, size := network.Mask.Size()
+	if v4 := network.IP.To4(); v4 != nil && size == 32 {
+		ip = append(make(net.IP, 12), v4...)
+		ones += 96
+	}
+	n := mw.root
+	for i := 0; i < ones && i < bits; i++ {
+		if n.leaf() {
+			n.split()
+		}
+		n = n.child[ip[i/8]>>(7-uint(i%8))&1]
+	}
+	n.child = [2]*mmdbNode{}
+	n.data = data
+}
+
+// merge replaces the inner nodes whose leaves all have the same record
+// by a leaf.
+func merge(n *mmdbNode) {
+	if n.leaf() {
+		return
+	}
+	merge(n.child[0])
+	merge(n.child[1])
+	if l, r := n.child[0], n.child[1]; l.leaf() && r.leaf() && l.data == r.data {
+		n.child = [2]*mmdbNode{}
+		n.data = l.data
+	}
+}
+
+// WriteTo writes the database to w.
+func (mw *mmdbWriter) WriteTo(w io.Writer) (int64, error) {
+	merge(mw.root)
+	if mw.root.leaf() {
+		// The tree needs at least a node.
+		mw.root.split()
+	}
+	var nodes []*mmdbNode
+	for queue := []*mmdbNode{mw.root}; len(queue) > 0; queue = queue[1:] {
+		n := queue[0]
+		n.id = uint32(len(nodes))
+		nodes = append(nodes, n)
+		for _, c := range n.child {
+			if !c.leaf() {
+				queue = append(queue, c)
+			}
+		}
+	}
+	nodeCount := uint32(len(nodes))
+	offsets := make([]uint32, len(mw.records)+1)
+	var data bytes.Buffer
+	for i, rec := range mw.records {
+		offsets[i+1] = uint32(data.Len())
+		data.WriteString(rec)
+	}
+	if uint64(nodeCount)+16+uint64(data.Len()) > math.MaxUint32 {
+		return 0, fmt.Errorf("database too large for 32 bit records")
+	}
+
+	var b bytes.Buffer
+	rec := make([]byte, 4)
+	for _, n := range nodes {
+		for _, c := range n.child {
+			v := nodeCount // no data
+			switch {
+			case !c.leaf():
+				v = c.id
+			case c.data > 0:
+				v = nodeCount + 16 + offsets[c.data]
+			}
+			binary.BigEndian.PutUint32(rec, v)
+			b.Write(rec)
+		}
+	}
+	b.Write(make([]byte, 16))
+	data.WriteTo(&b)
+	b.WriteString(mmdbMetadataStart)
+	langs := make([]interface{}, len(mw.languages))
+	for i, l := range mw.languages {
+		langs[i] = l
+	}
+	encodeMMDB(&b, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 buildEpoch(),
+		"database_type":               mw.dbType,
+		"description":                 map[string]interface{}{"en": mw.description},
+		"ip_version":                  uint16(6),
+		"languages":                   langs,
+		"node_count":                  nodeCount,
+		"record_size":                 uint16(32),
+	})
+	return b.WriteTo(w)
+}
+
+// buildEpoch returns the build time of the databases written: now, or
+// $SOURCE_DATE_EPOCH if set, for reproducible builds.
+func buildEpoch() uint64 {
+	if v, err := strconv.ParseUint(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return v
+	}
+	return uint64(time.Now().Unix())
+}
+
+// mmdb data types.
+const (
+	mmdbString = 2
+	mmdbDouble = 3
+	mmdbUint16 = 5
+	mmdbUint32 = 6
+	mmdbMap    = 7
+	mmdbUint64 = 9
+	mmdbArray  = 11
+)
+
+// encodeMMDB appends v to b in the mmdb data format. Maps are written
+// with sorted keys, so that equal records are encoded the same.
+func encodeMMDB(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		writeControl(b, mmdbString, len(v))
+		b.WriteString(v)
+	case float64:
+		writeControl(b, mmdbDouble, 8)
+		binary.Write(b, binary.BigEndian, v)
+	case uint16:
+		writeUint(b, mmdbUint16, uint64(v))
+	case uint32:
+		writeUint(b, mmdbUint32, uint64(v))
+	case uint64:
+		writeUint(b, mmdbUint64, v)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeControl(b, mmdbMap, len(v))
+		for _, k := range keys {
+			encodeMMDB(b, k)
+			encodeMMDB(b, v[k])
+		}
+	case []interface{}:
+		writeControl(b, mmdbArray, len(v))
+		for _, x := range v {
+			encodeMMDB(b, x)
+		}
+	default:
+		panic(fmt.Sprintf("mmdb: unsupported type %T", v))
+	}
+}
+
+// writeUint writes x with as few bytes as needed.
+func writeUint(b *bytes.Buffer, typ int, x uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	i := 0
+	for i < 8 && buf[i] == 0 {
+		i++
+	}
+	writeControl(b, typ, 8-i)
+	b.Write(buf[i:])
+}
+
+// writeControl writes the control byte of a field of type typ and the
+// given size, followed by the extended type and size bytes, if any.
+func writeControl(b *bytes.Buffer, typ, size int) {
+	var ctrl byte
+	if typ <= 7 {
+		ctrl = byte(typ) << 5
+	}
+	var extra []byte
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 29+256:
+		ctrl |= 29
+		extra = []byte{byte(size - 29)}
+	case size < 285+65536:
+		ctrl |= 30
+		extra = []byte{byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		ctrl |= 31
+		s := size - 65821
+		extra = []byte{byte(s >> 16), byte(s >> 8), byte(s)}
+	}
+	b.WriteByte(ctrl)
+	if typ > 7 {
+		b.WriteByte(byte(typ - 7))
+	}
+	b.Write(extra)
+}
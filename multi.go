@@ -0,0 +1,121 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	maxQuestions = 16 // max questions in a message
+	maxFanout    = 4  // max questions of a message answered at once
+)
+
+// acceptMsg is the dns.MsgAcceptFunc of the server. On top of what the
+// dns package accepts, it accepts queries with up to maxQuestions
+// questions, and the UPDATE messages of acceptUpdate.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&(1<<15) != 0 { // response
+		return dns.MsgIgnore
+	}
+	switch int(dh.Bits>>11) & 0xF {
+	case dns.OpcodeUpdate:
+		return acceptUpdate(dh)
+	case dns.OpcodeQuery:
+		if dh.Qdcount > 1 && dh.Qdcount <= maxQuestions {
+			dh.Qdcount = 1
+		}
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// captureWriter is a dns.ResponseWriter keeping the message written
+// instead of sending it.
+type captureWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *captureWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// questions answers each question of a message with several on its own,
+// up to maxFanout at once, and writes the combined answer. Its rcode is
+// the first error rcode among the answers, if any, and it has their
+// extended errors.
+func (h *handle) questions(start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) > maxQuestions {
+		h.fail(dns.RcodeFormatError, start, w, r)
+		return
+	}
+	answers := make([]*dns.Msg, len(r.Question))
+	sem := make(chan struct{}, maxFanout)
+	var wg sync.WaitGroup
+	for i, q := range r.Question {
+		sub := new(dns.Msg)
+		sub.MsgHdr = r.MsgHdr
+		sub.Question = []dns.Question{q}
+		if opt := r.IsEdns0(); opt != nil {
+			sub.Extra = []dns.RR{opt}
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			cw := &captureWriter{ResponseWriter: w}
+			h.question(start, cw, sub)
+			answers[i] = cw.msg
+		}(i)
+	}
+	wg.Wait()
+
+	m := h.reply(r)
+	m.Question = r.Question
+	m.Authoritative = true
+	var extra []dns.EDNS0
+	// The ECS scope of the answer is the largest of the answers.
+	var ecs *dns.EDNS0_SUBNET
+	for _, a := range answers {
+		if a == nil {
+			continue
+		}
+		if m.Rcode == dns.RcodeSuccess {
+			m.Rcode = a.Rcode
+		}
+		m.Authoritative = m.Authoritative && a.Authoritative
+		m.Answer = append(m.Answer, a.Answer...)
+		if len(m.Ns) == 0 {
+			m.Ns = a.Ns
+		}
+		for _, rr := range a.Extra {
+			opt, ok := rr.(*dns.OPT)
+			if !ok {
+				m.Extra = append(m.Extra, rr)
+				continue
+			}
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+					if ecs == nil || e.SourceScope > ecs.SourceScope {
+						ecs = e
+					}
+					continue
+				}
+				if c := o.Option(); c != dns.EDNS0NSID && c != dns.EDNS0PADDING {
+					extra = append(extra, o)
+				}
+			}
+		}
+	}
+	if ecs != nil {
+		extra = append(extra, ecs)
+	}
+	h.finish(m, w, r, extra...)
+}
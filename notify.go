@@ -0,0 +1,38 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// notify handles DNS NOTIFY messages by reloading the database. NOTIFY is
+// accepted from the addresses allowed by -notify-allow or with a valid
+// TSIG signature.
+func (h *handle) notify(start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	tsig := r.IsTsig()
+	allowed := h.notifyACL != nil && h.notifyACL.contains(clientIP(w))
+	signed := tsig != nil && w.TsigStatus() == nil
+	if !allowed && !signed {
+		h.refuse(refuseNotify, start, w, r)
+		return
+	}
+	m := h.reply(r)
+	m.Authoritative = true
+	h.write(m, start, w, r)
+
+	go func() {
+		if !h.silent {
+			log.Println("database reload requested by NOTIFY from", clientIP(w))
+		}
+		if err := h.db.reload(); err != nil {
+			log.Println("database reload:", err)
+		}
+	}()
+}
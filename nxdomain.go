@@ -0,0 +1,85 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mvrilo/freegeoip-dns/events"
+)
+
+// nxCause is the cause of a NXDOMAIN answer. Like deny reasons, the
+// values are stable: they are counted, logged and set in query error
+// events, so that operators can tell attacks from client bugs and
+// configuration errors.
+type nxCause string
+
+// NXDOMAIN causes.
+const (
+	nxOutOfZone       nxCause = "out-of-zone"      // name not under the domain
+	nxInvalidName     nxCause = "invalid-name"     // not a valid hostname
+	nxBadEncoding     nxCause = "bad-encoding"     // meant as an IP, but not one
+	nxUnresolvable    nxCause = "unresolvable"     // hostname not found
+	nxResolverFailure nxCause = "resolver-failure" // every resolver failed
+	nxUnsupportedType nxCause = "unsupported-type" // -unsupported-rcode nxdomain
+	nxUnknownName     nxCause = "unknown-name"     // unknown admin or CHAOS name
+)
+
+var nxdomainQueries = newCounter("freegeoip_dns_nxdomain_total", "Queries answered NXDOMAIN, by cause.", "cause")
+
+// nxdomain answers NXDOMAIN, writing a line with its cause to the log,
+// unless silent, in the format
+//
+//	NXDOMAIN cause=<cause> client=<ip> name=<name>
+func (h *handle) nxdomain(cause nxCause, start time.Time, w dns.ResponseWriter, r *dns.Msg, extra ...dns.EDNS0) {
+	if !h.silent {
+		client := "-"
+		if !h.privacy {
+			client = clientIP(w).String()
+		}
+		log.Printf("NXDOMAIN cause=%s client=%s name=%s\n", cause, client, r.Question[0].Name)
+	}
+	nxdomainQueries.inc(string(cause))
+	events.Default.EmitError(events.Error{Query: h.eventQuery(start, w, r), Rcode: dns.RcodeNameError, Reason: failReason(extra), Cause: string(cause)})
+	h.failed(dns.RcodeNameError, start, w, r, extra...)
+}
+
+// resolveFail answers the queryIP error err for name, in domain.
+func (h *handle) resolveFail(err error, name, domain string, start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	if rcode := resolveError(err); rcode != dns.RcodeNameError {
+		h.fail(rcode, start, w, r, resolveEDE(err))
+		return
+	}
+	h.nxdomain(resolveCause(err, name, domain), start, w, r, resolveEDE(err))
+}
+
+// resolveCause returns the cause of the queryIP error err for name, in
+// domain, answered NXDOMAIN.
+func resolveCause(err error, name, domain string) nxCause {
+	host, ok := stripDomain(name, domain)
+	switch {
+	case !ok:
+		return nxOutOfZone
+	case err == errInvalidName:
+		return nxInvalidName
+	case err == errResolveFailed:
+		return nxResolverFailure
+	case meantAsIP(host):
+		return nxBadEncoding
+	}
+	return nxUnresolvable
+}
+
+// meantAsIP reports whether the hostname h, not an IP, is likely a
+// mistyped or badly encoded one: dotted decimal labels, like 10.0.0.256,
+// a name with colons, or a single label, which is either an IP label
+// encoding or a top level domain without addresses.
+func meantAsIP(h string) bool {
+	return strings.Trim(h, "0123456789.") == "" || strings.IndexByte(h, ':') >= 0 || strings.IndexByte(h, '.') < 0
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// OTLP severity numbers.
+const (
+	otlpInfo = 9
+	otlpWarn = 13
+)
+
+var otlpRecords = newCounter("freegeoip_dns_otlp_log_records_total", "Log records exported with OTLP, by result: sent, dropped or error.", "result")
+
+// otlpLogger logs the errors of the exporter, which can't go through the
+// log package it exports.
+var otlpLogger = log.New(os.Stderr, "", log.LstdFlags)
+
+// otlpRecord is an OTLP log record.
+type otlpRecord struct {
+	TimeUnixNano   string     `json:"timeUnixNano"`
+	SeverityNumber int        `json:"severityNumber"`
+	SeverityText   string     `json:"severityText"`
+	Body           otlpValue  `json:"body"`
+	Attributes     []otlpAttr `json:"attributes,omitempty"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64 as a string in OTLP JSON
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpString(k, v string) otlpAttr { return otlpAttr{k, otlpValue{StringValue: &v}} }
+
+func otlpInt(k string, v int64) otlpAttr {
+	s := strconv.FormatInt(v, 10)
+	return otlpAttr{k, otlpValue{IntValue: &s}}
+}
+
+// otlpExporter exports the server log lines and a record for every
+// answer to an OpenTelemetry collector, with OTLP/HTTP in JSON. Records
+// are batched like access log rows, and dropped when the collector can't
+// keep up.
+type otlpExporter struct {
+	url      string
+	resource []otlpAttr
+	queue    chan otlpRecord
+}
+
+// newOTLPExporter returns the exporter to the collector at endpoint,
+// e.g. http://127.0.0.1:4318.
+func newOTLPExporter(endpoint, instance string) *otlpExporter {
+	e := &otlpExporter{
+		url:      strings.TrimSuffix(endpoint, "/") + "/v1/logs",
+		resource: []otlpAttr{otlpString("service.name", "freegeoip-dns"), otlpString("service.version", VERSION)},
+		queue:    make(chan otlpRecord, sinkQueueLen),
+	}
+	if instance != "" {
+		e.resource = append(e.resource, otlpString("service.instance.id", instance))
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) enqueue(r otlpRecord) {
+	select {
+	case e.queue <- r:
+	default:
+		otlpRecords.inc("dropped")
+	}
+}
+
+// Write exports the log lines in p, so that the exporter can be used as
+// output of the log package.
+func (e *otlpExporter) Write(p []byte) (int, error) {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		sev, text := otlpInfo, "INFO"
+		if strings.Contains(line, "WARNING") || strings.Contains(line, "error") {
+			sev, text = otlpWarn, "WARN"
+		}
+		e.enqueue(otlpRecord{TimeUnixNano: now, SeverityNumber: sev, SeverityText: text, Body: otlpValue{StringValue: &line}})
+	}
+	return len(p), nil
+}
+
+// exportAnswers exports a record for every answer.
+func (e *otlpExporter) exportAnswers() {
+	queue := answerQueue(sinkQueueLen, otlpRecords)
+	go func() {
+		for a := range queue {
+			ev := newQueryEvent(a)
+			sev, text := otlpInfo, "INFO"
+			if a.Rcode == dns.RcodeServerFailure {
+				sev, text = otlpWarn, "WARN"
+			}
+			body := "query"
+			rec := otlpRecord{
+				TimeUnixNano:   strconv.FormatInt(ev.Time.UnixNano(), 10),
+				SeverityNumber: sev,
+				SeverityText:   text,
+				Body:           otlpValue{StringValue: &body},
+				Attributes: []otlpAttr{
+					otlpString("dns.question.name", ev.Name),
+					otlpString("dns.question.type", ev.Type),
+					otlpString("dns.response_code", ev.Rcode),
+					otlpString("geo.ip", ev.IP),
+					otlpString("geo.country", ev.Country),
+					otlpInt("latency_us", ev.LatencyUs),
+				},
+			}
+			if ev.Client != "" {
+				rec.Attributes = append(rec.Attributes, otlpString("client.address", ev.Client))
+			}
+			e.enqueue(rec)
+		}
+	}()
+}
+
+func (e *otlpExporter) run() {
+	var batch []otlpRecord
+	tick := time.NewTicker(sinkFlushIntvl)
+	for {
+		select {
+		case r := <-e.queue:
+			if batch = append(batch, r); len(batch) < sinkBatchLen {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := e.send(batch); err != nil {
+			otlpRecords.add(float64(len(batch)), "error")
+			otlpLogger.Println("otlp:", err)
+		} else {
+			otlpRecords.add(float64(len(batch)), "sent")
+		}
+		batch = batch[:0]
+	}
+}
+
+// send posts the records to the collector.
+func (e *otlpExporter) send(records []otlpRecord) error {
+	type scope struct {
+		Name string `json:"name"`
+	}
+	type scopeLogs struct {
+		Scope      scope        `json:"scope"`
+		LogRecords []otlpRecord `json:"logRecords"`
+	}
+	type resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	type resourceLogs struct {
+		Resource  resource    `json:"resource"`
+		ScopeLogs []scopeLogs `json:"scopeLogs"`
+	}
+	body := struct {
+		ResourceLogs []resourceLogs `json:"resourceLogs"`
+	}{[]resourceLogs{{
+		Resource:  resource{e.resource},
+		ScopeLogs: []scopeLogs{{Scope: scope{"freegeoip-dns"}, LogRecords: records}},
+	}}}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := sinkClient.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp)
+}
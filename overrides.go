@@ -0,0 +1,198 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// overrides are response field corrections for IPs and CIDRs, managed
+// with DNS UPDATE messages.
+type overrides struct {
+	mu     sync.RWMutex
+	fields map[string]map[string]string // cidr -> field name -> value
+	table  *prefixTable                 // cidr -> cidr
+}
+
+func newOverrides() *overrides {
+	return &overrides{
+		fields: make(map[string]map[string]string),
+		table:  newPrefixTable(),
+	}
+}
+
+// rebuild rebuilds the lookup table. Called with the lock held.
+func (o *overrides) rebuild() {
+	t := newPrefixTable()
+	for cidr := range o.fields {
+		n, _ := parseCIDR(cidr)
+		t.insert(n, cidr)
+	}
+	o.table = t
+}
+
+// apply replaces the values of fields overridden for ip, and appends the
+// overridden fields not present in the response.
+func (o *overrides) apply(ip net.IP, fields []field) []field {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	cidr, ok := o.table.lookup(ip)
+	if !ok {
+		return fields
+	}
+	return setFields(fields, o.fields[cidr])
+}
+
+// setFields replaces the values of the fields in set, and appends those
+// not present in fields.
+func setFields(fields []field, set map[string]string) []field {
+	found := make(map[string]bool)
+	for i := range fields {
+		if v, ok := set[fields[i].name]; ok {
+			fields[i].value = v
+			found[fields[i].name] = true
+		}
+	}
+	for name, v := range set {
+		if !found[name] {
+			fields = append(fields, extraField(name, v))
+		}
+	}
+	return fields
+}
+
+// overrideOp is a single change of an UPDATE message.
+type overrideOp struct {
+	cidr   string
+	del    bool
+	fields map[string]string // nil deletes all fields
+}
+
+// parseUpdate validates the update section of r, sent for zone domain,
+// and returns its changes. It returns the rcode to answer on failure.
+func parseUpdate(r *dns.Msg, domain string) ([]overrideOp, int) {
+	zone := dns.Fqdn(domain)
+	var ops []overrideOp
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone, hdr.Name) || dns.CountLabel(hdr.Name) == dns.CountLabel(zone) {
+			return nil, dns.RcodeNotZone
+		}
+		label := strings.TrimSuffix(strings.TrimSuffix(hdr.Name, zone), ".")
+		n, err := parseCIDR(label)
+		if err != nil {
+			return nil, dns.RcodeFormatError
+		}
+		op := overrideOp{cidr: n.String()}
+		switch hdr.Class {
+		case dns.ClassINET:
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				return nil, dns.RcodeRefused
+			}
+			if op.fields, err = parseOverrideFields(txt.Txt); err != nil {
+				return nil, dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if hdr.Rrtype != dns.TypeTXT && hdr.Rrtype != dns.TypeANY {
+				return nil, dns.RcodeRefused
+			}
+			op.del = true
+		case dns.ClassNONE:
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				return nil, dns.RcodeRefused
+			}
+			if op.fields, err = parseOverrideFields(txt.Txt); err != nil {
+				return nil, dns.RcodeFormatError
+			}
+			op.del = true
+		default:
+			return nil, dns.RcodeFormatError
+		}
+		ops = append(ops, op)
+	}
+	return ops, dns.RcodeSuccess
+}
+
+// parseOverrideFields parses TXT strings in the form name=value.
+func parseOverrideFields(txt []string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, s := range txt {
+		p := strings.SplitN(s, "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return nil, fmt.Errorf("invalid override %q, want name=value", s)
+		}
+		fields[p[0]] = p[1]
+	}
+	return fields, nil
+}
+
+// update applies ops atomically.
+func (o *overrides) update(ops []overrideOp) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, op := range ops {
+		switch {
+		case op.del && op.fields == nil:
+			delete(o.fields, op.cidr)
+		case op.del:
+			for name := range op.fields {
+				delete(o.fields[op.cidr], name)
+			}
+			if len(o.fields[op.cidr]) == 0 {
+				delete(o.fields, op.cidr)
+			}
+		default:
+			if o.fields[op.cidr] == nil {
+				o.fields[op.cidr] = make(map[string]string)
+			}
+			for name, v := range op.fields {
+				o.fields[op.cidr][name] = v
+			}
+		}
+	}
+	o.rebuild()
+}
+
+// acceptUpdate returns what the server does with the UPDATE message of
+// header dh. The dns package answers NOTIMP to every opcode but QUERY
+// and NOTIFY, so UPDATE messages for a single zone are let through to
+// update, which authenticates them.
+func acceptUpdate(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Qdcount != 1 {
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+// update handles RFC 2136 UPDATE messages. Only TSIG signed updates are
+// accepted; prerequisites are not supported.
+func (h *handle) update(start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	tsig := r.IsTsig()
+	if h.overrides == nil || tsig == nil {
+		h.refuse(refuseUnsignedUpdate, start, w, r)
+		return
+	}
+	m := h.reply(r)
+	if w.TsigStatus() != nil {
+		m.Rcode = dns.RcodeNotAuth
+	} else if len(r.Answer) > 0 {
+		m.Rcode = dns.RcodeNotImplemented
+	} else {
+		var ops []overrideOp
+		if ops, m.Rcode = parseUpdate(r, h.domain); m.Rcode == dns.RcodeSuccess {
+			h.overrides.update(ops)
+		}
+	}
+	h.write(m, start, w, r)
+}
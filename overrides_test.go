@@ -0,0 +1,56 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// updateMsg returns an UPDATE of testDomain adding the TXT record rr.
+func updateMsg(t *testing.T, rr string) *dns.Msg {
+	t.Helper()
+	add, err := dns.NewRR(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(testDomain + ".")
+	m.Insert([]dns.RR{add})
+	return m
+}
+
+func TestUpdate(t *testing.T) {
+	secret := map[string]string{"update.": "c2VjcmV0"}
+	h := newTestHandle(t, fixtureDB)
+	h.overrides = newOverrides()
+	addr := startServer(t, h, secret)
+
+	m := updateMsg(t, `8.8.8.0/24.`+testDomain+`. 0 IN TXT "country_code=BR" "city=Sao Paulo"`)
+	m.SetTsig("update.", dns.HmacSHA256, 300, time.Now().Unix())
+	c := &dns.Client{Net: "udp", TsigSecret: secret, Timeout: 2 * time.Second}
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("signed UPDATE: got rcode %s, want NOERROR", dns.RcodeToString[r.Rcode])
+	}
+	got := answerText(t, exchange(t, addr, "udp", txtQuery("8.8.8.8")))
+	for _, s := range []string{"BR", "Sao Paulo"} {
+		if !strings.Contains(got, s) {
+			t.Errorf("after the UPDATE: got %q, want it to contain %q", got, s)
+		}
+	}
+
+	m = updateMsg(t, `8.8.8.0/24.`+testDomain+`. 0 IN TXT "city=Nowhere"`)
+	if r := exchange(t, addr, "udp", m); r.Rcode != dns.RcodeRefused {
+		t.Errorf("unsigned UPDATE: got rcode %s, want REFUSED", dns.RcodeToString[r.Rcode])
+	}
+}
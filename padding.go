@@ -0,0 +1,46 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// defaultPaddingBlock is the block size responses are padded to, as
+// recommended by RFC 8467.
+const defaultPaddingBlock = 468
+
+// encrypted reports whether w is a connection over TLS.
+func encrypted(w dns.ResponseWriter) bool {
+	cs, ok := w.(dns.ConnectionStater)
+	return ok && cs.ConnectionState() != nil
+}
+
+// wantsPadding reports whether the query with opt has a Padding option,
+// which servers must not send otherwise (RFC 7830 4).
+func wantsPadding(opt *dns.OPT) bool {
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
+
+// pad adds a Padding option to the OPT record o of m so that the size of
+// m is a multiple of the padding block, if enabled and r asked for it
+// over an encrypted transport. This keeps the answer size from telling
+// which location was returned.
+func (h *handle) pad(m *dns.Msg, o *dns.OPT, w dns.ResponseWriter, r *dns.Msg) {
+	if h.paddingBlock <= 0 || !wantsPadding(r.IsEdns0()) || !encrypted(w) {
+		return
+	}
+	p := &dns.EDNS0_PADDING{}
+	o.Option = append(o.Option, p)
+	if n := m.Len() % h.paddingBlock; n > 0 {
+		p.Padding = make([]byte, h.paddingBlock-n)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rawExchange sends m to addr over network, udp or tcp-tls, and returns
+// the reply as received, packed and unpacked.
+func rawExchange(t *testing.T, addr, network string, cfg *tls.Config, m *dns.Msg) ([]byte, *dns.Msg) {
+	t.Helper()
+	c := &dns.Client{Net: network, TLSConfig: cfg, Timeout: 2 * time.Second}
+	co, err := c.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer co.Close()
+	co.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := co.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	b, err := co.ReadMsgHeader(&dns.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	return b, r
+}
+
+// paddingOption returns the Padding option of r, if any.
+func paddingOption(r *dns.Msg) *dns.EDNS0_PADDING {
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if p, ok := o.(*dns.EDNS0_PADDING); ok {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// paddedQuery returns a TXT query for ip with EDNS, and with a Padding
+// option if padded.
+func paddedQuery(ip string, padded bool) *dns.Msg {
+	m := txtQuery(ip)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	if padded {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+	}
+	return m
+}
+
+func TestPadding(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		h := newTestHandle(t, fixtureDB)
+		h.paddingBlock = defaultPaddingBlock
+		if fast {
+			if h.fast = h.newFastLane(); h.fast == nil {
+				t.Fatal("the fast lane is off")
+			}
+		}
+		udp := startServer(t, h, nil)
+		dot, cfg := startTLSServer(t, h, defaultStreamLimits)
+
+		for _, ip := range []string{"8.8.8.8", "2001:db8:1::1", "203.0.113.9"} {
+			b, r := rawExchange(t, dot, "tcp-tls", cfg, paddedQuery(ip, true))
+			if paddingOption(r) == nil {
+				t.Errorf("fast=%v %s over TLS: got no Padding option", fast, ip)
+			} else if len(b)%defaultPaddingBlock != 0 {
+				t.Errorf("fast=%v %s over TLS: got %d bytes, want a multiple of %d", fast, ip, len(b), defaultPaddingBlock)
+			}
+			if answerText(t, r) == "" {
+				t.Errorf("fast=%v %s over TLS: got an empty answer", fast, ip)
+			}
+
+			// Padding is only sent when asked for, and only over TLS.
+			if _, r := rawExchange(t, dot, "tcp-tls", cfg, paddedQuery(ip, false)); paddingOption(r) != nil {
+				t.Errorf("fast=%v %s over TLS without the option in the query: got a Padding option", fast, ip)
+			}
+			if _, r := rawExchange(t, udp, "udp", nil, paddedQuery(ip, true)); paddingOption(r) != nil {
+				t.Errorf("fast=%v %s over UDP: got a Padding option", fast, ip)
+			}
+		}
+	}
+}
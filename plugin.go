@@ -0,0 +1,280 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// pluginTimeout bounds the time of a plugin call.
+const pluginTimeout = 50 * time.Millisecond
+
+var pluginErrors = newCounter("freegeoip_dns_plugin_errors_total", "Failed plugin calls, by plugin.", "plugin")
+
+// plugin is a sandboxed WebAssembly module customizing the server. The
+// module exports its memory and
+//
+//	alloc(size i32) i32
+//
+// returning a buffer of size bytes for the input of its calls, and any
+// of the following functions, taking the JSON input at ptr with length
+// len:
+//
+//	allow(ptr, len i32) i32    access policy for {"client", "name", "type"}:
+//	                           non-zero to answer, zero to refuse
+//	enrich(ptr, len i32) i64   enricher for {"ip", "client", "fields"}: returns
+//	                           a JSON object of fields to set, or 0
+//	format(ptr, len i32) i64   formatter for {"fields": [{"name", "value"}]}:
+//	                           returns the response string
+//
+// Results are returned as the pointer to the output in the upper 32 bits
+// and its length in the lower 32 bits. WASI is available to modules, e.g.
+// built with TinyGo or Rust; reactor modules are initialized with their
+// _initialize function. Calls to a module are serialized. A failed call,
+// e.g. terminated at the timeout, closes the instance of the module, and
+// the next call runs in a new one.
+type plugin struct {
+	name     string
+	rt       wazero.Runtime
+	compiled wazero.CompiledModule
+	cfg      wazero.ModuleConfig
+	// allow, enrich and format are whether the module exports them.
+	allow, enrich, format bool
+
+	mu  sync.Mutex
+	mod api.Module // nil or closed after a failed call
+	err error      // of the last instantiation
+}
+
+// loadPlugin compiles and instantiates the module in file.
+func loadPlugin(ctx context.Context, rt wazero.Runtime, file string) (*plugin, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := rt.CompileModule(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", file, err)
+	}
+	exports := compiled.ExportedFunctions()
+	if _, ok := exports["alloc"]; !ok {
+		return nil, fmt.Errorf("plugin %s: alloc or memory not exported", file)
+	}
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	p := &plugin{
+		name:     name,
+		rt:       rt,
+		compiled: compiled,
+		cfg:      wazero.NewModuleConfig().WithName(name).WithStartFunctions("_initialize").WithStderr(os.Stderr),
+	}
+	_, p.allow = exports["allow"]
+	_, p.enrich = exports["enrich"]
+	_, p.format = exports["format"]
+	if !p.allow && !p.enrich && !p.format {
+		return nil, fmt.Errorf("plugin %s: none of allow, enrich or format exported", file)
+	}
+	if err := p.instantiate(ctx); err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", file, err)
+	}
+	if p.mod.Memory() == nil {
+		return nil, fmt.Errorf("plugin %s: alloc or memory not exported", file)
+	}
+	return p, nil
+}
+
+// instantiate replaces the instance of the module with a new one, with
+// a fresh memory.
+func (p *plugin) instantiate(ctx context.Context) error {
+	if p.mod != nil {
+		p.mod.Close(ctx)
+	}
+	p.mod, p.err = p.rt.InstantiateModule(ctx, p.compiled, p.cfg)
+	return p.err
+}
+
+// call calls the exported function fn with the JSON encoding of in and
+// returns its result and, if output is set and the result is not 0, the
+// output it points to.
+func (p *plugin) call(fn string, in interface{}, output bool) (uint64, []byte, error) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return 0, nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mod == nil || p.mod.IsClosed() {
+		if err := p.instantiate(context.Background()); err != nil {
+			return 0, nil, fmt.Errorf("instantiation: %v", err)
+		}
+	}
+	res, out, err := p.callModule(fn, b, output)
+	if err != nil {
+		// The call may have been terminated, which closes the module,
+		// or left its memory in any state.
+		p.mod.Close(context.Background())
+	}
+	return res, out, err
+}
+
+// callModule calls fn with the input b in the instance of the module.
+func (p *plugin) callModule(fn string, b []byte, output bool) (uint64, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	res, err := p.mod.ExportedFunction("alloc").Call(ctx, uint64(len(b)))
+	if err != nil {
+		return 0, nil, err
+	}
+	ptr := uint32(res[0])
+	if !p.mod.Memory().Write(ptr, b) {
+		return 0, nil, errors.New("alloc returned a buffer out of memory")
+	}
+	if res, err = p.mod.ExportedFunction(fn).Call(ctx, uint64(ptr), uint64(len(b))); err != nil {
+		return 0, nil, err
+	}
+	if !output || res[0] == 0 {
+		return res[0], nil, nil
+	}
+	out, ok := p.mod.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return 0, nil, errors.New("output out of memory")
+	}
+	return res[0], append([]byte(nil), out...), nil
+}
+
+// failed returns the error of the last instantiation of the module of a
+// plugin, if it failed.
+func (ps plugins) failed() error {
+	for _, p := range ps {
+		p.mu.Lock()
+		err := p.err
+		p.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("plugin %s: %v", p.name, err)
+		}
+	}
+	return nil
+}
+
+func (p *plugin) fail(err error) {
+	pluginErrors.inc(p.name)
+	log.Printf("plugin %s: %v", p.name, err)
+}
+
+// plugins are the loaded plugins, called in order.
+type plugins []*plugin
+
+// loadPlugins loads the modules in files in a new runtime.
+func loadPlugins(files []string) (plugins, error) {
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+	var ps plugins
+	for _, f := range files {
+		p, err := loadPlugin(ctx, rt, f)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// allowed reports whether all access policies allow the query. Failing
+// policies refuse it.
+func (ps plugins) allowed(client net.IP, name string, qtype uint16) bool {
+	in := map[string]interface{}{"client": client.String(), "name": name, "type": qtype}
+	for _, p := range ps {
+		if !p.allow {
+			continue
+		}
+		res, _, err := p.call("allow", in, false)
+		if err != nil {
+			p.fail(err)
+			return false
+		}
+		if uint32(res) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// apply sets the fields returned by the enrichers.
+func (ps plugins) apply(ip, client net.IP, fields []field) []field {
+	for _, p := range ps {
+		if !p.enrich {
+			continue
+		}
+		in := map[string]interface{}{"ip": ip.String(), "client": client.String(), "fields": fieldMap(fields)}
+		res, b, err := p.call("enrich", in, true)
+		if err != nil {
+			p.fail(err)
+			continue
+		}
+		if res == 0 {
+			continue
+		}
+		var set map[string]string
+		if err := json.Unmarshal(b, &set); err != nil {
+			p.fail(fmt.Errorf("enrich: %v", err))
+			continue
+		}
+		fields = setFields(fields, set)
+	}
+	return fields
+}
+
+// formatter returns the first formatter plugin, or nil if there is none.
+func (ps plugins) formatter() *plugin {
+	for _, p := range ps {
+		if p.format {
+			return p
+		}
+	}
+	return nil
+}
+
+// formatResponse returns the response of the fields up to level written
+// by the formatter p.
+func (p *plugin) formatResponse(fields []field, level int) (string, error) {
+	type nv struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	var in struct {
+		Fields []nv `json:"fields"`
+	}
+	for _, f := range fields {
+		if f.level <= level {
+			in.Fields = append(in.Fields, nv{f.name, f.value})
+		}
+	}
+	_, b, err := p.call("format", in, true)
+	return string(b), err
+}
+
+// fieldMap returns the values of fields by name.
+func fieldMap(fields []field) map[string]string {
+	m := make(map[string]string, len(fields))
+	for _, f := range fields {
+		m[f.name] = f.value
+	}
+	return m
+}
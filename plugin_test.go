@@ -0,0 +1,72 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// slowPolicy is a module exporting its memory, an alloc returning 1024,
+// and an allow allowing inputs up to 60 bytes and looping forever on
+// longer ones.
+var slowPolicy = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// types: (i32) i32, (i32, i32) i32
+	0x01, 0x0c, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f,
+	// functions
+	0x03, 0x03, 0x02, 0x00, 0x01,
+	// memory of 1 page
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// exports: memory, alloc, allow
+	0x07, 0x1a, 0x03,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x05, 'a', 'l', 'l', 'o', 'c', 0x00, 0x00,
+	0x05, 'a', 'l', 'l', 'o', 'w', 0x00, 0x01,
+	// code
+	0x0a, 0x19, 0x02,
+	// alloc: i32.const 1024
+	0x05, 0x00, 0x41, 0x80, 0x08, 0x0b,
+	// allow: if len > 60 { loop { br 0 } }; i32.const 1
+	0x11, 0x00, 0x20, 0x01, 0x41, 0x3c, 0x4b, 0x04, 0x40, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b, 0x41, 0x01, 0x0b,
+}
+
+func TestPluginTimeout(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "slow.wasm")
+	if err := os.WriteFile(file, slowPolicy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ps, err := loadPlugins([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := net.ParseIP("127.0.0.1")
+	if !ps.allowed(client, "a.", dns.TypeTXT) {
+		t.Fatal("short query refused")
+	}
+	errors := pluginErrors.snapshot()["slow"]
+	if ps.allowed(client, strings.Repeat("a", 60)+".", dns.TypeTXT) {
+		t.Error("timed out query allowed")
+	}
+	if got := pluginErrors.snapshot()["slow"] - errors; got != 1 {
+		t.Errorf("got %v plugin errors, want 1", got)
+	}
+	// The terminated call closed the module, the next ones run in a new
+	// instance.
+	for i := 0; i < 2; i++ {
+		if !ps.allowed(client, "a.", dns.TypeTXT) {
+			t.Fatalf("query %d after the timeout refused", i)
+		}
+	}
+	if err := ps.failed(); err != nil {
+		t.Error(err)
+	}
+}
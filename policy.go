@@ -0,0 +1,111 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// policy groups the answer settings of a domain. The default policy is
+// set by flags, and each domain may override some of its settings.
+type policy struct {
+	ttl         uint32    // TTL of TXT answers
+	negativeTTL uint32    // SOA minimum, how long negative answers are cached
+	unsupported int       // rcode of queries for unsupported types
+	format      Formatter // response format
+	fields      []field   // static fields appended to named formats
+}
+
+// unsupportedRcodes maps names to rcodes of queries for unsupported
+// types. nodata is NOERROR without answers.
+var unsupportedRcodes = map[string]int{
+	"nxdomain": dns.RcodeNameError,
+	"nodata":   dns.RcodeSuccess,
+	"refused":  dns.RcodeRefused,
+	"notimp":   dns.RcodeNotImplemented,
+}
+
+// set sets the named setting of the policy to v.
+func (p *policy) set(name, v string) error {
+	switch name {
+	case "ttl", "negative-ttl":
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %q", name, v)
+		}
+		if name == "ttl" {
+			p.ttl = uint32(d.Seconds())
+		} else {
+			p.negativeTTL = uint32(d.Seconds())
+		}
+	case "unsupported":
+		rcode, ok := unsupportedRcodes[v]
+		if !ok {
+			return fmt.Errorf("invalid unsupported rcode %q, want nxdomain, nodata, refused or notimp", v)
+		}
+		p.unsupported = rcode
+	case "format":
+		f, ok := formatters[v]
+		if !ok {
+			return fmt.Errorf("invalid format %q, want one of %s", v, strings.Join(formatNames(), ", "))
+		}
+		p.format = f
+	default:
+		fname := strings.TrimPrefix(name, "field.")
+		if fname == name {
+			return fmt.Errorf("unknown policy setting %q, want ttl, negative-ttl, unsupported, format or field.<name>", name)
+		}
+		if fname == "" || strings.Trim(fname, "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+			return fmt.Errorf("invalid field name %q, want lowercase letters, digits and underscores", fname)
+		}
+		p.setField(fname, v)
+	}
+	return nil
+}
+
+// setField sets the static field name to v, replacing any field of that
+// name. The fields are copied, since policies are copied from the default
+// one.
+func (p *policy) setField(name, v string) {
+	fields := make([]field, 0, len(p.fields)+1)
+	for _, f := range p.fields {
+		if f.name != name {
+			fields = append(fields, f)
+		}
+	}
+	p.fields = append(fields, field{name: name, value: v, level: levelMinimal, keyed: true})
+}
+
+// parseDomainPolicies returns the policies of the domains given in the
+// form domain:name=value,..., overriding the settings of def.
+func parseDomainPolicies(specs []string, def policy) (map[string]policy, error) {
+	ret := make(map[string]policy)
+	for _, spec := range specs {
+		p := strings.SplitN(spec, ":", 2)
+		if len(p) != 2 || p[0] == "" {
+			return nil, fmt.Errorf("invalid domain policy %q, want domain:name=value,...", spec)
+		}
+		pol, ok := ret[p[0]]
+		if !ok {
+			pol = def
+		}
+		for _, kv := range strings.Split(p[1], ",") {
+			s := strings.SplitN(kv, "=", 2)
+			if len(s) != 2 {
+				return nil, fmt.Errorf("invalid domain policy %q, want domain:name=value,...", spec)
+			}
+			if err := pol.set(s[0], s[1]); err != nil {
+				return nil, fmt.Errorf("domain policy of %s: %v", p[0], err)
+			}
+		}
+		ret[p[0]] = pol
+	}
+	return ret, nil
+}
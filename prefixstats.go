@@ -0,0 +1,191 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Prefix lengths the queries are counted by, finest first. Sources are
+// counted in their /24 or /48 prefix, aggregated in the coarser ones when
+// the table is full.
+var (
+	prefixLens4 = []int{24, 16, 8, 0}
+	prefixLens6 = []int{48, 32, 16, 0}
+)
+
+// prefixStats counts queries by source prefix, per minute over a
+// rolling window, so that the networks driving the load are seen without
+// query logs. A minute has at most max prefixes: to count new ones, the
+// prefixes with fewer queries than average are aggregated in their
+// parent prefixes, keeping the busiest networks at the finest length.
+type prefixStats struct {
+	mu      sync.Mutex
+	max     int
+	minutes []minuteCounts // ring indexed by minute
+}
+
+func newPrefixStats(minutes, max int) *prefixStats {
+	s := &prefixStats{max: max, minutes: make([]minuteCounts, minutes)}
+	newGaugeFunc("freegeoip_dns_prefix_stats_entries", "Source prefixes counted by -prefix-stats-window over the window.", func() float64 {
+		return float64(s.len())
+	})
+	return s
+}
+
+// add counts a query from ip.
+func (s *prefixStats) add(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	k := prefixKey(ip, 0)
+	minute := time.Now().Unix() / 60
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mc := &s.minutes[minute%int64(len(s.minutes))]
+	if mc.minute != minute || mc.counts == nil {
+		mc.minute, mc.counts = minute, make(map[string]uint64)
+	}
+	if _, ok := mc.counts[k]; !ok && len(mc.counts) >= s.max {
+		s.compact(mc.counts)
+		// The source may be in an aggregated prefix by now.
+		for level := 1; level < len(prefixLens4); level++ {
+			if p := prefixKey(ip, level); mc.counts[p] > 0 {
+				k = p
+				break
+			}
+		}
+	}
+	mc.counts[k]++
+}
+
+// prefixKey returns the prefix of ip at level, an index of prefixLens4
+// or prefixLens6, in CIDR notation.
+func prefixKey(ip net.IP, level int) string {
+	n, bits := prefixLens6[level], 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, n, bits = ip4, prefixLens4[level], 32
+	}
+	mask := net.CIDRMask(n, bits)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// parentPrefix returns the prefix aggregating the prefix k, or false if
+// k is a whole address family.
+func parentPrefix(k string) (string, bool) {
+	ip, n, err := net.ParseCIDR(k)
+	if err != nil {
+		return "", false
+	}
+	ones, _ := n.Mask.Size()
+	lens := prefixLens6
+	if ip.To4() != nil {
+		lens = prefixLens4
+	}
+	for i, l := range lens[:len(lens)-1] {
+		if l == ones {
+			return prefixKey(ip, i+1), true
+		}
+	}
+	return "", false
+}
+
+// compact makes room in counts by aggregating the prefixes with no more
+// queries than average in their parents, then, if that's not enough, all
+// of them, until under max.
+func (s *prefixStats) compact(counts map[string]uint64) {
+	for len(counts) >= s.max {
+		var total uint64
+		for _, c := range counts {
+			total += c
+		}
+		if !aggregate(counts, total/uint64(len(counts))) && !aggregate(counts, math.MaxUint64) {
+			return
+		}
+	}
+}
+
+// aggregate moves the counts of the prefixes with up to max queries to
+// their parents, and reports whether any was.
+func aggregate(counts map[string]uint64, max uint64) bool {
+	moved := make(map[string]uint64)
+	for k, c := range counts {
+		if c > max {
+			continue
+		}
+		if p, ok := parentPrefix(k); ok {
+			delete(counts, k)
+			moved[p] += c
+		}
+	}
+	for p, c := range moved {
+		counts[p] += c
+	}
+	return len(moved) > 0
+}
+
+// counts returns the queries by prefix over the last n minutes, up to
+// the window, and the number of minutes counted.
+func (s *prefixStats) counts(n int) (map[string]uint64, int) {
+	if n <= 0 || n > len(s.minutes) {
+		n = len(s.minutes)
+	}
+	now := time.Now().Unix() / 60
+	ret := make(map[string]uint64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, mc := range s.minutes {
+		if mc.minute > now-int64(n) {
+			for k, c := range mc.counts {
+				ret[k] += c
+			}
+		}
+	}
+	return ret, n
+}
+
+// len returns the number of prefixes counted over the window.
+func (s *prefixStats) len() int {
+	counts, _ := s.counts(0)
+	return len(counts)
+}
+
+// prefixStatsHandler serves the prefixes with the most queries over the
+// last minutes given in the query parameter, the whole window by
+// default, as JSON. The limit parameter is the max number of prefixes,
+// 100 by default.
+func (h *handle) prefixStatsHandler(w http.ResponseWriter, r *http.Request) {
+	minutes, limit := 0, 100
+	for name, v := range map[string]*int{"minutes": &minutes, "limit": &limit} {
+		if s := r.FormValue(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*v = n
+		}
+	}
+	counts, n := h.prefixStats.counts(minutes)
+	top := make([]keyCount, 0, len(counts))
+	var total uint64
+	for k, c := range counts {
+		top = append(top, keyCount{k, c})
+		total += c
+	}
+	sortCounts(top)
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"minutes": n, "total": total, "prefixes": top})
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mvrilo/freegeoip-dns/events"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// publishQueueLen is the max number of query events waiting to be
+// published. Events are dropped when the queue is full, so that a slow
+// broker never slows down answers.
+const publishQueueLen = 10000
+
+var publishedEvents = newCounter("freegeoip_dns_published_events_total", "Query events published, by result: sent, dropped or error.", "result")
+
+// queryEvent is the structured event published for every answer.
+type queryEvent struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client,omitempty"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	IP        string    `json:"ip,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	Rcode     string    `json:"rcode"`
+	LatencyUs int64     `json:"latency_us"`
+}
+
+// publisher sends query events to a broker.
+type publisher interface {
+	publish(b []byte) error
+}
+
+// newPublisher returns the publisher to the broker in dsn, given as
+// nats://host:port/subject or kafka://broker1:port,broker2:port/topic.
+func newPublisher(dsn string) (publisher, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	dest := strings.TrimPrefix(u.Path, "/")
+	if dest == "" {
+		return nil, fmt.Errorf("publish: missing subject or topic in %q", dsn)
+	}
+	switch u.Scheme {
+	case "nats":
+		nc, err := nats.Connect("nats://"+u.Host, nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, err
+		}
+		return &natsPublisher{conn: nc, subject: dest}, nil
+	case "kafka":
+		w := &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(u.Host, ",")...),
+			Topic:        dest,
+			Async:        true,
+			BatchTimeout: 100 * time.Millisecond,
+		}
+		return &kafkaPublisher{w: w}, nil
+	}
+	return nil, fmt.Errorf("publish: unknown broker %q, want nats or kafka", u.Scheme)
+}
+
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (p *natsPublisher) publish(b []byte) error {
+	return p.conn.Publish(p.subject, b)
+}
+
+type kafkaPublisher struct {
+	w *kafka.Writer
+}
+
+func (p *kafkaPublisher) publish(b []byte) error {
+	return p.w.WriteMessages(context.Background(), kafka.Message{Value: b})
+}
+
+// answerQueue returns a queue of up to n answer events. Events are
+// counted as dropped in counter c when it is full.
+func answerQueue(n int, c counter) <-chan events.Answer {
+	queue := make(chan events.Answer, n)
+	events.OnAnswer(func(a events.Answer) {
+		select {
+		case queue <- a:
+		default:
+			c.inc("dropped")
+		}
+	})
+	return queue
+}
+
+// newQueryEvent returns the query event of the answer a.
+func newQueryEvent(a events.Answer) queryEvent {
+	ev := queryEvent{
+		Time:      a.Time,
+		Name:      a.Name,
+		Type:      dns.TypeToString[a.Type],
+		Country:   a.Country,
+		Rcode:     dns.RcodeToString[a.Rcode],
+		LatencyUs: int64(a.Duration / time.Microsecond),
+	}
+	if a.Client != nil {
+		ev.Client = a.Client.String()
+	}
+	if a.IP != nil {
+		ev.IP = a.IP.String()
+	}
+	return ev
+}
+
+// publishEvents publishes an event for every answer to p, from a bounded
+// queue.
+func publishEvents(p publisher) {
+	queue := answerQueue(publishQueueLen, publishedEvents)
+	go func() {
+		for a := range queue {
+			b, _ := json.Marshal(newQueryEvent(a))
+			if err := p.publish(b); err != nil {
+				publishedEvents.inc("error")
+				log.Println("publish:", err)
+				continue
+			}
+			publishedEvents.inc("sent")
+		}
+	}()
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryCmd looks up an IP or hostname on a server and prints the fields
+// of the answer, one per line.
+func queryCmd(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	domain := fs.String("domain", "", "Domain of the server")
+	port := fs.String("port", "5300", "Port of the server, unless given with @host:port")
+	profile := fs.String("profile", "", "Response profile: minimal, standard or full, the server default if empty")
+	timeout := fs.Duration("timeout", 5*time.Second, "Query timeout")
+	tcp := fs.Bool("tcp", false, "Query over TCP")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: freegeoip-dns query [flags] <ip-or-host> [@server[:port]]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	server := "127.0.0.1"
+	var target string
+	for _, arg := range fs.Args() {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			server = arg[1:]
+		case target == "":
+			target = arg
+		default:
+			fs.Usage()
+			return errors.New("query: too many arguments")
+		}
+	}
+	if target == "" {
+		fs.Usage()
+		return errors.New("query: missing ip or host")
+	}
+	if *profile != "" {
+		if _, err := parseProfile(*profile); err != nil {
+			return fmt.Errorf("query: %v", err)
+		}
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), *port)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(join(*profile, "json", queryLabel(target), *domain)), dns.TypeTXT)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	c := &dns.Client{Timeout: *timeout}
+	if *tcp {
+		c.Net = "tcp"
+	}
+	r, rtt, err := c.Exchange(m, server)
+	if err != nil {
+		return fmt.Errorf("query: %v", err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		msg := dns.RcodeToString[r.Rcode]
+		if opt := r.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_EDE); ok {
+					msg += ": " + e.String()
+				}
+			}
+		}
+		return fmt.Errorf("query: %s %s", m.Question[0].Name, msg)
+	}
+	for _, rr := range r.Answer {
+		if t, ok := rr.(*dns.TXT); ok {
+			if err := printAnswer(os.Stdout, t); err != nil {
+				return fmt.Errorf("query: %v", err)
+			}
+		}
+	}
+	fmt.Printf(";; %s from %s in %s\n", m.Question[0].Name, server, rtt.Round(time.Microsecond))
+	return nil
+}
+
+// queryLabel returns the query labels of target. IPv6 addresses are
+// written as hex labels, since colons are not valid in host names.
+func queryLabel(target string) string {
+	ip := net.ParseIP(target)
+	switch {
+	case ip == nil:
+		return strings.TrimSuffix(target, ".")
+	case ip.To4() != nil:
+		return ip.String()
+	}
+	return hexPrefix + hex.EncodeToString(ip)
+}
+
+// printAnswer prints the JSON object of a TXT answer as aligned name and
+// value columns, in the order of the server, the names of nested values
+// joined with dots, followed by any other strings of the answer, like
+// debug info or the signature.
+func printAnswer(w io.Writer, t *dns.TXT) error {
+	var s string
+	for _, part := range t.Txt {
+		s += unescapeTxt(part)
+	}
+	if !strings.HasPrefix(s, "{") {
+		return fmt.Errorf("answer is not a JSON object: %q", s)
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if err := printJSON(tw, dec, ""); err != nil {
+		return err
+	}
+	tw.Flush()
+	if extra := strings.TrimSpace(s[dec.InputOffset():]); extra != "" {
+		fmt.Fprintln(w, extra)
+	}
+	return nil
+}
+
+// printJSON prints the values of the next JSON value of dec as name and
+// value lines, named name, or with their key or index appended to it for
+// objects and arrays.
+func printJSON(w io.Writer, dec *json.Decoder, name string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'), json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			key := strconv.Itoa(i)
+			if tok == json.Delim('{') {
+				k, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key = k.(string)
+			}
+			if err := printJSON(w, dec, join(name, key)); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	}
+	fmt.Fprintf(w, "%s\t%v\n", name, tok)
+	return nil
+}
+
+// unescapeTxt reverts the escaping of a TXT string by the dns package:
+// \X is X and \DDD the byte of decimal value DDD.
+func unescapeTxt(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && strings.Trim(s[i+1:i+4], "0123456789") == "" {
+			if n, _ := strconv.Atoi(s[i+1 : i+4]); n < 256 {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		i++
+		b = append(b, s[i])
+	}
+	return string(b)
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a per-client token bucket limiter.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing rate queries per second per
+// client, with bursts of up to burst queries.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	rl := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clients: make(map[string]*bucket),
+	}
+	tasks.start(&task{name: "ratelimit-sweep", intvl: time.Minute, run: rl.sweep})
+	return rl
+}
+
+// allow reports whether client may issue another query now.
+func (rl *rateLimiter) allow(client string) bool {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b, ok := rl.clients[client]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.clients[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops clients that have been idle long enough for their bucket
+// to refill, keeping memory bounded.
+func (rl *rateLimiter) sweep() error {
+	now := time.Now()
+	rl.mu.Lock()
+	for k, b := range rl.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.clients, k)
+		}
+	}
+	rl.mu.Unlock()
+	return nil
+}
+
+var throttledQueries = newCounter("freegeoip_dns_throttled_queries_total", "Queries over -max-qps, by result: delayed or shed.", "result")
+
+// throttle is a global token bucket in front of the handler. Queries over
+// the rate wait for their token, up to maxWait, so that bursts are
+// absorbed with bounded latency, and are shed beyond.
+type throttle struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	maxWait time.Duration
+	tokens  float64
+	last    time.Time
+}
+
+// newThrottle returns a throttle allowing rate queries per second, with
+// bursts of up to burst queries, delaying queries up to maxWait.
+func newThrottle(rate float64, burst int, maxWait time.Duration) *throttle {
+	if burst < 1 {
+		burst = 1
+	}
+	return &throttle{
+		rate:    rate,
+		burst:   float64(burst),
+		maxWait: maxWait,
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+// wait takes a token, waiting until it is due. It reports false, without
+// waiting nor taking it, if it would be due after maxWait. Tokens are
+// taken ahead, so that waiting queries are let through in order.
+func (t *throttle) wait() bool {
+	now := time.Now()
+	t.mu.Lock()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+	delay := time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+	if delay > t.maxWait {
+		t.mu.Unlock()
+		throttledQueries.inc("shed")
+		return false
+	}
+	t.tokens--
+	t.mu.Unlock()
+	if delay > 0 {
+		throttledQueries.inc("delayed")
+		time.Sleep(delay)
+	}
+	return true
+}
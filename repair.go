@@ -0,0 +1,96 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// minRepairLookups is the min number of lookups in an interval for the
+// error rate to be checked, so that a few errors at low traffic don't
+// trigger a repair.
+const minRepairLookups = 100
+
+var (
+	dbLookupErrors = newCounter("freegeoip_dns_db_lookup_errors_total", "Database lookups that failed with a loaded database.")
+	dbRepairs      = newCounter("freegeoip_dns_db_repairs_total", "Integrity checks triggered by lookup errors, by result: ok, redownloaded or error.", "result")
+)
+
+// checkLookupErrors checks the lookup error rate of g since the last
+// check, run every -repair-interval, and when above maxRate verifies the
+// loaded database and, if it is corrupt, downloads or reopens it again
+// rather than waiting for the next update.
+func checkLookupErrors(g *geoDB, info *dbInfo, maxRate float64) error {
+	lookups := atomic.SwapInt64(&g.lookups, 0)
+	errs := atomic.SwapInt64(&g.lookupErrs, 0)
+	if lookups < minRepairLookups || float64(errs)/float64(lookups) <= maxRate {
+		return nil
+	}
+	log.Printf("WARNING %d of %d database lookups failed, verifying the database", errs, lookups)
+	result, err := g.repair(info)
+	dbRepairs.inc(result)
+	if err != nil {
+		return fmt.Errorf("database repair: %v", err)
+	}
+	return nil
+}
+
+// repair verifies the loaded database file and, if it is corrupt, forces
+// a new download of a remote database, or reopens a local one in case it
+// was replaced. It returns the result for the metrics.
+func (g *geoDB) repair(info *dbInfo) (string, error) {
+	meta := info.get()
+	if meta == nil {
+		return "error", nil
+	}
+	err := verifyDB(meta.File)
+	if err == nil {
+		log.Println("database verified, lookup errors are not caused by corruption")
+		return "ok", nil
+	}
+	log.Println("database corrupt:", err)
+	if src := g.source(); isURL(src) {
+		// Without validators the download is not conditional.
+		os.Remove(newDownloader(src, g.opts).file + ".validators")
+		err = g.reload()
+	} else {
+		err = g.reopen()
+	}
+	if err != nil {
+		return "error", err
+	}
+	return "redownloaded", nil
+}
+
+// verifyDB checks the integrity of the mmdb file, mapped rather than
+// read in memory. Gzipped files are uncompressed to a temporary file
+// first.
+func verifyDB(file string) error {
+	gz, err := isGzip(file)
+	if err != nil {
+		return err
+	}
+	if gz {
+		tmp, err := gunzipTemp(file, filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp)
+		file = tmp
+	}
+	r, err := maxminddb.Open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return r.Verify()
+}
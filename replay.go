@@ -0,0 +1,159 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Query recordings are a sequence of records made of the time the query
+// was received, as big endian Unix nanoseconds, the length of the query
+// as a big endian uint16, and the query in wire format.
+const recordHeaderLen = 10
+
+// recorder appends the queries received to a recording.
+type recorder struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// newRecorder appends to the recording in file, flushed by flush.
+func newRecorder(file string) (*recorder, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// flush writes the buffered records to the file. It is run every second
+// by the record-flush task.
+func (rec *recorder) flush() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if err := rec.w.Flush(); err != nil {
+		return fmt.Errorf("query recording: %v", err)
+	}
+	return nil
+}
+
+// record appends r, received at t.
+func (rec *recorder) record(t time.Time, r *dns.Msg) {
+	b, err := r.Pack()
+	if err != nil || len(b) > 0xffff {
+		return
+	}
+	var hdr [recordHeaderLen]byte
+	binary.BigEndian.PutUint64(hdr[:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint16(hdr[8:], uint16(len(b)))
+	rec.mu.Lock()
+	rec.w.Write(hdr[:])
+	rec.w.Write(b)
+	rec.mu.Unlock()
+}
+
+// readRecord reads the next record of a recording.
+func readRecord(r io.Reader) (time.Time, []byte, error) {
+	var hdr [recordHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return time.Time{}, nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(hdr[8:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return time.Time{}, nil, err
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(hdr[:8]))), b, nil
+}
+
+// replayCmd sends the queries of a recording to a server, at their
+// original pace or faster, and prints the rcodes of the answers.
+func replayCmd(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "Query recording, made with -record")
+	target := fs.String("target", "127.0.0.1:5300", "Address in form of host:port of the server to send the queries to")
+	speed := fs.Float64("speed", 1, "Replay speed, e.g. 2 for twice as fast as recorded, 0 for as fast as possible")
+	timeout := fs.Duration("timeout", 5*time.Second, "Query timeout")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("replay: missing -file")
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[string]int)
+		c       = &dns.Client{Timeout: *timeout}
+		first   time.Time
+		start   = time.Now()
+	)
+	br := bufio.NewReader(f)
+	for {
+		t, b, err := readRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("replay: %v", err)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(b); err != nil {
+			continue
+		}
+		if first.IsZero() {
+			first = t
+		}
+		if *speed > 0 {
+			at := start.Add(time.Duration(float64(t.Sub(first)) / *speed))
+			time.Sleep(time.Until(at))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := "error"
+			if r, _, err := c.Exchange(m, *target); err == nil {
+				result = dns.RcodeToString[r.Rcode]
+			}
+			mu.Lock()
+			results[result]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	var total int
+	keys := make([]string, 0, len(results))
+	for k, n := range results {
+		keys = append(keys, k)
+		total += n
+	}
+	sort.Strings(keys)
+	fmt.Printf("%d queries in %s\n", total, time.Since(start).Round(time.Millisecond))
+	for _, k := range keys {
+		fmt.Printf("%s\t%d\n", k, results[k])
+	}
+	return nil
+}
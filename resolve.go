@@ -0,0 +1,153 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEDepth is the max number of CNAME records followed to resolve a
+// hostname.
+const maxCNAMEDepth = 8
+
+var errCNAMEChain = errors.New("CNAME chain too long")
+
+// resolvConf is the file with the resolvers used for hostnames.
+var resolvConf = "/etc/resolv.conf"
+
+// resolver resolves hostnames with the system resolvers, following CNAME
+// chains itself so that their length is bounded and the canonical name
+// is known.
+type resolver struct {
+	servers []string
+	client  *dns.Client
+}
+
+var (
+	systemResolver     *resolver
+	systemResolverOnce sync.Once
+)
+
+// getResolver returns the resolver configured in resolvConf, or nil if
+// it can't be read.
+func getResolver() *resolver {
+	systemResolverOnce.Do(func() {
+		conf, err := dns.ClientConfigFromFile(resolvConf)
+		if err != nil || len(conf.Servers) == 0 {
+			return
+		}
+		res := &resolver{client: new(dns.Client)}
+		for _, s := range conf.Servers {
+			res.servers = append(res.servers, net.JoinHostPort(s, conf.Port))
+		}
+		systemResolver = res
+	})
+	return systemResolver
+}
+
+// lookup returns the IPv4 addresses of host, or the IPv6 ones if it has
+// none, and its canonical name.
+func (res *resolver) lookup(ctx context.Context, host string) ([]net.IP, string, error) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		ips, cname, err := res.query(ctx, dns.Fqdn(host), qtype)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(ips) > 0 {
+			return ips, strings.TrimSuffix(cname, "."), nil
+		}
+	}
+	return nil, "", errHostNotFound
+}
+
+// query returns the records of type qtype of name, following CNAME
+// records, and the name they were found at.
+func (res *resolver) query(ctx context.Context, name string, qtype uint16) ([]net.IP, string, error) {
+	depth := 0
+	for {
+		r, err := res.exchange(ctx, name, qtype)
+		if err != nil {
+			return nil, "", err
+		}
+		if r.Rcode == dns.RcodeNameError {
+			return nil, "", errHostNotFound
+		}
+		// Recursive resolvers usually include the whole chain, but it
+		// may end at a CNAME whose target must be queried again.
+		followed := false
+		for {
+			if ips := addrs(r.Answer, name, qtype); len(ips) > 0 {
+				return ips, name, nil
+			}
+			target := cnameTarget(r.Answer, name)
+			if target == "" {
+				break
+			}
+			if depth++; depth > maxCNAMEDepth {
+				return nil, "", errCNAMEChain
+			}
+			name, followed = target, true
+		}
+		if !followed {
+			return nil, name, nil
+		}
+	}
+}
+
+// exchange sends a query to the servers in turn until one answers. It
+// returns errResolveFailed if none does.
+func (res *resolver) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	for _, s := range res.servers {
+		r, _, err := res.client.ExchangeContext(ctx, m, s)
+		if ctx.Err() != nil {
+			return nil, errResolveTimeout
+		}
+		if err == nil && r.Rcode != dns.RcodeServerFailure {
+			return r, nil
+		}
+	}
+	return nil, errResolveFailed
+}
+
+// addrs returns the addresses of type qtype of name in rrs.
+func addrs(rrs []dns.RR, name string, qtype uint16) []net.IP {
+	var ret []net.IP
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			if qtype == dns.TypeA {
+				ret = append(ret, rr.A)
+			}
+		case *dns.AAAA:
+			if qtype == dns.TypeAAAA {
+				ret = append(ret, rr.AAAA)
+			}
+		}
+	}
+	return ret
+}
+
+// cnameTarget returns the target of the CNAME record of name in rrs, or
+// an empty string if there is none.
+func cnameTarget(rrs []dns.RR, name string) string {
+	for _, rr := range rrs {
+		if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+			return c.Target
+		}
+	}
+	return ""
+}
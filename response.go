@@ -0,0 +1,180 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxmindQuery is the object used to query the maxmind database.
+type Query struct {
+	Continent struct {
+		Code string `maxminddb:"code" json:"code,omitempty"`
+	} `maxminddb:"continent" json:"continent,omitempty"`
+	Country struct {
+		ISOCode    string            `maxminddb:"iso_code" json:"iso_code,omitempty"`
+		Names      map[string]string `maxminddb:"names" json:"names,omitempty"`
+		Confidence *uint16           `maxminddb:"confidence" json:"confidence,omitempty"`
+	} `maxminddb:"country" json:"country,omitempty"`
+	Region []struct {
+		ISOCode string            `maxminddb:"iso_code" json:"iso_code,omitempty"`
+		Names   map[string]string `maxminddb:"names" json:"names,omitempty"`
+	} `maxminddb:"subdivisions" json:"subdivisions,omitempty"`
+	City struct {
+		Names      map[string]string `maxminddb:"names" json:"names,omitempty"`
+		Confidence *uint16           `maxminddb:"confidence" json:"confidence,omitempty"`
+	} `maxminddb:"city" json:"city,omitempty"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude" json:"latitude,omitempty"`
+		Longitude float64 `maxminddb:"longitude" json:"longitude,omitempty"`
+		MetroCode uint    `maxminddb:"metro_code" json:"metro_code,omitempty"`
+		// AccuracyRadius is the radius in km around the coordinates the
+		// IP is likely in.
+		AccuracyRadius uint16 `maxminddb:"accuracy_radius" json:"accuracy_radius,omitempty"`
+		TimeZone       string `maxminddb:"time_zone" json:"time_zone,omitempty"`
+	} `maxminddb:"location" json:"location,omitempty"`
+	Postal struct {
+		Code string `maxminddb:"code" json:"code,omitempty"`
+	} `maxminddb:"postal" json:"postal,omitempty"`
+	// Traits are only present in GeoIP2 Enterprise databases.
+	Traits struct {
+		UserType      string   `maxminddb:"user_type" json:"user_type,omitempty"`
+		StaticIPScore *float64 `maxminddb:"static_ip_score" json:"static_ip_score,omitempty"`
+	} `maxminddb:"traits" json:"traits,omitempty"`
+	Candidates []candidate `maxminddb:"candidates" json:"candidates,omitempty"`
+}
+
+// Field detail levels. A response profile includes all fields up to its
+// level.
+const (
+	levelMinimal = iota
+	levelStandard
+	levelFull
+)
+
+// profiles maps response profile names to their field level.
+var profiles = map[string]int{
+	"minimal":  levelMinimal,
+	"standard": levelStandard,
+	"full":     levelFull,
+}
+
+// parseProfile returns the field level of the named profile.
+func parseProfile(name string) (int, error) {
+	level, ok := profiles[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown profile %q, want minimal, standard or full", name)
+	}
+	return level, nil
+}
+
+// responseVersion is a positional response schema.
+type responseVersion struct {
+	sep string
+	// fixed versions always include optional fields, so that every
+	// field has the same position in all responses.
+	fixed bool
+}
+
+// versions maps version labels to response schemas. Version 1 is the
+// original schema, where the region fields are left out for addresses
+// without a region.
+var versions = map[string]*responseVersion{
+	"v1": {sep: "    "},
+	"v2": {sep: "|", fixed: true},
+}
+
+// parseVersion returns the named response version.
+func parseVersion(name string) (*responseVersion, error) {
+	v, ok := versions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown response version %q, want v1 or v2", name)
+	}
+	return v, nil
+}
+
+// field is a named response value. Keyed fields are written as
+// name=value in positional responses, and empty optional fields are
+// left out unless the response version is fixed.
+type field struct {
+	name     string
+	value    string
+	level    int
+	keyed    bool
+	optional bool
+}
+
+// extraField returns a keyed field only included in the full profile.
+func extraField(name, value string) field {
+	return field{name: name, value: value, level: levelFull, keyed: true}
+}
+
+// queryFields returns the response fields of query for ip.
+func queryFields(query *Query, ip net.IP, lang string) []field {
+	var regionCode, regionName string
+	if len(query.Region) > 0 {
+		regionCode = query.Region[0].ISOCode
+		regionName = query.Region[0].Names[lang]
+	}
+
+	ret := []field{
+		{name: "ip", value: ip.String()},
+		{name: "country_code", value: query.Country.ISOCode},
+		{name: "country_name", value: query.Country.Names[lang]},
+		{name: "region_code", value: regionCode, level: levelStandard, optional: true},
+		{name: "region_name", value: regionName, level: levelStandard, optional: true},
+		{name: "city", value: query.City.Names[lang]},
+		{name: "zip_code", value: query.Postal.Code, level: levelStandard},
+		{name: "time_zone", value: query.Location.TimeZone, level: levelStandard},
+		{name: "latitude", value: strconv.FormatFloat(query.Location.Latitude, 'f', 2, 64), level: levelStandard},
+		{name: "longitude", value: strconv.FormatFloat(query.Location.Longitude, 'f', 2, 64), level: levelStandard},
+		{name: "metro_code", value: strconv.Itoa(int(query.Location.MetroCode)), level: levelStandard},
+	}
+	return append(ret, enterpriseFields(query)...)
+}
+
+// enterpriseFields returns the GeoIP2 Enterprise fields set in query.
+// It returns nothing for other databases.
+func enterpriseFields(query *Query) []field {
+	var ret []field
+	if query.Traits.UserType != "" {
+		ret = append(ret, extraField("user_type", query.Traits.UserType))
+	}
+	if c := query.Country.Confidence; c != nil {
+		ret = append(ret, extraField("country_confidence", strconv.Itoa(int(*c))))
+	}
+	if c := query.City.Confidence; c != nil {
+		ret = append(ret, extraField("city_confidence", strconv.Itoa(int(*c))))
+	}
+	if s := query.Traits.StaticIPScore; s != nil {
+		ret = append(ret, extraField("static_ip_score", strconv.FormatFloat(*s, 'f', 2, 64)))
+	}
+	return ret
+}
+
+// response returns the positional response of the fields up to level.
+// With omitEmpty, empty fields are left out and the others written as
+// name=value, except in fixed versions.
+func response(fields []field, level int, v *responseVersion, omitEmpty bool) string {
+	omitEmpty = omitEmpty && !v.fixed
+	var ret []string
+	for _, f := range fields {
+		if f.level > level || (f.optional && f.value == "" && !v.fixed) {
+			continue
+		}
+		switch {
+		case omitEmpty && f.value == "":
+		case f.keyed || omitEmpty:
+			ret = append(ret, f.name+"="+f.value)
+		default:
+			ret = append(ret, f.value)
+		}
+	}
+	return strings.Join(ret, v.sep)
+}
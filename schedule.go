@@ -0,0 +1,158 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// taskDocs describes the periodic maintenance tasks by name. Tasks must
+// be listed to be started, so that -disable-tasks can check its names.
+var taskDocs = map[string]string{
+	"db-update":         "Download of a remote database",
+	"db-watch":          "Modification check of a local database file, in mmap mode",
+	"db-repair":         "Lookup error rate check of -repair-error-rate",
+	"db-integrity":      "Integrity check of -integrity-interval",
+	"threat-feeds":      "Reload of -threat-feed",
+	"tor-exits":         "Reload of -tor-exits",
+	"cloud-ranges":      "Reload of -cloud-ranges",
+	"ratelimit-sweep":   "Eviction of idle clients of -ratelimit",
+	"cluster-poll":      "Fetch of the statistics and bans of the cluster peers",
+	"cluster-top-reset": "Reset of the top clients and queries of cluster mode",
+	"cluster-db-sync":   "Database sync with the cluster leader, with -cluster-db",
+	"leak-alarm":        "Goroutine and in-flight query check of -warn-goroutines and -warn-inflight",
+	"socket-stats":      "Export of the UDP socket statistics",
+	"fault-reload":      "Database reload of fault injection",
+	"access-log-rotate": "Flush, rotation and purge of -access-log",
+	"record-flush":      "Flush of -record",
+}
+
+// timeNow reads the time of the deadlines of the cluster and the access
+// log, compared on the monotonic clock, and wallNow the system clock, for
+// the times shared with peers or read from files. They only differ in
+// the tests simulating system clock steps.
+var (
+	timeNow = time.Now
+	wallNow = time.Now
+)
+
+var (
+	taskRuns         = newCounter("freegeoip_dns_task_runs_total", "Runs of the maintenance tasks, by task and result: ok or error.", "task", "result")
+	taskLastRun      = newGauge("freegeoip_dns_task_last_run_timestamp_seconds", "Time the maintenance tasks last ran, by task.", "task")
+	taskLastDuration = newGauge("freegeoip_dns_task_last_duration_seconds", "Duration of the last run of the maintenance tasks, by task.", "task")
+)
+
+// task is a periodic maintenance task. Errors returned by run are logged
+// and, if retry is set, retried with exponential backoff up to retry
+// instead of waiting for the next interval.
+type task struct {
+	name  string
+	intvl time.Duration
+	retry time.Duration
+	// done stops the task when closed, if not nil.
+	done <-chan struct{}
+	run  func() error
+}
+
+// scheduler runs the maintenance tasks, each in its own goroutine, with
+// their intervals lengthened at random by up to jitter, a fraction of the
+// interval, so that the tasks of a fleet started at once don't run in
+// lockstep.
+type scheduler struct {
+	mu       sync.Mutex
+	jitter   float64
+	disabled map[string]bool
+}
+
+// tasks is the scheduler of the server.
+var tasks = &scheduler{jitter: 0.1}
+
+// disable disables the tasks of the comma separated names.
+func (s *scheduler) disable(names string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disabled = make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name == "" {
+			continue
+		}
+		if _, ok := taskDocs[name]; !ok {
+			return fmt.Errorf("unknown task %q, want one of %s", name, strings.Join(taskNames(), ", "))
+		}
+		s.disabled[name] = true
+	}
+	return nil
+}
+
+// taskNames returns the names of the tasks, sorted.
+func taskNames() []string {
+	names := make([]string, 0, len(taskDocs))
+	for name := range taskDocs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// start starts t, unless disabled. Its first run is after an interval.
+func (s *scheduler) start(t *task) {
+	if _, ok := taskDocs[t.name]; !ok {
+		panic("unknown task " + t.name)
+	}
+	s.mu.Lock()
+	disabled, jitter := s.disabled[t.name], s.jitter
+	s.mu.Unlock()
+	if disabled {
+		return
+	}
+	go t.loop(jitter)
+}
+
+// loop runs t until it is done.
+func (t *task) loop(jitter float64) {
+	backoff := time.Second
+	wait := jittered(t.intvl, jitter)
+	for {
+		select {
+		case <-time.After(wait):
+		case <-t.done:
+			return
+		}
+		start := time.Now()
+		err := t.run()
+		taskLastRun.set(float64(start.Unix()), t.name)
+		taskLastDuration.set(time.Since(start).Seconds(), t.name)
+		if err != nil {
+			taskRuns.inc(t.name, "error")
+			log.Println(err)
+			if t.retry > 0 {
+				wait = backoff + time.Duration(rand.Int63n(int64(backoff)))
+				if backoff *= 2; backoff > t.retry {
+					backoff = t.retry
+				}
+				continue
+			}
+		} else {
+			taskRuns.inc(t.name, "ok")
+		}
+		backoff = time.Second
+		wait = jittered(t.intvl, jitter)
+	}
+}
+
+// jittered returns d lengthened at random by up to the jitter fraction.
+func jittered(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*jitter*float64(d))
+}
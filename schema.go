@@ -0,0 +1,258 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+)
+
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// fieldDocs describes the response fields. Fields not listed, like those
+// of plugins and scripts, are strings.
+var fieldDocs = map[string]struct {
+	description string
+	pattern     string
+}{
+	"ip":                 {"Queried IP address", ""},
+	"country_code":       {"ISO 3166-1 alpha-2 country code", "^([A-Z]{2})?$"},
+	"country_name":       {"Country name in the server language", ""},
+	"region_code":        {"ISO 3166-2 subdivision code, without the country", ""},
+	"region_name":        {"Subdivision name in the server language", ""},
+	"city":               {"City name in the server language", ""},
+	"zip_code":           {"Postal code", ""},
+	"time_zone":          {"IANA time zone", ""},
+	"latitude":           {"Latitude in degrees, with 2 decimals", `^-?[0-9]+\.[0-9]{2}$`},
+	"longitude":          {"Longitude in degrees, with 2 decimals", `^-?[0-9]+\.[0-9]{2}$`},
+	"metro_code":         {"US metro code, 0 if unknown", "^[0-9]+$"},
+	"user_type":          {"GeoIP2 Enterprise user type", ""},
+	"country_confidence": {"Confidence in the country, 0 to 100", "^[0-9]+$"},
+	"city_confidence":    {"Confidence in the city, 0 to 100", "^[0-9]+$"},
+	"static_ip_score":    {"Static IP score, with 2 decimals", `^[0-9]+\.[0-9]{2}$`},
+	"threat":             {"Threat feeds listing the IP, with -threat-feed", ""},
+	"is_tor_exit":        {"Whether the IP is a Tor exit node, with -tor-exits", "^(true|false)$"},
+	"cloud":              {"Cloud provider and region of the IP, with -cloud-ranges", ""},
+	"asn":                {"Autonomous system number, with -asn-db", "^AS[0-9]+$"},
+	"as_org":             {"Autonomous system organization, with -asn-db", ""},
+	"is_hosting":         {"Whether the AS is a hosting provider, with -asn-db", "^(true|false)$"},
+	"subdomain":          {"Subdomain of wildcard domains the query was under", ""},
+	"cname":              {"Canonical name of queried hostnames, with -cname", ""},
+	"instance":           {"Instance ID, in debug responses", ""},
+}
+
+// candidatePattern matches the names of the alternate location fields
+// added with -candidates.
+const candidatePattern = "^candidate[0-9]+_(country_code|city|confidence)$"
+
+// schemaFields returns the fields of the responses up to level, in
+// order: the database fields, followed by the known extra fields.
+func schemaFields(level int) []field {
+	fields := queryFields(new(Query), net.IPv4zero, "")
+	var extra []string
+	for name := range fieldDocs {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		if !hasField(fields, name) {
+			f := extraField(name, "")
+			if name == "instance" {
+				f.level = levelMinimal
+			}
+			fields = append(fields, f)
+		}
+	}
+	return selectFields(fields, level, false)
+}
+
+// hasField reports whether fields has one named name.
+func hasField(fields []field, name string) bool {
+	for _, f := range fields {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldSchema returns the schema of the value of f.
+func fieldSchema(f field) map[string]interface{} {
+	s := map[string]interface{}{"type": "string"}
+	if d, ok := fieldDocs[f.name]; ok {
+		s["description"] = d.description
+		if d.pattern != "" {
+			s["pattern"] = d.pattern
+		}
+	}
+	return s
+}
+
+// objectSchema returns the schema of the kv responses, objects of the
+// fields by name. Only the database fields are always present,
+// unless empty fields are omitted.
+func objectSchema(title, description string, fields []field) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	for _, f := range fields {
+		props[f.name] = fieldSchema(f)
+		if !f.keyed && !f.optional {
+			required = append(required, f.name)
+		}
+	}
+	return map[string]interface{}{
+		"$schema":           jsonSchemaDialect,
+		"title":             title,
+		"description":       description,
+		"type":              "object",
+		"properties":        props,
+		"required":          required,
+		"patternProperties": map[string]interface{}{candidatePattern: map[string]interface{}{"type": "string"}},
+		"additionalProperties": map[string]interface{}{
+			"type": "string",
+		},
+	}
+}
+
+// recordSchema returns the schema of the json responses, objects of the
+// database record of the IP with the extra fields enabled under extra.
+func recordSchema(fields []field) map[string]interface{} {
+	extra := make(map[string]interface{})
+	for _, f := range fields {
+		if f.keyed {
+			extra[f.name] = fieldSchema(f)
+		}
+	}
+	return map[string]interface{}{
+		"$schema":     jsonSchemaDialect,
+		"title":       "json response",
+		"description": "JSON object of the database record of the IP, with the ip and the sections of the database, such as country, city and location, names in all its languages. Empty values are left out.",
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"ip": fieldSchema(field{name: "ip"}),
+			"extra": map[string]interface{}{
+				"description":          "Extra fields of the response by name, in order, like the static fields and those of the other databases. Left out if there are none.",
+				"type":                 "object",
+				"properties":           extra,
+				"patternProperties":    map[string]interface{}{candidatePattern: map[string]interface{}{"type": "string"}},
+				"additionalProperties": map[string]interface{}{"type": "string"},
+			},
+		},
+		"required":             []string{"ip"},
+		"additionalProperties": true,
+	}
+}
+
+// arraySchema returns the schema of positional and csv responses, arrays
+// of the values of the database fields, in order, followed by those of
+// the extra fields enabled, described by rest.
+func arraySchema(title, description string, fields []field, rest map[string]interface{}) map[string]interface{} {
+	var items []interface{}
+	for _, f := range fields {
+		if !f.keyed {
+			items = append(items, fieldSchema(f))
+		}
+	}
+	return map[string]interface{}{
+		"$schema":     jsonSchemaDialect,
+		"title":       title,
+		"description": description,
+		"type":        "array",
+		"prefixItems": items,
+		"items":       rest,
+	}
+}
+
+// responseSchemas returns the JSON Schema of the responses of each format
+// and version in the given profile.
+func responseSchemas(profile string) (map[string]interface{}, error) {
+	level, err := parseProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	fields := schemaFields(level)
+	var v1 []field
+	for _, f := range fields {
+		if !f.optional {
+			v1 = append(v1, f)
+		}
+	}
+	keyed := map[string]interface{}{
+		"type":        "string",
+		"description": "Extra field written as name=value",
+		"pattern":     "^[a-z0-9_]+=.*$",
+	}
+	values := map[string]interface{}{
+		"type":        "string",
+		"description": "Value of an extra field, in the order of the json response",
+	}
+	return map[string]interface{}{
+		"server":  VERSION,
+		"profile": profile,
+		"formats": map[string]interface{}{
+			"v1": arraySchema("v1 response",
+				"Values split by 4 spaces. For addresses with a region, region_code and region_name follow country_name; they are left out otherwise, so they are not listed.",
+				v1, keyed),
+			"v2":   arraySchema("v2 response", "Values split by |, always with every field.", fields, keyed),
+			"json": recordSchema(fields),
+			"kv": objectSchema("kv response",
+				`name=value pairs split by spaces, values empty or with spaces, quotes or = quoted as Go strings, decoding to this object.`,
+				fields),
+			"csv": arraySchema("csv response", "CSV record of the values, without header.", fields, values),
+		},
+	}, nil
+}
+
+// writeSchemas writes the response schemas of profile as JSON.
+func writeSchemas(w io.Writer, profile string) error {
+	s, err := responseSchemas(profile)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// schemaCmd prints the JSON Schema of the responses of each format and
+// version.
+func schemaCmd(args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	profile := fs.String("profile", "full", "Response profile: minimal, standard or full")
+	fs.Parse(args)
+	if err := writeSchemas(os.Stdout, *profile); err != nil {
+		return fmt.Errorf("schema: %v", err)
+	}
+	return nil
+}
+
+// schemaHandler serves the response schemas of the profile query
+// parameter, the server profile by default.
+func (h *handle) schemaHandler(w http.ResponseWriter, r *http.Request) {
+	profile := r.FormValue("profile")
+	if profile == "" {
+		for name, level := range profiles {
+			if level == h.level {
+				profile = name
+			}
+		}
+	}
+	if _, err := parseProfile(profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	writeSchemas(w, profile)
+}
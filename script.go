@@ -0,0 +1,95 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"go.starlark.net/starlark"
+)
+
+// maxScriptSteps bounds the work of a script call, so that a buggy
+// script can't stall the handler.
+const maxScriptSteps = 100000
+
+var scriptErrors = newCounter("freegeoip_dns_script_errors_total", "Failed calls of the response script.")
+
+// script is a Starlark script customizing responses. It must define
+//
+//	def respond(ip, client, fields):
+//	    return {"field": "value"}
+//
+// where ip is the queried IP, client the IP of the client and fields a
+// dict of the response fields by name. The dict returned, or None,
+// overrides fields like DNS UPDATE overrides do: existing fields get the
+// new values and new ones are appended.
+type script struct {
+	file    string
+	respond starlark.Callable
+}
+
+// loadScript loads the script in file.
+func loadScript(file string) (*script, error) {
+	thread := &starlark.Thread{Name: "load", Print: scriptPrint}
+	globals, err := starlark.ExecFile(thread, file, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	globals.Freeze()
+	fn, ok := globals["respond"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s: no respond function", file)
+	}
+	return &script{file: file, respond: fn}, nil
+}
+
+func scriptPrint(_ *starlark.Thread, msg string) {
+	log.Println("script:", msg)
+}
+
+// apply calls the respond function of the script and applies the fields
+// it returns. The fields are left as they are if the script fails.
+func (s *script) apply(ip, client net.IP, fields []field) []field {
+	d := starlark.NewDict(len(fields))
+	for _, f := range fields {
+		d.SetKey(starlark.String(f.name), starlark.String(f.value))
+	}
+	thread := &starlark.Thread{Name: "respond", Print: scriptPrint}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	args := starlark.Tuple{starlark.String(ip.String()), starlark.String(client.String()), d}
+	ret, err := starlark.Call(thread, s.respond, args, nil)
+	if err != nil {
+		scriptErrors.inc()
+		log.Printf("script %s: %v", s.file, err)
+		return fields
+	}
+	if ret == starlark.None {
+		return fields
+	}
+	rd, ok := ret.(*starlark.Dict)
+	if !ok {
+		scriptErrors.inc()
+		log.Printf("script %s: respond returned %s, want dict or None", s.file, ret.Type())
+		return fields
+	}
+	set := make(map[string]string, rd.Len())
+	for _, kv := range rd.Items() {
+		k, ok := starlark.AsString(kv[0])
+		if !ok {
+			scriptErrors.inc()
+			log.Printf("script %s: field name %s is not a string", s.file, kv[0])
+			return fields
+		}
+		if v, ok := starlark.AsString(kv[1]); ok {
+			set[k] = v
+		} else {
+			set[k] = kv[1].String()
+		}
+	}
+	return setFields(fields, set)
+}
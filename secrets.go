@@ -0,0 +1,200 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SecretProvider returns secrets by reference, e.g. a file name or the
+// path of a secret in a vault, so that they are not given on the command
+// line, where they show in process listings.
+type SecretProvider interface {
+	Secret(ref string) (string, error)
+}
+
+// secretProviders are the providers of secret references, by name.
+var secretProviders = make(map[string]SecretProvider)
+
+// registerSecretProvider makes p resolve the {{name:ref}} references. It
+// panics if the name is already registered.
+func registerSecretProvider(name string, p SecretProvider) {
+	if _, ok := secretProviders[name]; ok {
+		panic("secret provider " + name + " already registered")
+	}
+	secretProviders[name] = p
+}
+
+func init() {
+	registerSecretProvider("file", fileSecrets{})
+	registerSecretProvider("env", envSecrets{})
+	registerSecretProvider("vault", &vaultSecrets{client: &http.Client{Timeout: 10 * time.Second}})
+}
+
+// secretRefFlags are the flags that may have secret references besides
+// secretFlags: the URLs of databases and sinks, which may carry license
+// keys and passwords.
+var secretRefFlags = map[string]bool{
+	"db":        true,
+	"asn-db":    true,
+	"log-sink":  true,
+	"publish":   true,
+	"otlp-logs": true,
+}
+
+var secretRef = regexp.MustCompile(`\{\{([a-z]+):([^{}]+)\}\}`)
+
+// secretRefs maps the values of the flags with secret references to the
+// values as given, which are printed instead by redact.
+var secretRefs = make(map[string]string)
+
+// resolveSecret returns v with the secret references replaced.
+func resolveSecret(v string) (string, error) {
+	var err error
+	ret := secretRef.ReplaceAllStringFunc(v, func(ref string) string {
+		m := secretRef.FindStringSubmatch(ref)
+		p, ok := secretProviders[m[1]]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("unknown secret provider %q, want one of %s", m[1], strings.Join(secretProviderNames(), ", "))
+			}
+			return ref
+		}
+		s, perr := p.Secret(m[2])
+		if perr != nil && err == nil {
+			err = fmt.Errorf("secret %s: %v", ref, perr)
+		}
+		return s
+	})
+	if err != nil {
+		return "", err
+	}
+	if ret != v {
+		secretRefs[ret] = v
+	}
+	return ret, nil
+}
+
+// secretProviderNames returns the names of the secret providers, sorted.
+func secretProviderNames() []string {
+	names := make([]string, 0, len(secretProviders))
+	for name := range secretProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveSecrets replaces the secret references in the values of the
+// flags set on the command line.
+func resolveSecrets() error {
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err != nil || !secretFlags[f.Name] && !secretRefFlags[f.Name] {
+			return
+		}
+		if l, ok := f.Value.(*listFlag); ok {
+			for i, v := range *l {
+				if (*l)[i], err = resolveSecret(v); err != nil {
+					err = fmt.Errorf("-%s: %v", f.Name, err)
+					return
+				}
+			}
+			return
+		}
+		v, rerr := resolveSecret(f.Value.String())
+		if rerr == nil {
+			rerr = f.Value.Set(v)
+		}
+		if rerr != nil {
+			err = fmt.Errorf("-%s: %v", f.Name, rerr)
+		}
+	})
+	return err
+}
+
+// fileSecrets reads secrets from files, e.g. mounted by the container
+// runtime, without the trailing newline.
+type fileSecrets struct{}
+
+func (fileSecrets) Secret(ref string) (string, error) {
+	b, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// envSecrets reads secrets from environment variables.
+type envSecrets struct{}
+
+func (envSecrets) Secret(ref string) (string, error) {
+	v, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s not set", ref)
+	}
+	return v, nil
+}
+
+// vaultSecrets reads secrets from a HashiCorp Vault KV engine at
+// $VAULT_ADDR, with the token in $VAULT_TOKEN. The references are paths
+// followed by #field, the field defaulting to value, e.g.
+// secret/data/geodns#tsig for version 2 of the engine.
+type vaultSecrets struct {
+	client *http.Client
+}
+
+func (v *vaultSecrets) Secret(ref string) (string, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", errors.New("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	path, field := ref, "value"
+	if i := strings.LastIndexByte(ref, '#'); i >= 0 {
+		path, field = ref[:i], ref[i+1:]
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault: %s", resp.Status)
+	}
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("vault: %v", err)
+	}
+	data := secret.Data
+	// Version 2 of the KV engine nests the fields in data.data.
+	if raw, ok := data["data"]; ok && data["metadata"] != nil {
+		data = nil
+		if err = json.Unmarshal(raw, &data); err != nil {
+			return "", fmt.Errorf("vault: %v", err)
+		}
+	}
+	var s string
+	if err = json.Unmarshal(data[field], &s); err != nil {
+		return "", fmt.Errorf("vault: no string field %q in %s", field, path)
+	}
+	return s, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// selftestCmd queries a running server for a known IP and checks the
+// structure of the answer, for post-deploy validation.
+func selftestCmd(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	target := fs.String("target", "127.0.0.1:5300", "Address in form of host:port of the server to check")
+	domain := fs.String("domain", "", "Domain of the server")
+	ip := fs.String("ip", "8.8.8.8", "IP to query")
+	country := fs.String("country", "", "Expected country code of -ip, not checked if empty")
+	timeout := fs.Duration("timeout", 5*time.Second, "Query timeout")
+	fs.Parse(args)
+
+	if net.ParseIP(*ip) == nil {
+		return fmt.Errorf("selftest: invalid -ip %q", *ip)
+	}
+	m := new(dns.Msg)
+	// The v2 schema has fixed fields, so the answer can be checked
+	// regardless of the server profile.
+	m.SetQuestion(dns.Fqdn(join("v2", *ip, *domain)), dns.TypeTXT)
+	c := &dns.Client{Timeout: *timeout}
+	start := time.Now()
+	r, _, err := c.Exchange(m, *target)
+	if err != nil {
+		return fmt.Errorf("selftest: %v", err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("selftest: got rcode %s, want NOERROR", dns.RcodeToString[r.Rcode])
+	}
+	if len(r.Answer) != 1 {
+		return fmt.Errorf("selftest: got %d answers, want 1", len(r.Answer))
+	}
+	t, ok := r.Answer[0].(*dns.TXT)
+	if !ok || len(t.Txt) == 0 {
+		return errors.New("selftest: answer is not a TXT record")
+	}
+	fields := strings.Split(t.Txt[0], versions["v2"].sep)
+	if len(fields) < 3 {
+		return fmt.Errorf("selftest: got %d fields, want at least 3: %q", len(fields), t.Txt[0])
+	}
+	if !net.ParseIP(fields[0]).Equal(net.ParseIP(*ip)) {
+		return fmt.Errorf("selftest: got ip %q, want %s", fields[0], *ip)
+	}
+	if *country != "" && !strings.EqualFold(fields[1], *country) {
+		return fmt.Errorf("selftest: got country %q, want %s", fields[1], *country)
+	}
+	fmt.Printf("ok %s %s\n", time.Since(start).Round(time.Millisecond), t.Txt[0])
+	return nil
+}
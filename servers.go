@@ -0,0 +1,188 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	registerTransport("udp", func(fs *flag.FlagSet) func(env *transportEnv) (Transport, error) {
+		return func(env *transportEnv) (Transport, error) {
+			return &dnsTransport{name: "udp", network: env.net, addr: env.addr, srv: &dns.Server{Net: env.net, TsigSecret: env.tsigSecret}}, nil
+		}
+	})
+	registerTransport("tcp", func(fs *flag.FlagSet) func(env *transportEnv) (Transport, error) {
+		enabled := fs.Bool("tcp", true, "Also listen on TCP on -addr, for the answers truncated over UDP")
+		return func(env *transportEnv) (Transport, error) {
+			if !*enabled {
+				return nil, nil
+			}
+			// The TCP listener is on the same address, for the answers
+			// truncated over UDP.
+			network := "tcp" + strings.TrimPrefix(env.net, "udp")
+			return newStreamTransport("tcp", network, env.addr, nil, env, "tcp"), nil
+		}
+	})
+	registerTransport("tls", func(fs *flag.FlagSet) func(env *transportEnv) (Transport, error) {
+		addr := fs.String("tls-addr", "", "Address in form of ip:port for the DNS over TLS listener, e.g. :853, disabled if empty")
+		tlsNet := fs.String("tls-net", "", "Network of the DNS over TLS listener: tcp (dual-stack), tcp4 or tcp6, inferred from -tls-addr if empty")
+		cert := fs.String("tls-cert", "", "PEM certificate file of -tls-addr")
+		key := fs.String("tls-key", "", "PEM private key file of -tls-addr")
+		return func(env *transportEnv) (Transport, error) {
+			if *addr == "" {
+				return nil, nil
+			}
+			network, err := listenNet("tcp", *tlsNet, *addr)
+			if err != nil {
+				return nil, err
+			}
+			cfg, err := loadTLSConfig(*cert, *key)
+			if err != nil {
+				return nil, err
+			}
+			return newStreamTransport("tls", network, *addr, cfg, env, "tcp-tls"), nil
+		}
+	})
+	registerTransport("unix", func(fs *flag.FlagSet) func(env *transportEnv) (Transport, error) {
+		path := fs.String("unix-socket", "", "Path of a Unix socket to also answer DNS over TCP framing on, e.g. for a local proxy, disabled if empty")
+		return func(env *transportEnv) (Transport, error) {
+			if *path == "" {
+				return nil, nil
+			}
+			return newStreamTransport("unix", "unix", *path, nil, env, "tcp"), nil
+		}
+	})
+}
+
+// dnsTransport is a transport served by the dns package: UDP, or a stream
+// transport, TCP, TLS or Unix, with the connection limits of its env.
+type dnsTransport struct {
+	name    string
+	network string // of the listener, e.g. udp4 or unix
+	addr    string
+	tls     *tls.Config   // nil if not over TLS
+	limits  *streamLimits // nil for UDP
+	srv     *dns.Server
+}
+
+// newStreamTransport returns the named stream transport listening on
+// network and addr, over TLS with cfg if not nil. srvNet is the network
+// of its dns.Server, tcp or tcp-tls.
+func newStreamTransport(name, network, addr string, cfg *tls.Config, env *transportEnv, srvNet string) *dnsTransport {
+	srv := &dns.Server{Net: srvNet, TsigSecret: env.tsigSecret}
+	env.limits.apply(srv)
+	return &dnsTransport{name: name, network: network, addr: addr, tls: cfg, limits: &env.limits, srv: srv}
+}
+
+func (t *dnsTransport) Name() string { return t.name }
+
+func (t *dnsTransport) String() string {
+	if t.tls != nil {
+		return t.network + "-tls " + t.addr
+	}
+	return t.network + " " + t.addr
+}
+
+func (t *dnsTransport) Listen() error {
+	t.srv.MsgAcceptFunc = acceptMsg
+	if t.limits == nil {
+		pc, err := net.ListenPacket(t.network, t.addr)
+		if err != nil {
+			return err
+		}
+		t.srv.PacketConn = pc
+		return nil
+	}
+	if t.network == "unix" {
+		removeStaleSocket(t.addr)
+	}
+	ln, err := t.limits.listen(t.network, t.addr, t.name, t.tls)
+	if err != nil {
+		return err
+	}
+	t.srv.Listener = ln
+	return nil
+}
+
+func (t *dnsTransport) Serve(h dns.Handler) error {
+	if t.network == "unix" {
+		h = localClients(h)
+	}
+	t.srv.Handler = h
+	return t.srv.ActivateAndServe()
+}
+
+func (t *dnsTransport) Shutdown(ctx context.Context) error {
+	return t.srv.ShutdownContext(ctx)
+}
+
+// removeStaleSocket removes the Unix socket left at path by a previous
+// run, so that it can be listened on again. Other files, and the sockets
+// still listened on, are left alone, for the listener to fail on.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// loopback is the client address of the queries over Unix sockets,
+// which have none: they come from the host, so they are located,
+// limited and logged as local ones.
+var loopback = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// localClients returns h seeing the clients as loopback.
+func localClients(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		h.ServeDNS(localWriter{w}, r)
+	})
+}
+
+// localWriter is a dns.ResponseWriter with loopback as client address.
+type localWriter struct{ dns.ResponseWriter }
+
+func (localWriter) RemoteAddr() net.Addr { return loopback }
+
+// listen returns a listener on addr with the connection limits of l,
+// over TLS with cfg if not nil. name labels the connection metrics.
+func (l streamLimits) listen(network, addr, name string, cfg *tls.Config) (net.Listener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ln = l.wrap(ln, name)
+	if cfg != nil {
+		ln = tls.NewListener(ln, cfg)
+	}
+	return ln, nil
+}
+
+// loadTLSConfig returns the TLS config of the listeners over TLS.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("a certificate and a key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
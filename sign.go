@@ -0,0 +1,29 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// hmacLen is the length the response HMAC is truncated to, in bytes.
+const hmacLen = 16
+
+// signResponse returns the TXT string authenticating the response resp
+// to the query name qname with key: hmac= followed by the base64 of the
+// HMAC-SHA256 of the lowercased name and the response, separated by a
+// newline, truncated to hmacLen bytes. The name is included so that a
+// relay can't pass off the answer for one IP as that of another.
+func signResponse(key []byte, qname, resp string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(qname)))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(resp))
+	return "hmac=" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:hmacLen])
+}
@@ -0,0 +1,229 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log rows are buffered and inserted in batches of up to
+// sinkBatchLen rows, at least every sinkFlushIntvl. Rows are dropped
+// when sinkQueueLen rows are waiting.
+const (
+	sinkQueueLen   = 50000
+	sinkBatchLen   = 1000
+	sinkFlushIntvl = time.Second
+)
+
+var sinkRows = newCounter("freegeoip_dns_log_sink_rows_total", "Access log rows exported, by result: inserted, dropped or error.", "result")
+
+// sink inserts batches of access log rows into a database.
+type sink interface {
+	insert(rows []queryEvent) error
+}
+
+// newSink returns the sink of dsn, given as
+// clickhouse://[user:password@]host:port/db.table for the HTTP interface
+// of ClickHouse or bigquery://project/dataset/table for BigQuery streaming
+// inserts, authenticated with the service account of the GCE instance.
+func newSink(dsn string) (sink, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	path := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "clickhouse":
+		if path == "" {
+			return nil, fmt.Errorf("log sink: missing table in %q", dsn)
+		}
+		q := url.Values{
+			"query": {"INSERT INTO " + path + " FORMAT JSONEachRow"},
+			// Times are sent in RFC 3339.
+			"date_time_input_format": {"best_effort"},
+		}
+		s := &clickhouseSink{url: "http://" + u.Host + "/?" + q.Encode()}
+		if u.User != nil {
+			s.user = u.User.Username()
+			s.password, _ = u.User.Password()
+		}
+		return s, nil
+	case "bigquery":
+		p := strings.Split(path, "/")
+		if u.Host == "" || len(p) != 2 {
+			return nil, fmt.Errorf("log sink: want bigquery://project/dataset/table, got %q", dsn)
+		}
+		return &bigquerySink{url: fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll", u.Host, p[0], p[1])}, nil
+	}
+	return nil, fmt.Errorf("log sink: unknown database %q, want clickhouse or bigquery", u.Scheme)
+}
+
+var sinkClient = &http.Client{Timeout: 30 * time.Second}
+
+// checkResponse returns an error for failed HTTP responses, and closes
+// their body.
+func checkResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+}
+
+type clickhouseSink struct {
+	url            string
+	user, password string
+}
+
+func (s *clickhouseSink) insert(rows []queryEvent) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, r := range rows {
+		enc.Encode(r)
+	}
+	req, err := http.NewRequest("POST", s.url, &b)
+	if err != nil {
+		return err
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp)
+}
+
+// gceTokenURL is the metadata server endpoint returning access tokens of
+// the service account of the instance.
+const gceTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+type bigquerySink struct {
+	url string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// accessToken returns the access token of the instance, refreshed a
+// minute before it expires.
+func (s *bigquerySink) accessToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.expires.Add(-time.Minute)) {
+		return s.token, nil
+	}
+	req, err := http.NewRequest("GET", gceTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("access token: %s", resp.Status)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	s.token, s.expires = t.AccessToken, time.Now().Add(time.Duration(t.ExpiresIn)*time.Second)
+	return s.token, nil
+}
+
+func (s *bigquerySink) insert(rows []queryEvent) error {
+	type row struct {
+		JSON queryEvent `json:"json"`
+	}
+	body := struct {
+		Rows []row `json:"rows"`
+	}{}
+	for _, r := range rows {
+		body.Rows = append(body.Rows, row{r})
+	}
+	b, _ := json.Marshal(body)
+	token, err := s.accessToken()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return checkResponse(resp)
+	}
+	// Rows can fail individually in successful responses.
+	var res struct {
+		InsertErrors []json.RawMessage `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if len(res.InsertErrors) > 0 {
+		return errors.New("insert errors: " + string(res.InsertErrors[0]))
+	}
+	return nil
+}
+
+// exportLog inserts a row for every answer into s, in batches.
+func exportLog(s sink) {
+	queue := answerQueue(sinkQueueLen, sinkRows)
+	go func() {
+		var batch []queryEvent
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := s.insert(batch); err != nil {
+				sinkRows.add(float64(len(batch)), "error")
+				log.Println("log sink:", err)
+			} else {
+				sinkRows.add(float64(len(batch)), "inserted")
+			}
+			batch = batch[:0]
+		}
+		tick := time.NewTicker(sinkFlushIntvl)
+		for {
+			select {
+			case a := <-queue:
+				if batch = append(batch, newQueryEvent(a)); len(batch) >= sinkBatchLen {
+					flush()
+				}
+			case <-tick.C:
+				flush()
+			}
+		}
+	}()
+}
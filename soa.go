@@ -0,0 +1,52 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// soa returns the SOA record of the domain. The serial is the build
+// epoch of the loaded database, and the minimum, how long resolvers
+// cache negative answers (RFC 2308), the negative TTL of the policy.
+func (h *handle) soa() *dns.SOA {
+	zone := dns.Fqdn(h.domain)
+	var serial uint32 = 1
+	if meta := h.info.get(); meta != nil {
+		serial = uint32(meta.BuildEpoch)
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: h.policy.negativeTTL},
+		Ns:      "ns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  h.policy.negativeTTL,
+	}
+}
+
+// addSOA adds the SOA of the domain to the authority section of m if it
+// is a negative answer, NXDOMAIN or NODATA, to a query r for a name in
+// the domain, so that resolvers cache it.
+func (h *handle) addSOA(m, r *dns.Msg) {
+	if h.domain == "" || r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 || len(m.Ns) > 0 {
+		return
+	}
+	if m.Rcode != dns.RcodeNameError && (m.Rcode != dns.RcodeSuccess || len(m.Answer) > 0) {
+		return
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return
+	}
+	if _, ok := stripDomain(q.Name, h.domain); ok || strings.EqualFold(strings.TrimSuffix(q.Name, "."), strings.TrimSuffix(h.domain, ".")) {
+		m.Ns = append(m.Ns, h.soa())
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	socketDrops   = newCounter("freegeoip_dns_udp_socket_drops_total", "Queries dropped by the kernel before being read, e.g. because the receive buffer was full.")
+	socketRxQueue = newGauge("freegeoip_dns_udp_socket_rx_queue_bytes", "Bytes waiting in the receive buffer of the UDP socket.")
+)
+
+// udpSocketFiles are the Linux socket tables read by watchSocket.
+var udpSocketFiles = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+// udpSocketStats returns the receive queue and drop counts of the UDP
+// sockets bound to port, read from the kernel socket tables.
+func udpSocketStats(port int) (rxQueue, drops uint64, err error) {
+	for _, name := range udpSocketFiles {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		s := bufio.NewScanner(f)
+		s.Scan() // header
+		for s.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:when
+			// retrnsmt uid timeout inode ref pointer drops
+			fs := strings.Fields(s.Text())
+			if len(fs) < 13 {
+				continue
+			}
+			i := strings.LastIndex(fs[1], ":")
+			p, err := strconv.ParseUint(fs[1][i+1:], 16, 16)
+			if err != nil || int(p) != port {
+				continue
+			}
+			q := strings.SplitN(fs[4], ":", 2)
+			if len(q) == 2 {
+				n, _ := strconv.ParseUint(q[1], 16, 64)
+				rxQueue += n
+			}
+			n, _ := strconv.ParseUint(fs[12], 10, 64)
+			drops += n
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return rxQueue, drops, nil
+}
+
+// watchSocket exports the kernel statistics of the UDP socket listening
+// on addr every intvl. It returns an error when they are not available,
+// e.g. on systems other than Linux.
+func watchSocket(addr string, intvl time.Duration) error {
+	_, ps, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := net.LookupPort("udp", ps)
+	if err != nil {
+		return fmt.Errorf("invalid port in %q: %v", addr, err)
+	}
+	if _, err := os.Stat(udpSocketFiles[0]); err != nil {
+		return fmt.Errorf("socket statistics not available: %v", err)
+	}
+	var last uint64
+	tasks.start(&task{name: "socket-stats", intvl: intvl, run: func() error {
+		rx, drops, err := udpSocketStats(port)
+		if err != nil {
+			return fmt.Errorf("socket statistics: %v", err)
+		}
+		socketRxQueue.set(float64(rx))
+		// Drops reset when the socket is recreated.
+		if drops < last {
+			last = 0
+		}
+		socketDrops.add(float64(drops - last))
+		last = drops
+		return nil
+	}})
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// dumpStatsOnSignal logs a snapshot of the runtime stats on each SIGUSR1,
+// for a quick diagnostic without the admin server.
+func dumpStatsOnSignal(info *dbInfo) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	last, lastQueries := time.Now(), totalQueries()
+	for range c {
+		now, queries := time.Now(), totalQueries()
+		qps := (queries - lastQueries) / now.Sub(last).Seconds()
+		last, lastQueries = now, queries
+		dumpStats(info, qps)
+	}
+}
+
+// dumpStats logs the query rate, in-flight queries, database age, cache
+// hit rate, goroutines and memory in use.
+func dumpStats(info *dbInfo, qps float64) {
+	age := "unknown"
+	if m := info.get(); m != nil {
+		age = time.Since(m.BuildTime).Round(time.Second).String()
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	hitRate := "-"
+	if c := cacheLookups.snapshot(); c["hit"]+c["miss"] > 0 {
+		hitRate = fmt.Sprintf("%.2f", c["hit"]/(c["hit"]+c["miss"]))
+	}
+	log.Printf("stats: qps=%.1f inflight=%d db_age=%s cache_hit_rate=%s goroutines=%d heap_mib=%.1f sys_mib=%.1f gc=%d",
+		qps, atomic.LoadInt64(&inflight), age, hitRate, runtime.NumGoroutine(),
+		float64(mem.HeapAlloc)/(1<<20), float64(mem.Sys)/(1<<20), mem.NumGC)
+}
+
+// totalQueries returns the number of queries answered so far.
+func totalQueries() float64 {
+	var n float64
+	for _, x := range queriesTotal.snapshot() {
+		n += x
+	}
+	return n
+}
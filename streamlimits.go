@@ -0,0 +1,108 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	streamConns         = newGauge("freegeoip_dns_stream_connections", "Open connections to the stream listeners, by listener: tcp, tls, https or unix.", "listener")
+	streamConnsRejected = newCounter("freegeoip_dns_stream_connections_rejected_total", "Connections to the stream listeners closed at once for being over the max of open connections, by listener.", "listener")
+)
+
+// streamLimits bound the resources held by the clients of the stream
+// listeners, TCP and DNS over TLS, so that slow or idle clients can't
+// exhaust them: each query must be read within readTimeout, connections
+// are closed after idleTimeout without queries or after maxQueries, and
+// at most maxConns are open at once.
+type streamLimits struct {
+	readTimeout time.Duration
+	idleTimeout time.Duration
+	maxQueries  int // 0 for no limit
+	maxConns    int // 0 for no limit
+}
+
+// defaultStreamLimits are the limits of the dns package, with at most
+// 1000 connections at once.
+var defaultStreamLimits = streamLimits{
+	readTimeout: 2 * time.Second,
+	idleTimeout: 8 * time.Second,
+	maxQueries:  128,
+	maxConns:    1000,
+}
+
+// apply sets the timeouts and query limit of srv.
+func (l streamLimits) apply(srv *dns.Server) {
+	srv.ReadTimeout = l.readTimeout
+	srv.IdleTimeout = func() time.Duration { return l.idleTimeout }
+	srv.MaxTCPQueries = l.maxQueries
+	if l.maxQueries == 0 {
+		srv.MaxTCPQueries = -1
+	}
+}
+
+// wrap returns ln closing the connections over maxConns as soon as they
+// are accepted, before any TLS handshake. name labels the metrics.
+func (l streamLimits) wrap(ln net.Listener, name string) net.Listener {
+	cl := &connLimitListener{Listener: ln, name: name}
+	if l.maxConns > 0 {
+		cl.sem = make(chan struct{}, l.maxConns)
+	}
+	streamConns.set(0, name)
+	return cl
+}
+
+// connLimitListener is a net.Listener with a max of open connections.
+type connLimitListener struct {
+	net.Listener
+	name string
+	sem  chan struct{} // nil for no limit
+	open int64
+}
+
+func (ln *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ln.sem != nil {
+			select {
+			case ln.sem <- struct{}{}:
+			default:
+				streamConnsRejected.inc(ln.name)
+				c.Close()
+				continue
+			}
+		}
+		streamConns.set(float64(atomic.AddInt64(&ln.open, 1)), ln.name)
+		return &limitedConn{Conn: c, ln: ln}, nil
+	}
+}
+
+// limitedConn is a connection of a connLimitListener, releasing its slot
+// when closed.
+type limitedConn struct {
+	net.Conn
+	ln   *connLimitListener
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		streamConns.set(float64(atomic.AddInt64(&c.ln.open, -1)), c.ln.name)
+		if c.ln.sem != nil {
+			<-c.ln.sem
+		}
+	})
+	return c.Conn.Close()
+}
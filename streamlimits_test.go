@@ -0,0 +1,188 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTCPServer serves h over TCP on an ephemeral port of 127.0.0.1,
+// with the given limits, and returns its address.
+func startTCPServer(t *testing.T, h *handle, limits streamLimits) string {
+	t.Helper()
+	mux := dns.NewServeMux()
+	mux.Handle(dns.Fqdn(h.domain), h)
+	tr := newStreamTransport("tcp", "tcp", "127.0.0.1:0", nil, &transportEnv{limits: limits}, "tcp")
+	if err := tr.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	serveTransports(t, mux, tr)
+	return tr.srv.Listener.Addr().String()
+}
+
+// dialQuery opens a connection to addr with c, over tcp or tcp-tls, and
+// sends a query on it. It returns the connection if answered, and nil if
+// closed by the server.
+func dialQuery(t *testing.T, c *dns.Client, addr string) *dns.Conn {
+	t.Helper()
+	co, err := c.Dial(addr)
+	if err != nil {
+		// The TLS handshake fails on the connections closed at once.
+		if c.Net == "tcp-tls" {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	if _, _, err := c.ExchangeWithConn(txtQuery("8.8.8.8"), co); err != nil {
+		co.Close()
+		return nil
+	}
+	return co
+}
+
+func TestStreamMaxConns(t *testing.T) {
+	limits := defaultStreamLimits
+	limits.maxConns = 2
+	h := newTestHandle(t, fixtureDB)
+	dot, cfg := startTLSServer(t, h, limits)
+	for _, c := range []*dns.Client{
+		{Net: "tcp", Timeout: 2 * time.Second},
+		{Net: "tcp-tls", TLSConfig: cfg, Timeout: 2 * time.Second},
+	} {
+		addr := dot
+		if c.Net == "tcp" {
+			addr = startTCPServer(t, h, limits)
+		}
+		var open []*dns.Conn
+		for i := 0; i < limits.maxConns; i++ {
+			co := dialQuery(t, c, addr)
+			if co == nil {
+				t.Fatalf("%s: got connection %d of %d closed", c.Net, i+1, limits.maxConns)
+			}
+			open = append(open, co)
+		}
+		if co := dialQuery(t, c, addr); co != nil {
+			co.Close()
+			t.Errorf("%s: got a query answered over the connection past the max of %d", c.Net, limits.maxConns)
+		}
+
+		// Closing a connection frees its slot, once the server sees it.
+		open[0].Close()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			co := dialQuery(t, c, addr)
+			if co != nil {
+				co.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: got the connections closed after one of %d was", c.Net, limits.maxConns)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, co := range open[1:] {
+			co.Close()
+		}
+	}
+}
+
+func TestStreamMaxQueries(t *testing.T) {
+	limits := defaultStreamLimits
+	limits.maxQueries = 3
+	addr := startTCPServer(t, newTestHandle(t, fixtureDB), limits)
+	c := &dns.Client{Net: "tcp", Timeout: 2 * time.Second}
+	co, err := c.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer co.Close()
+	for i := 0; i < limits.maxQueries; i++ {
+		if _, _, err := c.ExchangeWithConn(txtQuery("8.8.8.8"), co); err != nil {
+			t.Fatalf("query %d of %d: %v", i+1, limits.maxQueries, err)
+		}
+	}
+	if _, _, err := c.ExchangeWithConn(txtQuery("8.8.8.8"), co); err == nil {
+		t.Errorf("got a query answered past the max of %d per connection", limits.maxQueries)
+	}
+}
+
+// startDoHServer serves h over plain HTTP DoH on an ephemeral port of
+// 127.0.0.1, with the given limits, and returns its address.
+func startDoHServer(t *testing.T, h *handle, limits streamLimits) string {
+	t.Helper()
+	mux := dns.NewServeMux()
+	mux.Handle(dns.Fqdn(h.domain), h)
+	tr := &dohTransport{network: "tcp", addr: "127.0.0.1:0", path: "/dns-query", limits: limits}
+	if err := tr.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	serveTransports(t, mux, tr)
+	return tr.ln.Addr().String()
+}
+
+func TestDoHMaxQueries(t *testing.T) {
+	limits := defaultStreamLimits
+	limits.maxQueries = 3
+	addr := startDoHServer(t, newTestHandle(t, fixtureDB), limits)
+	var dials int64
+	d := &net.Dialer{}
+	client := &http.Client{Timeout: 2 * time.Second, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt64(&dials, 1)
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	b, err := txtQuery("8.8.8.8").Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + addr + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(b)
+	const queries = 7
+	for i := 0; i < queries; i++ {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("query %d: %v", i+1, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("query %d: %s", i+1, resp.Status)
+		}
+	}
+	if got, want := atomic.LoadInt64(&dials), int64((queries+limits.maxQueries-1)/limits.maxQueries); got != want {
+		t.Errorf("%d queries with a max of %d per connection: got %d connections, want %d", queries, limits.maxQueries, got, want)
+	}
+}
+
+func TestDoHReadTimeout(t *testing.T) {
+	limits := defaultStreamLimits
+	limits.readTimeout = 200 * time.Millisecond
+	addr := startDoHServer(t, newTestHandle(t, fixtureDB), limits)
+	co, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer co.Close()
+	// The headers come at once, the body never.
+	if _, err := io.WriteString(co, "POST /dns-query HTTP/1.1\r\nHost: geo\r\nContent-Type: "+dohContentType+"\r\nContent-Length: 64\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	co.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	io.Copy(io.Discard, co)
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("got the connection of a stalled request body open for %v, want it closed after %v", d, limits.readTimeout)
+	}
+}
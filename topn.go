@@ -0,0 +1,87 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyCount is a key and its count in a topN.
+type keyCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// topN tracks the most frequent keys with bounded memory, using the
+// space-saving algorithm: when full, the least frequent key is replaced
+// and its count inherited, overestimating rare keys rather than missing
+// frequent ones.
+type topN struct {
+	mu     sync.Mutex
+	size   int
+	counts map[string]uint64
+}
+
+func newTopN(size int) *topN {
+	return &topN{size: size, counts: make(map[string]uint64, size)}
+}
+
+// add counts one occurrence of k.
+func (t *topN) add(k string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.counts[k]; ok {
+		t.counts[k] = c + 1
+		return
+	}
+	if len(t.counts) < t.size {
+		t.counts[k] = 1
+		return
+	}
+	var minKey string
+	var minCount uint64
+	for mk, c := range t.counts {
+		if minKey == "" || c < minCount {
+			minKey, minCount = mk, c
+		}
+	}
+	delete(t.counts, minKey)
+	t.counts[k] = minCount + 1
+}
+
+// top returns the n most frequent keys, most frequent first.
+func (t *topN) top(n int) []keyCount {
+	t.mu.Lock()
+	ret := make([]keyCount, 0, len(t.counts))
+	for k, c := range t.counts {
+		ret = append(ret, keyCount{k, c})
+	}
+	t.mu.Unlock()
+	sortCounts(ret)
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+// reset clears the counts, so that the top reflects recent traffic.
+func (t *topN) reset() error {
+	t.mu.Lock()
+	t.counts = make(map[string]uint64, t.size)
+	t.mu.Unlock()
+	return nil
+}
+
+// sortCounts sorts counts by count, descending, then by key.
+func sortCounts(counts []keyCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const torExitList = "https://check.torproject.org/torbulkexitlist"
+
+// torExits is the set of known Tor exit node addresses.
+type torExits struct {
+	src   string
+	mu    sync.RWMutex
+	table *prefixTable
+}
+
+// newTorExits loads the exit list from src, a file or URL.
+func newTorExits(src string) (*torExits, error) {
+	te := &torExits{src: src}
+	return te, te.load()
+}
+
+// load (re)reads the exit list, keeping the previous one on failure.
+func (te *torExits) load() error {
+	rc, err := openSource(te.src)
+	if err != nil {
+		return fmt.Errorf("tor exit list: %v", err)
+	}
+	defer rc.Close()
+	t := newPrefixTable()
+	if err = readPrefixes(rc, t, ""); err != nil {
+		return fmt.Errorf("tor exit list: %v", err)
+	}
+	te.mu.Lock()
+	te.table = t
+	te.mu.Unlock()
+	return nil
+}
+
+// contains reports whether ip is a Tor exit node.
+func (te *torExits) contains(ip net.IP) bool {
+	te.mu.RLock()
+	defer te.mu.RUnlock()
+	_, ok := te.table.lookup(ip)
+	return ok
+}
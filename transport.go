@@ -0,0 +1,184 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	transportQueries = newCounter("freegeoip_dns_transport_queries_total", "Queries received, by transport: udp, tcp, tls, https or unix.", "transport")
+	transportUp      = newGauge("freegeoip_dns_transport_up", "Whether the transport is serving queries, by transport.", "transport")
+)
+
+// Transport is a listener of DNS queries, e.g. over UDP or TLS. The
+// transports are registered with registerTransport, and new ones, or
+// in-memory ones in tests, are served without changes to main.
+type Transport interface {
+	// Name returns the name the transport is registered with, labeling
+	// its metrics.
+	Name() string
+	// Listen binds the transport to its address, so that errors such as
+	// an address in use are reported before any transport is served.
+	Listen() error
+	// Serve answers the queries with h until Shutdown, returning nil
+	// then.
+	Serve(h dns.Handler) error
+	// Shutdown stops Serve, waiting until ctx is done for the queries
+	// being answered.
+	Shutdown(ctx context.Context) error
+	// String returns the network and address of the transport, for the
+	// logs.
+	String() string
+}
+
+// transportEnv is the configuration shared by the transports: the
+// address and network of -addr and -net, the TSIG keys and the limits of
+// the stream transports.
+type transportEnv struct {
+	addr       string
+	net        string // udp, udp4 or udp6
+	tsigSecret map[string]string
+	limits     streamLimits
+}
+
+// transportFactory defines the flags of a transport on fs, and returns
+// the func creating it once they are parsed, returning nil if the
+// transport isn't enabled.
+type transportFactory func(fs *flag.FlagSet) func(env *transportEnv) (Transport, error)
+
+var transportFactories = make(map[string]transportFactory)
+
+// registerTransport makes f create the transport with the given name. It
+// panics if the name is already registered, and is meant to be called
+// from init.
+func registerTransport(name string, f transportFactory) {
+	if _, dup := transportFactories[name]; dup {
+		panic("transport already registered: " + name)
+	}
+	transportFactories[name] = f
+}
+
+// defineTransports defines the flags of the registered transports on fs,
+// and returns the func creating the ones enabled by them.
+func defineTransports(fs *flag.FlagSet) func(env *transportEnv) (*transportGroup, error) {
+	names := make([]string, 0, len(transportFactories))
+	for name := range transportFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	makers := make([]func(env *transportEnv) (Transport, error), len(names))
+	for i, name := range names {
+		makers[i] = transportFactories[name](fs)
+	}
+	return func(env *transportEnv) (*transportGroup, error) {
+		g := &transportGroup{}
+		for i, mk := range makers {
+			t, err := mk(env)
+			if err != nil {
+				return nil, fmt.Errorf("%s transport: %v", names[i], err)
+			}
+			if t != nil {
+				g.transports = append(g.transports, t)
+			}
+		}
+		return g, nil
+	}
+}
+
+// transportHooks are called on the lifecycle events of the transports of
+// a group. Any may be nil.
+type transportHooks struct {
+	started func(t Transport)            // listening, before serving
+	stopped func(t Transport, err error) // done serving, err nil after Shutdown
+}
+
+// transportGroup serves a set of transports together with the same
+// handler.
+type transportGroup struct {
+	transports []Transport
+	hooks      []transportHooks
+}
+
+// onLifecycle adds hooks called by serve.
+func (g *transportGroup) onLifecycle(hooks transportHooks) {
+	g.hooks = append(g.hooks, hooks)
+}
+
+// serve listens on all the transports, then answers their queries with h
+// until one fails, returning its error, or until SIGINT or SIGTERM. The
+// transports are then shut down, waiting up to timeout for the queries
+// being answered.
+func (g *transportGroup) serve(h dns.Handler, timeout time.Duration) error {
+	for _, t := range g.transports {
+		if err := t.Listen(); err != nil {
+			return fmt.Errorf("%s: %v", t, err)
+		}
+	}
+	errc := make(chan error, len(g.transports))
+	for _, t := range g.transports {
+		for _, hk := range g.hooks {
+			if hk.started != nil {
+				hk.started(t)
+			}
+		}
+		transportUp.set(1, t.Name())
+		go func(t Transport) {
+			err := t.Serve(countQueries(t.Name(), h))
+			transportUp.set(0, t.Name())
+			for _, hk := range g.hooks {
+				if hk.stopped != nil {
+					hk.stopped(t, err)
+				}
+			}
+			if err != nil {
+				errc <- fmt.Errorf("%s: %v", t, err)
+			}
+		}(t)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case err := <-errc:
+		return err
+	case got := <-sig:
+		log.Printf("%s, shutting down", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, t := range g.transports {
+		wg.Add(1)
+		go func(t Transport) {
+			defer wg.Done()
+			if err := t.Shutdown(ctx); err != nil {
+				log.Printf("shutdown of %s: %v", t, err)
+			}
+		}(t)
+	}
+	wg.Wait()
+	return nil
+}
+
+// countQueries returns h counting the queries of the named transport.
+func countQueries(name string, h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		transportQueries.inc(name)
+		h.ServeDNS(w, r)
+	})
+}
@@ -0,0 +1,29 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import "net"
+
+// embeddedIPv4 returns the IPv4 address embedded in ip, which is where
+// the host is, rather than the tunnel endpoint: the address of
+// IPv4-mapped addresses, of the 6to4 site of 2002::/16 addresses (RFC
+// 3056), or the obfuscated address of the Teredo client of 2001::/32
+// addresses (RFC 4380). Other addresses are returned as is.
+func embeddedIPv4(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	if len(ip) != net.IPv6len {
+		return ip
+	}
+	switch {
+	case ip[0] == 0x20 && ip[1] == 0x02:
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5]).To4()
+	case ip[0] == 0x20 && ip[1] == 0x01 && ip[2] == 0 && ip[3] == 0:
+		return net.IPv4(^ip[12], ^ip[13], ^ip[14], ^ip[15]).To4()
+	}
+	return ip
+}
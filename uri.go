@@ -0,0 +1,40 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// uriTTL is the TTL of URI answers. The URL only depends on the queried
+// IP, so it can be cached for long.
+const uriTTL = 3600
+
+// uri answers URI queries (RFC 7553) with the URL of the HTTP
+// representation of the geolocation of the queried IP, made from
+// h.uriTemplate.
+func (h *handle) uri(start time.Time, w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	_, name := h.options(q.Name)
+	domain, _ := h.queryDomain(name)
+	ip, _, err := queryIP(name, domain, h.resolveTimeout)
+	if err != nil {
+		h.resolveFail(err, name, domain, start, w, r)
+		return
+	}
+	m := h.reply(r)
+	m.Answer = append(m.Answer, &dns.URI{
+		Hdr:      dns.RR_Header{Name: q.Name, Rrtype: dns.TypeURI, Class: dns.ClassINET, Ttl: uriTTL},
+		Priority: 10,
+		Weight:   1,
+		Target:   strings.Replace(h.uriTemplate, "{ip}", url.PathEscape(ip.String()), -1),
+	})
+	h.write(m, start, w, r)
+}
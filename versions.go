@@ -0,0 +1,128 @@
+// Copyright 2015 Murilo Santana <mvrilo@gmail.com> and the freegeoip authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// versionLayout is the timestamp suffix of archived database versions.
+const versionLayout = "20060102T150405Z"
+
+// archiveVersion moves the database file to a timestamped version, with
+// its validators, and deletes the oldest versions beyond keep.
+func archiveVersion(file string, keep int) error {
+	st, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	version := file + "." + st.ModTime().UTC().Format(versionLayout)
+	if err = os.Rename(file, version); err != nil {
+		return err
+	}
+	os.Rename(file+".validators", version+".validators")
+	versions, err := listVersions(file)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions[min(keep, len(versions)):] {
+		os.Remove(v)
+		os.Remove(v + ".validators")
+	}
+	return nil
+}
+
+// listVersions returns the archived versions of file, newest first.
+func listVersions(file string) ([]string, error) {
+	matches, err := filepath.Glob(file + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, m := range matches {
+		if _, err := time.Parse(versionLayout, strings.TrimPrefix(m, file+".")); err == nil {
+			versions = append(versions, m)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	return versions, nil
+}
+
+// rollback replaces the database file with the given archived version,
+// or the newest one if empty, and returns the version restored. The
+// validators of the replaced file are kept as rejected, so that the
+// updater does not download the same build again.
+func rollback(file, version string) (string, error) {
+	versions, err := listVersions(file)
+	if err != nil {
+		return "", err
+	}
+	if len(versions) == 0 {
+		return "", errors.New("no previous database versions")
+	}
+	v := versions[0]
+	if version != "" {
+		v = file + "." + version
+		found := false
+		for _, vv := range versions {
+			found = found || vv == v
+		}
+		if !found {
+			return "", fmt.Errorf("unknown database version %q", version)
+		}
+	}
+	if err = os.Rename(file+".validators", file+".rejected"); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	os.Rename(v+".validators", file+".validators")
+	if err = os.Rename(v, file); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(v, file+"."), nil
+}
+
+// rollbackCmd implements the rollback command, which restores a previous
+// version of a downloaded database. A running server loads it as soon as
+// the file changes.
+func rollbackCmd(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	ipdb := fs.String("db", maxmindFile, "IP database URL")
+	dbDir := fs.String("db-dir", filepath.Join(os.TempDir(), "freegeoip-dns"), "Directory of the downloaded databases")
+	version := fs.String("version", "", "Version to restore, defaults to the newest previous one")
+	list := fs.Bool("list", false, "List the previous versions and exit")
+	fs.Parse(args)
+
+	if !isURL(*ipdb) {
+		return errors.New("rollback: -db must be the URL of a downloaded database")
+	}
+	file := newDownloader(*ipdb, dbOptions{dir: *dbDir}).file
+	if *list {
+		versions, err := listVersions(file)
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			fmt.Println(strings.TrimPrefix(v, file+"."))
+		}
+		return nil
+	}
+	v, err := rollback(file, *version)
+	if err != nil {
+		return err
+	}
+	fmt.Println("rolled back to", v)
+	return nil
+}